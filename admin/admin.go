@@ -0,0 +1,313 @@
+// Package admin provides an http.Handler for inspecting and managing a set of
+// named caches at runtime, e.g. from a debug port.
+//
+// The handler serves JSON and is meant to be mounted under a prefix:
+//
+//	reg := admin.NewRegistry()
+//	reg.Register("deals", dealCache)
+//	http.Handle("/debug/cache/", http.StripPrefix("/debug/cache", admin.NewHandler(reg, false)))
+//
+// It exposes the following routes, relative to that prefix:
+//
+//	GET    /caches                        list the registered caches
+//	GET    /caches/{name}                 show a cache's stats, and its namespaces'
+//	GET    /caches/{name}/keys            list keys (?prefix=, ?cursor=, ?limit=)
+//	GET    /caches/{name}/keys/{key}      get an item and its expiration
+//	DELETE /caches/{name}/keys/{key}      delete an item
+//	POST   /caches/{name}/flush           delete all items
+//
+// In read-only mode, the DELETE and POST routes respond with 403 Forbidden.
+package admin
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Cache is the subset of *cache.Cache's methods the handler uses.
+type Cache interface {
+	Range(f func(k string, it cache.Item) bool)
+	ItemCount() int
+	GetWithExpiration(k string) (interface{}, time.Time, bool)
+	Delete(k string)
+	Flush()
+}
+
+// A Registry is a set of named caches. It is safe for concurrent use.
+type Registry struct {
+	mu     sync.RWMutex
+	caches map[string]Cache
+}
+
+// Return a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{caches: map[string]Cache{}}
+}
+
+// Register a cache under the given name, replacing any cache already
+// registered under it.
+func (r *Registry) Register(name string, c Cache) {
+	r.mu.Lock()
+	r.caches[name] = c
+	r.mu.Unlock()
+}
+
+// Remove the cache registered under the given name, if any.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	delete(r.caches, name)
+	r.mu.Unlock()
+}
+
+// Get the cache registered under the given name.
+func (r *Registry) Get(name string) (Cache, bool) {
+	r.mu.RLock()
+	c, found := r.caches[name]
+	r.mu.RUnlock()
+	return c, found
+}
+
+// Returns the names of the registered caches in sorted order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.caches))
+	for name := range r.caches {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+const (
+	defaultLimit = 100
+	maxLimit     = 10000
+)
+
+// Stats is the response for GET /caches/{name}.
+type Stats struct {
+	Name      string `json:"name"`
+	ItemCount int    `json:"itemCount"`
+	// An estimate of the bytes used by the cache's items, if the cache
+	// has an ApproxMemoryUsage method like *cache.Cache's.
+	ApproxMemoryUsage int64 `json:"approxMemoryUsage,omitempty"`
+	// The stats of each of the cache's namespaces, if it has any (see
+	// cache.Namespace).
+	Namespaces []Stats `json:"namespaces,omitempty"`
+}
+
+// memoryUser is implemented by caches that can estimate their memory usage.
+type memoryUser interface {
+	ApproxMemoryUsage() int64
+}
+
+// namespacer is implemented by caches that can have namespaces.
+type namespacer interface {
+	Namespaces() []string
+	GetNamespace(name string) (*cache.Cache, bool)
+}
+
+func newStats(name string, c Cache) Stats {
+	s := Stats{Name: name, ItemCount: c.ItemCount()}
+	if m, ok := c.(memoryUser); ok {
+		s.ApproxMemoryUsage = m.ApproxMemoryUsage()
+	}
+	if n, ok := c.(namespacer); ok {
+		for _, ns := range n.Namespaces() {
+			if nc, found := n.GetNamespace(ns); found {
+				s.Namespaces = append(s.Namespaces, newStats(ns, nc))
+			}
+		}
+	}
+	return s
+}
+
+// KeyPage is the response for GET /caches/{name}/keys. Keys are returned in
+// sorted order; pass NextCursor as ?cursor= to get the next page. NextCursor
+// is empty on the last page.
+type KeyPage struct {
+	Keys       []string `json:"keys"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+// ItemInfo is the response for GET /caches/{name}/keys/{key}. Expiration is
+// omitted for items that never expire. Values that can't be marshaled to JSON
+// are rendered with fmt's %v verb instead.
+type ItemInfo struct {
+	Key        string      `json:"key"`
+	Value      interface{} `json:"value"`
+	Type       string      `json:"type"`
+	Expiration *time.Time  `json:"expiration,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type handler struct {
+	reg      *Registry
+	readOnly bool
+	mux      *http.ServeMux
+}
+
+// Return a handler serving the caches in reg. If readOnly is true, requests
+// that would modify a cache are rejected.
+func NewHandler(reg *Registry, readOnly bool) http.Handler {
+	h := &handler{
+		reg:      reg,
+		readOnly: readOnly,
+		mux:      http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /caches", h.listCaches)
+	h.mux.HandleFunc("GET /caches/{name}", h.withCache(h.stats))
+	h.mux.HandleFunc("GET /caches/{name}/keys", h.withCache(h.listKeys))
+	h.mux.HandleFunc("GET /caches/{name}/keys/{key...}", h.withCache(h.getKey))
+	h.mux.HandleFunc("DELETE /caches/{name}/keys/{key...}", h.writable(h.withCache(h.deleteKey)))
+	h.mux.HandleFunc("POST /caches/{name}/flush", h.writable(h.withCache(h.flush)))
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *handler) withCache(f func(http.ResponseWriter, *http.Request, string, Cache)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		c, found := h.reg.Get(name)
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("Cache %s not found", name))
+			return
+		}
+		f(w, r, name, c)
+	}
+}
+
+func (h *handler) writable(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.readOnly {
+			writeError(w, http.StatusForbidden, "Handler is read-only")
+			return
+		}
+		f(w, r)
+	}
+}
+
+func (h *handler) listCaches(w http.ResponseWriter, r *http.Request) {
+	names := h.reg.Names()
+	res := make([]Stats, 0, len(names))
+	for _, name := range names {
+		if c, found := h.reg.Get(name); found {
+			res = append(res, newStats(name, c))
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (h *handler) stats(w http.ResponseWriter, r *http.Request, name string, c Cache) {
+	writeJSON(w, http.StatusOK, newStats(name, c))
+}
+
+func (h *handler) listKeys(w http.ResponseWriter, r *http.Request, name string, c Cache) {
+	q := r.URL.Query()
+	prefix, cursor := q.Get("prefix"), q.Get("cursor")
+	limit := defaultLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxLimit {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxLimit))
+			return
+		}
+		limit = n
+	}
+	// Keep the limit+1 smallest matching keys, the extra one telling
+	// whether there's another page.
+	top := make(keyHeap, 0, limit+1)
+	c.Range(func(k string, _ cache.Item) bool {
+		if !strings.HasPrefix(k, prefix) || k <= cursor {
+			return true
+		}
+		if len(top) <= limit {
+			heap.Push(&top, k)
+		} else if k < top[0] {
+			top[0] = k
+			heap.Fix(&top, 0)
+		}
+		return true
+	})
+	keys := []string(top)
+	sort.Strings(keys)
+	page := KeyPage{Keys: keys}
+	if len(keys) > limit {
+		page.Keys = keys[:limit]
+		page.NextCursor = keys[limit-1]
+	}
+	if page.Keys == nil {
+		page.Keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// A max-heap of keys.
+type keyHeap []string
+
+func (h keyHeap) Len() int            { return len(h) }
+func (h keyHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (h *handler) getKey(w http.ResponseWriter, r *http.Request, name string, c Cache) {
+	k := r.PathValue("key")
+	x, exp, found := c.GetWithExpiration(k)
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Item %s not found", k))
+		return
+	}
+	info := ItemInfo{
+		Key:   k,
+		Value: x,
+		Type:  fmt.Sprintf("%T", x),
+	}
+	if _, err := json.Marshal(x); err != nil {
+		info.Value = fmt.Sprintf("%v", x)
+	}
+	if !exp.IsZero() {
+		info.Expiration = &exp
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (h *handler) deleteKey(w http.ResponseWriter, r *http.Request, name string, c Cache) {
+	c.Delete(r.PathValue("key"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) flush(w http.ResponseWriter, r *http.Request, name string, c Cache) {
+	c.Flush()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
@@ -0,0 +1,183 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func newTestServer(t *testing.T, readOnly bool) (*httptest.Server, *cache.Cache) {
+	tc := cache.New(cache.DefaultExpiration, 0)
+	reg := NewRegistry()
+	reg.Register("test", tc)
+	reg.Register("other", cache.New(cache.DefaultExpiration, 0))
+	ts := httptest.NewServer(NewHandler(reg, readOnly))
+	t.Cleanup(ts.Close)
+	return ts, tc
+}
+
+func do(t *testing.T, method, url string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if v != nil && res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatal("Couldn't decode response:", err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestListCachesAndStats(t *testing.T) {
+	ts, tc := newTestServer(t, false)
+	tc.Set("a", 1, cache.DefaultExpiration)
+
+	var list []Stats
+	if code := do(t, "GET", ts.URL+"/caches", &list); code != http.StatusOK {
+		t.Fatal("Unexpected status:", code)
+	}
+	if len(list) != 2 || list[0].Name != "other" || list[1].Name != "test" || list[1].ItemCount != 1 {
+		t.Error("Unexpected cache list:", list)
+	}
+
+	var stats Stats
+	if code := do(t, "GET", ts.URL+"/caches/test", &stats); code != http.StatusOK {
+		t.Fatal("Unexpected status:", code)
+	}
+	if stats.ItemCount != 1 || stats.ApproxMemoryUsage <= 0 {
+		t.Error("Unexpected stats:", stats)
+	}
+	if code := do(t, "GET", ts.URL+"/caches/missing", nil); code != http.StatusNotFound {
+		t.Error("Expected 404 for a missing cache, got", code)
+	}
+}
+
+func TestNamespaceStats(t *testing.T) {
+	ts, tc := newTestServer(t, false)
+	tc.Namespace("users", cache.DefaultExpiration).Set("a", 1, cache.DefaultExpiration)
+	slots := tc.Namespace("slots", cache.DefaultExpiration)
+	slots.Set("a", 1, cache.DefaultExpiration)
+	slots.Set("b", 2, cache.DefaultExpiration)
+
+	var stats Stats
+	if code := do(t, "GET", ts.URL+"/caches/test", &stats); code != http.StatusOK {
+		t.Fatal("Unexpected status:", code)
+	}
+	ns := stats.Namespaces
+	if len(ns) != 2 || ns[0].Name != "slots" || ns[0].ItemCount != 2 || ns[1].Name != "users" || ns[1].ItemCount != 1 {
+		t.Error("Unexpected namespace stats:", ns)
+	}
+
+	tc.DropNamespace("slots")
+	stats = Stats{}
+	do(t, "GET", ts.URL+"/caches/test", &stats)
+	if ns := stats.Namespaces; len(ns) != 1 || ns[0].Name != "users" {
+		t.Error("Unexpected namespace stats after dropping one:", ns)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	ts, tc := newTestServer(t, false)
+	for i := 0; i < 5; i++ {
+		tc.Set("pub:"+strconv.Itoa(i), i, cache.DefaultExpiration)
+	}
+	tc.Set("slot:1", 1, cache.DefaultExpiration)
+
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("Pagination did not terminate")
+		}
+		var page KeyPage
+		url := ts.URL + "/caches/test/keys?prefix=pub:&limit=2&cursor=" + cursor
+		if code := do(t, "GET", url, &page); code != http.StatusOK {
+			t.Fatal("Unexpected status:", code)
+		}
+		keys = append(keys, page.Keys...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	want := []string{"pub:0", "pub:1", "pub:2", "pub:3", "pub:4"}
+	if len(keys) != len(want) {
+		t.Fatalf("Expected keys %v, got %v", want, keys)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Errorf("Expected keys %v, got %v", want, keys)
+			break
+		}
+	}
+	if code := do(t, "GET", ts.URL+"/caches/test/keys?limit=0", nil); code != http.StatusBadRequest {
+		t.Error("Expected 400 for a bad limit, got", code)
+	}
+}
+
+func TestGetAndDeleteKey(t *testing.T) {
+	ts, tc := newTestServer(t, false)
+	tc.Set("a/b", "foo", time.Hour)
+	tc.Set("ch", make(chan int), cache.NoExpiration)
+
+	var info ItemInfo
+	if code := do(t, "GET", ts.URL+"/caches/test/keys/a/b", &info); code != http.StatusOK {
+		t.Fatal("Unexpected status:", code)
+	}
+	if info.Key != "a/b" || info.Value != "foo" || info.Type != "string" || info.Expiration == nil {
+		t.Error("Unexpected item info:", info)
+	}
+
+	info = ItemInfo{}
+	if code := do(t, "GET", ts.URL+"/caches/test/keys/ch", &info); code != http.StatusOK {
+		t.Fatal("Unexpected status:", code)
+	}
+	if info.Type != "chan int" || info.Expiration != nil {
+		t.Error("Unexpected item info:", info)
+	}
+
+	if code := do(t, "DELETE", ts.URL+"/caches/test/keys/a/b", nil); code != http.StatusNoContent {
+		t.Error("Unexpected status:", code)
+	}
+	if _, found := tc.Get("a/b"); found {
+		t.Error("a/b was found after being deleted")
+	}
+	if code := do(t, "GET", ts.URL+"/caches/test/keys/a/b", nil); code != http.StatusNotFound {
+		t.Error("Expected 404 for a deleted key, got", code)
+	}
+
+	if code := do(t, "POST", ts.URL+"/caches/test/flush", nil); code != http.StatusNoContent {
+		t.Error("Unexpected status:", code)
+	}
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("Expected 0 items after flush, got %d", n)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ts, tc := newTestServer(t, true)
+	tc.Set("a", 1, cache.DefaultExpiration)
+	if code := do(t, "DELETE", ts.URL+"/caches/test/keys/a", nil); code != http.StatusForbidden {
+		t.Error("Expected 403 for a delete, got", code)
+	}
+	if code := do(t, "POST", ts.URL+"/caches/test/flush", nil); code != http.StatusForbidden {
+		t.Error("Expected 403 for a flush, got", code)
+	}
+	if _, found := tc.Get("a"); !found {
+		t.Error("a was deleted by a read-only handler")
+	}
+	if code := do(t, "GET", ts.URL+"/caches/test/keys/a", nil); code != http.StatusOK {
+		t.Error("Expected reads to be allowed, got", code)
+	}
+}
@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Number of items from which a cache with an admission filter picks the
+	// one a new item is weighed against.
+	admissionSamples = 5
+	// Size of the filter of a cache with no item limit yet.
+	defaultAdmissionCapacity = 1024
+)
+
+// Turn on or off the admission filter, which keeps one-off keys, like those of
+// a scan, from pushing more useful items out of a full cache. Once the cache
+// and its namespaces are at their item limit (see SetMaxItems), an item with
+// a new key is only kept if the key has been read (with Get or
+// GetWithExpiration, whether or not it was found) more often recently than
+// that of the least read of a few items picked from the cache that would
+// otherwise have one evicted. If it has, that item is evicted; if it hasn't,
+// the new item is, and the eviction function, if any, is called for it as for
+// any evicted item.
+//
+// How often keys are read is estimated with TinyLFU: a count-min sketch of
+// 4-bit counters, behind a bloom filter (the "doorkeeper") that keeps keys
+// seen only once out of it. Both are aged periodically, by halving the
+// counters and clearing the doorkeeper, so that keys that were popular long
+// ago don't stay in the cache forever.
+//
+// Called on a namespace, this sets the filter it shares with its parent.
+func (c *cache) SetAdmission(enabled bool) {
+	c.mu.Lock()
+	if c.budget == nil {
+		c.startBudget()
+	}
+	b := c.budget
+	c.mu.Unlock()
+	if !enabled {
+		b.filter.Store(nil)
+		return
+	}
+	b.filter.Store(newTinyLFU(int(b.maxItems.Load())))
+}
+
+// record counts a use of k, if the budget has an admission filter.
+func (b *budget) record(k string) {
+	if f := b.filter.Load(); f != nil {
+		f.record(k)
+	}
+}
+
+// admit is like enforce, but is called after k is set in c, and if the budget
+// has an admission filter, evicts k rather than an item that has been used
+// more often.
+func (b *budget) admit(c *cache, k string) {
+	f := b.filter.Load()
+	if f == nil {
+		b.enforce()
+		return
+	}
+	for {
+		max := b.maxItems.Load()
+		if max < 1 || b.count.Load() <= max {
+			return
+		}
+		victim, _ := b.root.largest()
+		vk, found := victim.coldest(f, k)
+		if !found || f.estimate(k) <= f.estimate(vk) {
+			c.evict(k)
+			return
+		}
+		victim.evict(vk)
+	}
+}
+
+// coldest returns the least used, according to f, of a few arbitrary keys in
+// the cache other than except. Returns false if there are none.
+func (c *cache) coldest(f *tinyLFU, except string) (string, bool) {
+	var (
+		coldest string
+		min     uint32
+		n       int
+	)
+	c.mu.RLock()
+	for k := range c.items {
+		if k == except {
+			continue
+		}
+		if e := f.estimate(k); n == 0 || e < min {
+			coldest, min = k, e
+		}
+		if n++; n == admissionSamples {
+			break
+		}
+	}
+	c.mu.RUnlock()
+	return coldest, n > 0
+}
+
+// evict deletes the item k, if it is in the cache, and calls the eviction
+// function, if any, for it.
+func (c *cache) evict(k string) {
+	c.mu.Lock()
+	v, evicted := c.delete(k)
+	c.mu.Unlock()
+	if evicted {
+		c.onEvicted(k, v)
+	}
+}
+
+// A tinyLFU estimates how often keys have been used recently. It is safe for
+// concurrent use.
+type tinyLFU struct {
+	seed maphash.Seed
+	// Count-min sketch of 16 4-bit counters per word. Each key has a
+	// counter in each of 4 words.
+	counters []atomic.Uint64
+	// Bloom filter of the keys seen since the last reset.
+	doorkeeper []atomic.Uint64
+	// Number of uses recorded since the last reset, and the number after
+	// which the counters are aged.
+	additions  atomic.Int64
+	sampleSize int64
+	resetting  sync.Mutex
+}
+
+func newTinyLFU(capacity int) *tinyLFU {
+	if capacity < 1 {
+		capacity = defaultAdmissionCapacity
+	}
+	// Four counters per item, and eight doorkeeper bits per use recorded
+	// before the counters are aged.
+	sampleSize := int64(10 * capacity)
+	return &tinyLFU{
+		seed:       maphash.MakeSeed(),
+		counters:   make([]atomic.Uint64, nextPowerOfTwo(capacity)/4+1),
+		doorkeeper: make([]atomic.Uint64, nextPowerOfTwo(int(sampleSize))/8+1),
+		sampleSize: sampleSize,
+	}
+}
+
+func nextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// record counts a use of k. The first use since the last reset only goes into
+// the doorkeeper.
+func (f *tinyLFU) record(k string) {
+	h := maphash.String(f.seed, k)
+	if f.pass(h) {
+		for i := uint64(0); i < 4; i++ {
+			f.increment(f.counter(h, i))
+		}
+	}
+	if f.additions.Add(1) >= f.sampleSize && f.resetting.TryLock() {
+		if f.additions.Load() >= f.sampleSize {
+			f.reset()
+		}
+		f.resetting.Unlock()
+	}
+}
+
+// estimate returns about how many times k has been used since the counters
+// were last aged, up to 16.
+func (f *tinyLFU) estimate(k string) uint32 {
+	h := maphash.String(f.seed, k)
+	min := uint32(15)
+	for i := uint64(0); i < 4; i++ {
+		w, shift := f.counter(h, i)
+		if n := uint32(f.counters[w].Load()>>shift) & 0xf; n < min {
+			min = n
+		}
+	}
+	if f.seen(h) {
+		min++
+	}
+	return min
+}
+
+// counter returns the word and bit offset of the i'th counter for the hash h.
+func (f *tinyLFU) counter(h, i uint64) (int, uint) {
+	// Mix h with i, so that the counters are independent of each other.
+	x := (h + i*0x9e3779b97f4a7c15) * 0xbf58476d1ce4e5b9
+	x ^= x >> 31
+	w := int((x >> 4) % uint64(len(f.counters)))
+	return w, uint(x&0xf) * 4
+}
+
+// increment adds one to a counter, unless it is already at its maximum.
+func (f *tinyLFU) increment(w int, shift uint) {
+	for {
+		old := f.counters[w].Load()
+		if (old>>shift)&0xf == 0xf {
+			return
+		}
+		if f.counters[w].CompareAndSwap(old, old+1<<shift) {
+			return
+		}
+	}
+}
+
+// doorkeeperBits returns the bloom filter bits for the hash h.
+func (f *tinyLFU) doorkeeperBits(h uint64) [2]uint64 {
+	n := uint64(len(f.doorkeeper)) * 64
+	return [2]uint64{h % n, (h>>32 | h<<32) % n}
+}
+
+// seen reports whether the doorkeeper has seen h since the last reset.
+func (f *tinyLFU) seen(h uint64) bool {
+	for _, b := range f.doorkeeperBits(h) {
+		if f.doorkeeper[b/64].Load()&(1<<(b%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// pass adds h to the doorkeeper, and reports whether it was already there.
+func (f *tinyLFU) pass(h uint64) bool {
+	seen := true
+	for _, b := range f.doorkeeperBits(h) {
+		mask := uint64(1) << (b % 64)
+		if f.doorkeeper[b/64].Or(mask)&mask == 0 {
+			seen = false
+		}
+	}
+	return seen
+}
+
+// reset ages the counters by halving them, and clears the doorkeeper. Uses
+// recorded meanwhile may be lost.
+func (f *tinyLFU) reset() {
+	for i := range f.counters {
+		for {
+			old := f.counters[i].Load()
+			if f.counters[i].CompareAndSwap(old, old>>1&0x7777777777777777) {
+				break
+			}
+		}
+	}
+	for i := range f.doorkeeper {
+		f.doorkeeper[i].Store(0)
+	}
+	f.additions.Store(0)
+}
@@ -0,0 +1,272 @@
+package cache
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTinyLFU(t *testing.T) {
+	f := newTinyLFU(100)
+	if n := f.estimate("a"); n != 0 {
+		t.Error("Expected an unused key to have an estimate of 0, got", n)
+	}
+	f.record("a")
+	if n := f.estimate("a"); n != 1 {
+		t.Error("Expected a key used once to have an estimate of 1, got", n)
+	}
+	for i := 0; i < 7; i++ {
+		f.record("a")
+	}
+	if n := f.estimate("a"); n != 8 {
+		t.Error("Expected a key used 8 times to have an estimate of 8, got", n)
+	}
+	for i := 0; i < 100; i++ {
+		f.record("a")
+	}
+	if n := f.estimate("a"); n != 16 {
+		t.Error("Expected the estimate to saturate at 16, got", n)
+	}
+	f.reset()
+	if n := f.estimate("a"); n != 7 {
+		t.Error("Expected resetting to halve the estimate and clear the doorkeeper, got", n)
+	}
+
+	// Uses are aged after every 10 per item.
+	f = newTinyLFU(10)
+	for i := 0; i < 4; i++ {
+		f.record("b")
+	}
+	for i := 0; i < 96; i++ {
+		f.record("c" + strconv.Itoa(i))
+	}
+	if n := f.estimate("b"); n != 1 {
+		t.Error("Expected the counters to have been aged, got", n)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetMaxItems(10)
+	tc.SetAdmission(true)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	for i := 0; i < 10; i++ {
+		k := "hot" + strconv.Itoa(i)
+		tc.Set(k, i, DefaultExpiration)
+		for j := 0; j < 3; j++ {
+			tc.Get(k)
+		}
+	}
+	tc.Set("once", 1, DefaultExpiration)
+	if _, found := tc.Get("once"); found {
+		t.Error("A key used once was admitted to a full cache")
+	}
+	if len(evicted) != 1 || evicted[0] != "once" {
+		t.Error("Expected the rejected item to be evicted, got", evicted)
+	}
+	if n := tc.ItemCount(); n != 10 {
+		t.Error("Expected 10 items, got", n)
+	}
+	if err := tc.Add("once", 1, DefaultExpiration); err != nil {
+		t.Error(err)
+	}
+	if _, found := tc.Get("once"); found {
+		t.Error("A key used twice was admitted to a full cache")
+	}
+
+	for i := 0; i < 10; i++ {
+		tc.Get("popular")
+	}
+	tc.Set("popular", 1, DefaultExpiration)
+	if _, found := tc.Get("popular"); !found {
+		t.Error("A popular key wasn't admitted")
+	}
+	if n := tc.ItemCount(); n != 10 {
+		t.Error("Expected 10 items, got", n)
+	}
+	if len(evicted) != 3 || evicted[2] == "popular" {
+		t.Error("Expected an item to be evicted for the popular one, got", evicted)
+	}
+
+	// Without admission, new items push out arbitrary ones.
+	tc.SetAdmission(false)
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		k := "new" + strconv.Itoa(i)
+		tc.Set(k, i, DefaultExpiration)
+		if _, found := tc.Get(k); found {
+			admitted++
+		}
+	}
+	if admitted == 0 {
+		t.Error("Every new key was rejected with admission off")
+	}
+}
+
+func TestAdmissionSetters(t *testing.T) {
+	var saved bytes.Buffer
+	src := New(DefaultExpiration, 0)
+	src.Set("loaded", 1, DefaultExpiration)
+	if err := src.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	setters := map[string]func(tc *Cache){
+		"SetWithTags": func(tc *Cache) {
+			tc.SetWithTags("once", 1, DefaultExpiration, "tag")
+		},
+		"SetWithJitter": func(tc *Cache) {
+			tc.SetWithJitter("once", 1, DefaultExpiration, nil)
+		},
+		"SetWithRecompute": func(tc *Cache) {
+			tc.SetWithRecompute("once", 1, DefaultExpiration, time.Second)
+		},
+		"Txn": func(tc *Cache) {
+			tc.Txn(func(tx *Tx) error {
+				tx.Set("once", 1, DefaultExpiration)
+				return nil
+			})
+		},
+		"Load": func(tc *Cache) {
+			if err := tc.Load(bytes.NewReader(saved.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for name, set := range setters {
+		tc := New(DefaultExpiration, 0)
+		tc.SetMaxItems(10)
+		tc.SetAdmission(true)
+		for i := 0; i < 10; i++ {
+			k := "hot" + strconv.Itoa(i)
+			tc.Set(k, i, DefaultExpiration)
+			for j := 0; j < 3; j++ {
+				tc.Get(k)
+			}
+		}
+		set(tc)
+		if n := tc.ItemCount(); n != 10 {
+			t.Errorf("%s: expected 10 items, got %d", name, n)
+		}
+		for i := 0; i < 10; i++ {
+			if _, found := tc.Get("hot" + strconv.Itoa(i)); !found {
+				t.Errorf("%s: a hot item was evicted for a key used once", name)
+				break
+			}
+		}
+	}
+}
+
+func TestAdmissionBelowLimit(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetAdmission(true)
+	for i := 0; i < 2000; i++ {
+		tc.Set(strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if n := tc.ItemCount(); n != 2000 {
+		t.Error("Expected every item to be admitted without a limit, got", n)
+	}
+	tc.SetMaxItems(3000)
+	for i := 2000; i < 3000; i++ {
+		tc.Set(strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if n := tc.ItemCount(); n != 3000 {
+		t.Error("Expected every item to be admitted below the limit, got", n)
+	}
+}
+
+// A trace is a sequence of keys, which is replayed against a cache by getting
+// each key, and setting it if it's missing.
+type trace func(r *rand.Rand, n int) []string
+
+// Reads of a Zipf-distributed set of hot keys, with every other read being of
+// a key that's never read again, like a crawler's.
+func interleavedScan(r *rand.Rand, n int) []string {
+	z := rand.NewZipf(r, 1.1, 1, 10000)
+	keys := make([]string, n)
+	for i := range keys {
+		if i%2 == 0 {
+			keys[i] = "hot" + strconv.FormatUint(z.Uint64(), 10)
+		} else {
+			keys[i] = "scan" + strconv.Itoa(i)
+		}
+	}
+	return keys
+}
+
+// Reads of a Zipf-distributed set of hot keys, interrupted every 10,000 reads
+// by a scan of 5,000 keys that are never read again.
+func burstScan(r *rand.Rand, n int) []string {
+	z := rand.NewZipf(r, 1.1, 1, 10000)
+	keys := make([]string, 0, n)
+	for len(keys) < n {
+		for i := 0; i < 10000 && len(keys) < n; i++ {
+			keys = append(keys, "hot"+strconv.FormatUint(z.Uint64(), 10))
+		}
+		for i := 0; i < 5000 && len(keys) < n; i++ {
+			keys = append(keys, "scan"+strconv.Itoa(len(keys)))
+		}
+	}
+	return keys
+}
+
+// hitRatio replays keys against a cache, and returns the hit ratio of the hot
+// keys read soon (within 1,000 reads) after a scan, which is when a cache
+// without admission has had its hot keys pushed out.
+func hitRatio(keys []string, maxItems int, admission bool) float64 {
+	tc := New(DefaultExpiration, 0)
+	tc.SetMaxItems(maxItems)
+	tc.SetAdmission(admission)
+	reads, hits := 0, 0
+	sinceScan := 1000
+	for _, k := range keys {
+		_, found := tc.Get(k)
+		if strings.HasPrefix(k, "scan") {
+			sinceScan = 0
+		} else if sinceScan++; sinceScan <= 1000 {
+			reads++
+			if found {
+				hits++
+			}
+		}
+		if !found {
+			tc.Set(k, true, DefaultExpiration)
+		}
+	}
+	return float64(hits) / float64(reads)
+}
+
+func TestAdmissionHitRatio(t *testing.T) {
+	for _, v := range []struct {
+		name  string
+		trace trace
+	}{
+		{"interleaved scan", interleavedScan},
+		{"burst scan", burstScan},
+	} {
+		keys := v.trace(rand.New(rand.NewPCG(1, 2)), 300000)
+		without := hitRatio(keys, 1000, false)
+		with := hitRatio(keys, 1000, true)
+		t.Logf("%s: hot key hit ratio %.3f without admission, %.3f with", v.name, without, with)
+		if with < without*1.2 {
+			t.Errorf("Expected admission to raise the hot key hit ratio on a %s trace by at least 20%%, got %.3f without and %.3f with", v.name, without, with)
+		}
+	}
+}
+
+func BenchmarkCacheGetWithAdmission(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	tc.SetMaxItems(1000)
+	tc.SetAdmission(true)
+	tc.Set("foo", "bar", DefaultExpiration)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Get("foo")
+	}
+}
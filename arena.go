@@ -0,0 +1,347 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A ByteCache is a cache of []byte values that keeps its entries in large
+// preallocated ring buffers instead of a map of interface values. The only
+// per-entry bookkeeping is a map[uint64]uint32 from key hash to buffer offset,
+// which contains no pointers, so the garbage collector has next to nothing to
+// scan no matter how many entries the cache holds.
+//
+// The cache is split into shards, each with its own buffer and lock. When a
+// shard's buffer is full, the oldest entries in it are overwritten to make
+// room for new ones, so a ByteCache never grows beyond its initial size.
+// Values are copied in on Set and copied out on Get.
+type ByteCache struct {
+	*byteCache
+	// If this is confusing, see the comment at the bottom of New()
+}
+
+type byteCache struct {
+	defaultExpiration time.Duration
+	seed              maphash.Seed
+	shards            []*arenaShard
+	janitor           *janitor
+}
+
+// A ring buffer of entries. Each entry is laid out as
+//
+//	[length uint32][expiration int64][hash uint64][key length uint16][key][value]
+//
+// Entries never straddle the end of the buffer. When the buffer isn't wrapped,
+// the live entries are those in [head, tail). When it is, they are those in
+// [head, end) followed by those in [0, tail).
+type arenaShard struct {
+	mu      sync.RWMutex
+	index   map[uint64]uint32
+	buf     []byte
+	head    uint32
+	tail    uint32
+	end     uint32
+	wrapped bool
+}
+
+const (
+	arenaHeaderSize = 22
+	maxArenaKeyLen  = 1<<16 - 1
+)
+
+func (c *byteCache) hash(k string) uint64 {
+	return maphash.String(c.seed, k)
+}
+
+func (c *byteCache) shard(h uint64) *arenaShard {
+	return c.shards[h%uint64(len(c.shards))]
+}
+
+func (c *byteCache) expiration(d time.Duration) int64 {
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	if d > 0 {
+		return time.Now().Add(d).UnixNano()
+	}
+	return 0
+}
+
+// Add an item to the cache, replacing any existing item. If the duration is 0
+// (DefaultExpiration), the cache's default expiration time is used. If it is -1
+// (NoExpiration), the item never expires. Returns an error if the key and value
+// are too large to fit in a shard.
+func (c *byteCache) Set(k string, x []byte, d time.Duration) error {
+	h := c.hash(k)
+	s := c.shard(h)
+	e := c.expiration(d)
+	s.mu.Lock()
+	err := s.set(h, k, x, e)
+	s.mu.Unlock()
+	return err
+}
+
+// Add an item to the cache, replacing any existing item, using the default
+// expiration.
+func (c *byteCache) SetDefault(k string, x []byte) error {
+	return c.Set(k, x, DefaultExpiration)
+}
+
+// Add an item to the cache only if an item doesn't already exist for the given
+// key, or if the existing item has expired. Returns an error otherwise.
+func (c *byteCache) Add(k string, x []byte, d time.Duration) error {
+	h := c.hash(k)
+	s := c.shard(h)
+	e := c.expiration(d)
+	s.mu.Lock()
+	if _, found := s.get(h, k, time.Now().UnixNano()); found {
+		s.mu.Unlock()
+		return fmt.Errorf("Item %s already exists", k)
+	}
+	err := s.set(h, k, x, e)
+	s.mu.Unlock()
+	return err
+}
+
+// Set a new value for the cache key only if it already exists, and the existing
+// item hasn't expired. Returns an error otherwise.
+func (c *byteCache) Replace(k string, x []byte, d time.Duration) error {
+	h := c.hash(k)
+	s := c.shard(h)
+	e := c.expiration(d)
+	s.mu.Lock()
+	if _, found := s.get(h, k, time.Now().UnixNano()); !found {
+		s.mu.Unlock()
+		return fmt.Errorf("Item %s doesn't exist", k)
+	}
+	err := s.set(h, k, x, e)
+	s.mu.Unlock()
+	return err
+}
+
+// Get an item from the cache. Returns a copy of the item or nil, and a bool
+// indicating whether the key was found.
+func (c *byteCache) Get(k string) ([]byte, bool) {
+	h := c.hash(k)
+	s := c.shard(h)
+	s.mu.RLock()
+	off, found := s.get(h, k, time.Now().UnixNano())
+	if !found {
+		s.mu.RUnlock()
+		return nil, false
+	}
+	v := s.value(off)
+	s.mu.RUnlock()
+	return v, true
+}
+
+// GetWithExpiration returns a copy of an item and its expiration time from the
+// cache. It returns the item or nil, the expiration time if one is set (if the
+// item never expires a zero value for time.Time is returned), and a bool
+// indicating whether the key was found.
+func (c *byteCache) GetWithExpiration(k string) ([]byte, time.Time, bool) {
+	h := c.hash(k)
+	s := c.shard(h)
+	s.mu.RLock()
+	off, found := s.get(h, k, time.Now().UnixNano())
+	if !found {
+		s.mu.RUnlock()
+		return nil, time.Time{}, false
+	}
+	v := s.value(off)
+	e := s.expiration(off)
+	s.mu.RUnlock()
+	if e > 0 {
+		return v, time.Unix(0, e), true
+	}
+	return v, time.Time{}, true
+}
+
+// Delete an item from the cache. Does nothing if the key is not in the cache.
+// The space the item used is reclaimed when the shard's buffer wraps around.
+func (c *byteCache) Delete(k string) {
+	h := c.hash(k)
+	s := c.shard(h)
+	s.mu.Lock()
+	if off, found := s.index[h]; found && s.hasKey(off, k) {
+		delete(s.index, h)
+	}
+	s.mu.Unlock()
+}
+
+// Delete all expired items from the cache.
+func (c *byteCache) DeleteExpired() {
+	now := time.Now().UnixNano()
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for h, off := range s.index {
+			if e := s.expiration(off); e > 0 && now > e {
+				delete(s.index, h)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Returns the number of items in the cache. This may include items that have
+// expired, but have not yet been cleaned up.
+func (c *byteCache) ItemCount() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.RLock()
+		n += len(s.index)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Delete all items from the cache. The shards' buffers are kept.
+func (c *byteCache) Flush() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.index = map[uint64]uint32{}
+		s.head, s.tail, s.end, s.wrapped = 0, 0, 0, false
+		s.mu.Unlock()
+	}
+}
+
+// get returns the offset of the live entry for k, if any. Two keys with the
+// same hash can't both be stored; the one written last wins.
+func (s *arenaShard) get(h uint64, k string, now int64) (uint32, bool) {
+	off, found := s.index[h]
+	if !found {
+		return 0, false
+	}
+	if e := s.expiration(off); e > 0 && now > e {
+		return 0, false
+	}
+	if !s.hasKey(off, k) {
+		return 0, false
+	}
+	return off, true
+}
+
+func (s *arenaShard) set(h uint64, k string, x []byte, e int64) error {
+	if len(k) > maxArenaKeyLen {
+		return fmt.Errorf("Key %s is longer than %d bytes", k, maxArenaKeyLen)
+	}
+	n := arenaHeaderSize + len(k) + len(x)
+	if n > len(s.buf) {
+		return fmt.Errorf("Item %s is too large for a %d byte shard", k, len(s.buf))
+	}
+	off := s.alloc(uint32(n))
+	b := s.buf[off : off+uint32(n)]
+	binary.LittleEndian.PutUint32(b[0:], uint32(n))
+	binary.LittleEndian.PutUint64(b[4:], uint64(e))
+	binary.LittleEndian.PutUint64(b[12:], h)
+	binary.LittleEndian.PutUint16(b[20:], uint16(len(k)))
+	copy(b[arenaHeaderSize:], k)
+	copy(b[arenaHeaderSize+len(k):], x)
+	s.index[h] = off
+	return nil
+}
+
+// alloc reserves n contiguous bytes at the tail of the buffer, evicting the
+// oldest entries until they fit, and returns their offset.
+func (s *arenaShard) alloc(n uint32) uint32 {
+	for {
+		if !s.wrapped {
+			if uint32(len(s.buf))-s.tail >= n {
+				break
+			}
+			if s.head == s.tail {
+				// Empty; just start over at the front.
+				s.head, s.tail = 0, 0
+				continue
+			}
+			s.end, s.tail, s.wrapped = s.tail, 0, true
+			continue
+		}
+		if s.head-s.tail >= n {
+			break
+		}
+		s.evictHead()
+	}
+	off := s.tail
+	s.tail += n
+	return off
+}
+
+// evictHead drops the oldest entry in the buffer.
+func (s *arenaShard) evictHead() {
+	b := s.buf[s.head:]
+	n := binary.LittleEndian.Uint32(b[0:])
+	h := binary.LittleEndian.Uint64(b[12:])
+	if off, found := s.index[h]; found && off == s.head {
+		delete(s.index, h)
+	}
+	s.head += n
+	if s.head == s.end {
+		s.head, s.end, s.wrapped = 0, 0, false
+	}
+}
+
+func (s *arenaShard) expiration(off uint32) int64 {
+	return int64(binary.LittleEndian.Uint64(s.buf[off+4:]))
+}
+
+// hasKey reports whether the entry at off is for k. It doesn't allocate.
+func (s *arenaShard) hasKey(off uint32, k string) bool {
+	kl := uint32(binary.LittleEndian.Uint16(s.buf[off+20:]))
+	return string(s.buf[off+arenaHeaderSize:off+arenaHeaderSize+kl]) == k
+}
+
+func (s *arenaShard) value(off uint32) []byte {
+	n := binary.LittleEndian.Uint32(s.buf[off:])
+	kl := uint32(binary.LittleEndian.Uint16(s.buf[off+20:]))
+	v := make([]byte, n-arenaHeaderSize-kl)
+	copy(v, s.buf[off+arenaHeaderSize+kl:off+n])
+	return v
+}
+
+func stopByteCacheJanitor(c *ByteCache) {
+	c.janitor.stop <- true
+}
+
+// Return a new byte cache with a given default expiration duration and cleanup
+// interval (see New()), split into the given number of shards with a buffer of
+// shardSize bytes each. The buffers are allocated up front, so the cache uses
+// about shards*shardSize bytes for its whole lifetime. Panics if shardSize isn't
+// between 1 and math.MaxUint32, since entries are addressed by 32-bit offsets.
+func NewByteCache(defaultExpiration, cleanupInterval time.Duration, shards, shardSize int) *ByteCache {
+	if shardSize < 1 || uint64(shardSize) > math.MaxUint32 {
+		panic(fmt.Sprintf("cache: shard size %d is not between 1 and %d bytes", shardSize, uint64(math.MaxUint32)))
+	}
+	if defaultExpiration == 0 {
+		defaultExpiration = -1
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	c := &byteCache{
+		defaultExpiration: defaultExpiration,
+		seed:              maphash.MakeSeed(),
+		shards:            make([]*arenaShard, shards),
+	}
+	for i := range c.shards {
+		c.shards[i] = &arenaShard{
+			index: map[uint64]uint32{},
+			buf:   make([]byte, shardSize),
+		}
+	}
+	C := &ByteCache{c}
+	if cleanupInterval > 0 {
+		c.janitor = &janitor{
+			Interval: cleanupInterval,
+			stop:     make(chan bool),
+		}
+		go c.janitor.Run(c)
+		runtime.SetFinalizer(C, stopByteCacheJanitor)
+	}
+	return C
+}
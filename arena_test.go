@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"bytes"
+	"math"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestByteCache(t *testing.T) {
+	tc := NewByteCache(DefaultExpiration, 0, 4, 1024)
+
+	if x, found := tc.Get("a"); found || x != nil {
+		t.Error("Getting a found value that shouldn't exist:", x)
+	}
+
+	v := []byte("bar")
+	tc.Set("a", v, DefaultExpiration)
+	v[0] = 'c'
+	x, found := tc.Get("a")
+	if !found {
+		t.Fatal("a was not found")
+	}
+	if string(x) != "bar" {
+		t.Error("a is not bar; Set didn't copy the value:", string(x))
+	}
+	x[0] = 'f'
+	if x, _ := tc.Get("a"); string(x) != "bar" {
+		t.Error("a is not bar; Get didn't copy the value:", string(x))
+	}
+
+	if err := tc.Add("a", []byte("baz"), DefaultExpiration); err == nil {
+		t.Error("Add of an existing key succeeded")
+	}
+	if err := tc.Replace("b", []byte("baz"), DefaultExpiration); err == nil {
+		t.Error("Replace of a missing key succeeded")
+	}
+	if err := tc.Replace("a", []byte("qux"), DefaultExpiration); err != nil {
+		t.Error("Replace of an existing key failed:", err)
+	}
+	if x, _ := tc.Get("a"); string(x) != "qux" {
+		t.Error("a was not replaced:", string(x))
+	}
+	if err := tc.Add("b", nil, DefaultExpiration); err != nil {
+		t.Error("Add of a missing key failed:", err)
+	}
+	if x, found := tc.Get("b"); !found || len(x) != 0 {
+		t.Error("b was not an empty value:", x, found)
+	}
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("Expected 2 items, got %d", n)
+	}
+
+	tc.Delete("a")
+	if _, found := tc.Get("a"); found {
+		t.Error("a was found after being deleted")
+	}
+	tc.Flush()
+	if _, found := tc.Get("b"); found {
+		t.Error("b was found after Flush")
+	}
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("Expected 0 items after Flush, got %d", n)
+	}
+}
+
+func TestByteCacheTimes(t *testing.T) {
+	tc := NewByteCache(50*time.Millisecond, 1*time.Millisecond, 2, 1024)
+	tc.Set("a", []byte("1"), DefaultExpiration)
+	tc.Set("b", []byte("2"), NoExpiration)
+	tc.Set("c", []byte("3"), 20*time.Millisecond)
+	tc.Set("d", []byte("4"), 70*time.Millisecond)
+
+	<-time.After(25 * time.Millisecond)
+	if _, found := tc.Get("c"); found {
+		t.Error("Found c when it should have been automatically deleted")
+	}
+
+	<-time.After(30 * time.Millisecond)
+	if _, found := tc.Get("a"); found {
+		t.Error("Found a when it should have been automatically deleted")
+	}
+	if _, exp, found := tc.GetWithExpiration("b"); !found || !exp.IsZero() {
+		t.Error("Did not find b with a zero expiration even though it was set to never expire")
+	}
+	if _, exp, found := tc.GetWithExpiration("d"); !found || exp.Before(time.Now()) {
+		t.Error("Did not find d with a future expiration even though it was set to expire later than the default")
+	}
+
+	<-time.After(20 * time.Millisecond)
+	if _, found := tc.Get("d"); found {
+		t.Error("Found d when it should have been automatically deleted (later than the default)")
+	}
+	if n := tc.ItemCount(); n != 1 {
+		t.Errorf("Expected the janitor to leave 1 item, got %d", n)
+	}
+}
+
+func TestByteCacheWrapAround(t *testing.T) {
+	// Room for exactly 4 entries of 32 bytes (22 byte header, 2 byte key,
+	// 8 byte value) per lap around the buffer.
+	tc := NewByteCache(DefaultExpiration, 0, 1, 4*32+10)
+	v := bytes.Repeat([]byte("x"), 8)
+	for i := 0; i < 10; i++ {
+		if err := tc.Set("k"+strconv.Itoa(i), v, DefaultExpiration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := tc.ItemCount(); n != 4 {
+		t.Errorf("Expected 4 items to fit, got %d", n)
+	}
+	for i := 0; i < 10; i++ {
+		_, found := tc.Get("k" + strconv.Itoa(i))
+		if want := i >= 6; found != want {
+			t.Errorf("k%d: found is %v, should be %v", i, found, want)
+		}
+	}
+
+	// Overwriting a key leaves a dead entry behind, which must not evict
+	// the live one when the head reaches it.
+	tc.Set("k9", []byte("yyyyyyyy"), DefaultExpiration)
+	tc.Set("k0", v, DefaultExpiration)
+	if x, found := tc.Get("k9"); !found || string(x) != "yyyyyyyy" {
+		t.Error("k9 was lost:", string(x), found)
+	}
+
+	big := make([]byte, 4*32+10)
+	if err := tc.Set("big", big, DefaultExpiration); err == nil {
+		t.Error("Setting an item larger than the shard succeeded")
+	}
+}
+
+func TestByteCacheDeleteExpired(t *testing.T) {
+	tc := NewByteCache(DefaultExpiration, 0, 2, 1024)
+	tc.Set("a", []byte("a"), 10*time.Millisecond)
+	tc.Set("b", []byte("b"), NoExpiration)
+	<-time.After(20 * time.Millisecond)
+	tc.DeleteExpired()
+	if n := tc.ItemCount(); n != 1 {
+		t.Errorf("Expected 1 item after DeleteExpired, got %d", n)
+	}
+}
+
+func TestByteCacheShardSize(t *testing.T) {
+	tooBig := uint64(math.MaxUint32) + 1
+	for _, size := range []int{0, -1, int(tooBig)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewByteCache with a shard size of %d didn't panic", size)
+				}
+			}()
+			NewByteCache(DefaultExpiration, 0, 1, size)
+		}()
+	}
+}
+
+func TestByteCacheAllocs(t *testing.T) {
+	tc := NewByteCache(DefaultExpiration, 0, 1, 1024)
+	tc.Set("foo", []byte("bar"), DefaultExpiration)
+	// Only the copy of the value.
+	if n := testing.AllocsPerRun(100, func() { tc.Get("foo") }); n != 1 {
+		t.Errorf("Get made %v allocations, expected 1", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { tc.Get("baz") }); n != 0 {
+		t.Errorf("Get of a missing key made %v allocations", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { tc.Delete("foo") }); n != 0 {
+		t.Errorf("Delete made %v allocations", n)
+	}
+}
+
+const arenaBenchItems = 1000000
+
+func BenchmarkByteCacheGC(b *testing.B) {
+	tc := NewByteCache(DefaultExpiration, 0, 64, 1<<20)
+	v := []byte("zquux")
+	for i := 0; i < arenaBenchItems; i++ {
+		tc.Set("foo"+strconv.Itoa(i), v, DefaultExpiration)
+	}
+	benchmarkGC(b)
+	runtime.KeepAlive(tc)
+}
+
+func BenchmarkCacheGC(b *testing.B) {
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < arenaBenchItems; i++ {
+		tc.Set("foo"+strconv.Itoa(i), []byte("zquux"), DefaultExpiration)
+	}
+	benchmarkGC(b)
+	runtime.KeepAlive(tc)
+}
+
+// benchmarkGC measures how long a full collection takes with the heap as it
+// currently is.
+func benchmarkGC(b *testing.B) {
+	runtime.GC()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+}
+
+func BenchmarkByteCacheGet(b *testing.B) {
+	b.StopTimer()
+	tc := NewByteCache(DefaultExpiration, 0, 1, 1<<20)
+	tc.Set("foobarba", []byte("zquux"), DefaultExpiration)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Get("foobarba")
+	}
+}
+
+func BenchmarkByteCacheSet(b *testing.B) {
+	b.StopTimer()
+	tc := NewByteCache(DefaultExpiration, 0, 1, 1<<20)
+	v := []byte("zquux")
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Set("foobarba", v, DefaultExpiration)
+	}
+}
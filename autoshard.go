@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"hash/maphash"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// Fewest items per shard that shardCount aims for.
+	minShardItems = 1024
+	// One in this many operations on a cache that can grow measures how
+	// long it waits for its shard's lock.
+	contentionSampleRate = 64
+	// How often a cache that can grow checks how contended it is, and the
+	// mean wait of the sampled operations, out of at least minGrowSamples,
+	// above which it doubles its shards.
+	growInterval   = time.Second
+	growThreshold  = time.Microsecond
+	minGrowSamples = 100
+)
+
+// Returns the number of shards for a cache expected to hold about
+// expectedItems items, or an unknown number if it is 0: four per GOMAXPROCS,
+// so that goroutines rarely want the same shard at once, but not so many that
+// each holds fewer than minShardItems.
+func shardCount(expectedItems int) int {
+	n := 4 * runtime.GOMAXPROCS(0)
+	if expectedItems > 0 && expectedItems/minShardItems < n {
+		n = expectedItems / minShardItems
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// A shardGrower splits the shards of a sharded cache when they are contended.
+type shardGrower struct {
+	// Held for writing while a shard is split, and for reading by
+	// operations that must see every shard, like Flush.
+	mu        sync.RWMutex
+	maxShards int
+	stop      chan bool
+}
+
+// sample reports whether an operation should measure contention.
+func (g *shardGrower) sample() bool {
+	return rand.Uint32()%contentionSampleRate == 0
+}
+
+func (g *shardGrower) Run(sc *shardedCache) {
+	ticker := time.NewTicker(growInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sc.maybeGrow()
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// probe measures how long it takes to lock the shard.
+func (s *shard) probe() {
+	if !s.mu.TryLock() {
+		start := time.Now()
+		s.mu.Lock()
+		s.waited.Add(int64(time.Since(start)))
+	}
+	s.mu.Unlock()
+	s.samples.Add(1)
+}
+
+// maybeGrow doubles the number of shards if operations have waited too long
+// for their shards' locks since it was last called.
+func (sc *shardedCache) maybeGrow() {
+	var samples, waited int64
+	for _, s := range sc.table.Load().shards {
+		samples += s.samples.Swap(0)
+		waited += s.waited.Swap(0)
+	}
+	if samples < minGrowSamples || time.Duration(waited/samples) < growThreshold {
+		return
+	}
+	sc.grow()
+}
+
+// grow doubles the number of shards, up to the maximum, by splitting them one
+// at a time. Only the shard being split is locked, so the cache is never
+// paused as a whole.
+func (sc *shardedCache) grow() {
+	n := len(sc.table.Load().shards)
+	for i := 0; i < n; i++ {
+		if !sc.split() {
+			return
+		}
+	}
+}
+
+// split splits the next shard in two, moving about half of its items to a new
+// shard. Returns false if the cache already has the maximum number of shards.
+func (sc *shardedCache) split() bool {
+	g := sc.grower
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	t := sc.table.Load()
+	if len(t.shards) >= g.maxShards {
+		return false
+	}
+	old := t.shards[t.split]
+	old.routing.Lock()
+	old.mu.Lock()
+	ns := &shard{cache: &cache{
+		defaultExpiration: old.defaultExpiration,
+		items:             map[string]Item{},
+		seed:              maphash.MakeSeed(),
+		onEvicted:         old.onEvicted,
+		beta:              old.beta,
+		jitter:            old.jitter,
+	}}
+	next := &shardTable{
+		m:      t.m,
+		split:  t.split + 1,
+		shards: append(t.shards[:len(t.shards):len(t.shards)], ns),
+	}
+	if next.split == next.m {
+		next.m *= 2
+		next.split = 0
+	}
+	to := uint32(len(t.shards))
+	for k := range old.items {
+		if next.index(sc.hash(k)) == to {
+			old.move(k, ns.cache)
+		}
+	}
+	if ws := old.watchers; ws != nil {
+		for _, w := range ws.prefixes {
+			ns.addWatch(w)
+		}
+		for k, v := range ws.keys {
+			if next.index(sc.hash(k)) == to {
+				delete(ws.keys, k)
+				for _, w := range v {
+					ns.addWatch(w)
+				}
+			}
+		}
+		if len(ws.keys) == 0 && len(ws.prefixes) == 0 {
+			old.watchers = nil
+		}
+	}
+	sc.table.Store(next)
+	old.mu.Unlock()
+	old.routing.Unlock()
+	return true
+}
+
+// move moves the item k, with its tags, to another cache. Neither cache sees
+// this as the item being set or deleted. Both must be locked.
+func (c *cache) move(k string, to *cache) {
+	to.items[k] = c.items[k]
+	delete(c.items, k)
+	if tags, found := c.keyTags[k]; found {
+		c.untag(k)
+		to.tag(k, tags)
+	}
+	if d, found := c.deltas[k]; found {
+		delete(c.deltas, k)
+		if to.deltas == nil {
+			to.deltas = map[string]time.Duration{}
+		}
+		to.deltas[k] = d
+	}
+}
+
+func stopAdaptiveShardedWorkers(sc *unexportedShardedCache) {
+	if sc.janitor != nil {
+		sc.janitor.stop <- true
+	}
+	sc.grower.stop <- true
+}
+
+// Like unexportedNewSharded, but picks the number of shards with shardCount.
+func unexportedNewShardedAuto(defaultExpiration, cleanupInterval time.Duration, expectedItems int) *unexportedShardedCache {
+	return unexportedNewSharded(defaultExpiration, cleanupInterval, shardCount(expectedItems))
+}
+
+// Like unexportedNewShardedAuto, but the cache also measures how long
+// operations wait for their shards' locks, and doubles the number of shards,
+// up to maxShards, when that is too long. Operations on such a cache are a
+// little slower than on one that can't grow.
+func unexportedNewShardedAdaptive(defaultExpiration, cleanupInterval time.Duration, expectedItems, maxShards int) *unexportedShardedCache {
+	if defaultExpiration == 0 {
+		defaultExpiration = -1
+	}
+	sc := newShardedCache(shardCount(expectedItems), defaultExpiration, nil)
+	sc.grower = &shardGrower{
+		maxShards: maxShards,
+		stop:      make(chan bool),
+	}
+	SC := &unexportedShardedCache{sc}
+	if cleanupInterval > 0 {
+		runShardedJanitor(sc, cleanupInterval)
+	}
+	go sc.grower.Run(sc)
+	runtime.SetFinalizer(SC, stopAdaptiveShardedWorkers)
+	return SC
+}
@@ -0,0 +1,233 @@
+package cache
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardCount(t *testing.T) {
+	procs := runtime.GOMAXPROCS(0)
+	if n := shardCount(0); n != 4*procs {
+		t.Errorf("Expected %d shards for an unknown size, got %d", 4*procs, n)
+	}
+	if n := shardCount(1); n != 1 {
+		t.Errorf("Expected 1 shard for a tiny cache, got %d", n)
+	}
+	if n := shardCount(1 << 30); n != 4*procs {
+		t.Errorf("Expected %d shards for a huge cache, got %d", 4*procs, n)
+	}
+	if n := shardCount(3 * minShardItems); n > 3 {
+		t.Errorf("Expected at most 3 shards, got %d", n)
+	}
+}
+
+func TestShardTableIndex(t *testing.T) {
+	// Splitting a shard only moves keys from it to the new shard.
+	tbl := &shardTable{m: 3, split: 0}
+	next := &shardTable{m: 3, split: 1}
+	for h := uint32(0); h < 10000; h++ {
+		i, j := tbl.index(h), next.index(h)
+		if i != j && (i != 0 || j != 3) {
+			t.Fatalf("Splitting shard 0 moved %d from shard %d to %d", h, i, j)
+		}
+	}
+	full := &shardTable{m: 6, split: 0}
+	for h := uint32(0); h < 10000; h++ {
+		if full.index(h) != (&shardTable{m: 3, split: 3}).index(h) {
+			t.Fatal("Splitting every shard isn't the same as doubling the modulus")
+		}
+	}
+}
+
+func TestShardedCacheGrow(t *testing.T) {
+	tc := unexportedNewShardedAdaptive(DefaultExpiration, 0, minShardItems, 8)
+	if n := len(tc.caches()); n != 1 {
+		t.Fatalf("Expected to start with 1 shard, got %d", n)
+	}
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(i)
+		tc.SetWithTags(k, i, DefaultExpiration, "tag"+strconv.Itoa(i%2))
+	}
+	ch, cancel := tc.WatchPrefix("9")
+	defer cancel()
+	one, cancelOne := tc.Watch("500")
+	defer cancelOne()
+
+	tc.grow()
+	tc.grow()
+	tc.grow()
+	tc.grow()
+	cs := tc.caches()
+	if len(cs) != 8 {
+		t.Fatalf("Expected 8 shards, got %d", len(cs))
+	}
+	total := 0
+	for _, c := range cs {
+		n := c.ItemCount()
+		if n == 0 {
+			t.Error("A shard was left empty")
+		}
+		total += n
+	}
+	if total != 1000 {
+		t.Errorf("Expected 1000 items across the shards, got %d", total)
+	}
+	for i := 0; i < 1000; i++ {
+		if x, found := tc.Get(strconv.Itoa(i)); !found || x != i {
+			t.Fatalf("Item %d is %v after growing", i, x)
+		}
+	}
+
+	tc.Set("901", "x", DefaultExpiration)
+	if e := nextEvent(t, ch); e.Key != "901" {
+		t.Error("Expected an event for 901, got", e)
+	}
+	tc.Set("500", "x", DefaultExpiration)
+	if e := nextEvent(t, one); e.Key != "500" {
+		t.Error("Expected an event for 500, got", e)
+	}
+
+	tc.InvalidateTag("tag0")
+	if _, found := tc.Get("2"); found {
+		t.Error("A moved item lost its tag")
+	}
+	if _, found := tc.Get("3"); !found {
+		t.Error("An item with another tag was deleted")
+	}
+}
+
+func TestShardedCacheGrowConcurrent(t *testing.T) {
+	tc := unexportedNewShardedAdaptive(DefaultExpiration, 0, 0, 64)
+	const keys, workers, each = 100, 8, 500
+	for i := 0; i < keys; i++ {
+		tc.Set(strconv.Itoa(i), 0, DefaultExpiration)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				k := strconv.Itoa((w + j) % keys)
+				if err := tc.Increment(k, 1); err != nil {
+					t.Error(err)
+				}
+				a, b := strconv.Itoa(j%keys), strconv.Itoa((j*7)%keys)
+				tc.Txn([]string{a, b}, func(tx *Tx) error {
+					tx.Increment(a, -1)
+					tx.Increment(b, 1)
+					return nil
+				})
+			}
+		}(w)
+	}
+	for len(tc.caches()) < 64 {
+		tc.split()
+		runtime.Gosched()
+	}
+	wg.Wait()
+	total := 0
+	for i := 0; i < keys; i++ {
+		x, found := tc.Get(strconv.Itoa(i))
+		if !found {
+			t.Fatalf("Item %d was lost", i)
+		}
+		total += x.(int)
+	}
+	if total != workers*each {
+		t.Errorf("Expected a total of %d, got %d", workers*each, total)
+	}
+}
+
+func TestShardedCacheMaybeGrow(t *testing.T) {
+	tc := unexportedNewShardedAdaptive(DefaultExpiration, 0, 2*minShardItems, 4)
+	n := len(tc.caches())
+	s := tc.table.Load().shards[0]
+	s.samples.Store(minGrowSamples)
+	s.waited.Store(int64(minGrowSamples * growThreshold / 2))
+	tc.maybeGrow()
+	if len(tc.caches()) != n {
+		t.Error("The cache grew without much contention")
+	}
+	s.samples.Store(minGrowSamples)
+	s.waited.Store(int64(minGrowSamples * growThreshold * 2))
+	tc.maybeGrow()
+	if len(tc.caches()) != 2*n {
+		t.Errorf("Expected a contended cache to grow from %d to %d shards, got %d", n, 2*n, len(tc.caches()))
+	}
+	s.samples.Store(minGrowSamples)
+	s.waited.Store(int64(minGrowSamples * time.Second))
+	tc.maybeGrow()
+	if len(tc.caches()) != 4 {
+		t.Errorf("Expected the cache to stop at 4 shards, got %d", len(tc.caches()))
+	}
+}
+
+func BenchmarkShardedCacheGetManyConcurrentAdaptive(b *testing.B) {
+	b.StopTimer()
+	n := 10000
+	tsc := unexportedNewShardedAdaptive(NoExpiration, 0, 0, 64)
+	keys := make([]string, n)
+	for i := 0; i < n; i++ {
+		k := "foo" + strconv.Itoa(i)
+		keys[i] = k
+		tsc.Set(k, "bar", DefaultExpiration)
+	}
+	each := b.N / n
+	wg := new(sync.WaitGroup)
+	wg.Add(n)
+	for _, v := range keys {
+		go func(k string) {
+			for j := 0; j < each; j++ {
+				tsc.Get(k)
+			}
+			wg.Done()
+		}(v)
+	}
+	b.StartTimer()
+	wg.Wait()
+}
+
+// An eviction function that uses the cache while a split waits for its shard
+// mustn't deadlock.
+func TestShardedCacheEvictedDuringSplit(t *testing.T) {
+	tc := unexportedNewShardedAdaptive(DefaultExpiration, 0, minShardItems, 8)
+	for _, c := range tc.caches() {
+		c.OnEvicted(func(k string, v interface{}) {
+			go tc.split()
+			// Give the split time to start waiting.
+			time.Sleep(10 * time.Millisecond)
+			tc.Set(k+"'", v, DefaultExpiration)
+			tc.Flush()
+		})
+	}
+	for _, del := range []func(){
+		func() { tc.Delete("a") },
+		func() { tc.DeleteExpired() },
+		func() { tc.DeletePrefix("a") },
+		func() { tc.DeleteMatching("a*") },
+		func() { tc.InvalidateTag("t") },
+		func() {
+			tc.Txn([]string{"a"}, func(tx *Tx) error {
+				tx.Delete("a")
+				return nil
+			})
+		},
+	} {
+		tc.SetWithTags("a", 1, time.Nanosecond, "t")
+		time.Sleep(time.Millisecond)
+		done := make(chan struct{})
+		go func() {
+			del()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Deadlocked calling the eviction function")
+		}
+	}
+}
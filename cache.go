@@ -3,10 +3,15 @@ package cache
 import (
 	"encoding/gob"
 	"fmt"
+	"hash/maphash"
 	"io"
+	"iter"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +20,12 @@ type Item struct {
 	Expiration int64
 }
 
+// Returns true if the item is a negative entry added by SetNotFound.
+func (item Item) NotFound() bool {
+	_, negative := item.Object.(notFound)
+	return negative
+}
+
 // Returns true if the item has expired.
 func (item Item) Expired() bool {
 	if item.Expiration == 0 {
@@ -35,6 +46,10 @@ const (
 type Cache struct {
 	*cache
 	// If this is confusing, see the comment at the bottom of New()
+
+	// For a namespace, the cache it belongs to, which is kept alive (and
+	// its janitor running) for as long as the namespace is in use.
+	parent *Cache
 }
 
 type cache struct {
@@ -43,6 +58,36 @@ type cache struct {
 	mu                sync.RWMutex
 	onEvicted         func(string, interface{})
 	janitor           *janitor
+	// Seeds the key hashes that Scan cursors are made of.
+	seed maphash.Seed
+	// Tag index, allocated on first use by SetWithTags: keys by tag, and
+	// tags by key.
+	tagged  map[string]map[string]struct{}
+	keyTags map[string][]string
+	// Sorted index of the keys, only kept by caches made with NewOrdered.
+	ordered *skiplist
+	// Namespaces, allocated on first use by Namespace.
+	namespaces map[string]*cache
+	// Item limit shared with the cache's namespaces, set up by
+	// SetMaxItems or Namespace.
+	budget *budget
+	// Probabilistic early expiration: the beta parameter set by
+	// SetEarlyExpiration, and the recompute times recorded by
+	// SetWithRecompute, allocated on first use.
+	beta   float64
+	deltas map[string]time.Duration
+	// Randomizes item lifetimes, if set with WithJitter.
+	jitter Jitter
+	// Watches, allocated on first use by Watch or WatchPrefix.
+	watchers *watchers
+	// The keys a Scan in progress resumes from.
+	scan atomic.Pointer[scanSnapshot]
+	// Number of times the cache has been flushed, so that Range can tell
+	// that the map it was iterating over has been replaced.
+	flushes uint64
+	// Number of lookups that found a negative entry, added by
+	// SetNotFound.
+	negativeHits atomic.Int64
 }
 
 // Add an item to the cache, replacing any existing item. If the duration is 0
@@ -50,34 +95,80 @@ type cache struct {
 // (NoExpiration), the item never expires.
 func (c *cache) Set(k string, x interface{}, d time.Duration) {
 	// "Inlining" of set
-	var e int64
-	if d == DefaultExpiration {
-		d = c.defaultExpiration
-	}
-	if d > 0 {
-		e = time.Now().Add(d).UnixNano()
-	}
+	e := c.expiration(d, c.jitter)
 	c.mu.Lock()
+	b := c.budget
+	if b != nil {
+		c.countNew(k)
+	}
 	c.items[k] = Item{
 		Object:     x,
 		Expiration: e,
 	}
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, x)
+	}
+	if c.keyTags != nil {
+		c.untag(k)
+	}
+	if c.ordered != nil {
+		c.ordered.insert(k)
+	}
+	if c.deltas != nil {
+		delete(c.deltas, k)
+	}
 	// TODO: Calls to mu.Unlock are currently not deferred because defer
 	// adds ~200 ns (as of go1.)
 	c.mu.Unlock()
+	if b != nil {
+		b.admit(c, k)
+	}
 }
 
 func (c *cache) set(k string, x interface{}, d time.Duration) {
-	var e int64
+	c.setJittered(k, x, d, c.jitter)
+}
+
+func (c *cache) setJittered(k string, x interface{}, d time.Duration, j Jitter) {
+	c.setItem(k, Item{
+		Object:     x,
+		Expiration: c.expiration(d, j),
+	})
+}
+
+// expiration returns the expiration time of an item added now to be kept for d,
+// randomized with j if it isn't nil.
+func (c *cache) expiration(d time.Duration, j Jitter) int64 {
 	if d == DefaultExpiration {
 		d = c.defaultExpiration
 	}
-	if d > 0 {
-		e = time.Now().Add(d).UnixNano()
+	if d <= 0 {
+		return 0
 	}
-	c.items[k] = Item{
-		Object:     x,
-		Expiration: e,
+	if j != nil {
+		d = applyJitter(j, d)
+	}
+	return time.Now().Add(d).UnixNano()
+}
+
+// setItem adds an item to the cache, replacing any existing item. The cache
+// must be locked.
+func (c *cache) setItem(k string, item Item) {
+	if c.budget != nil {
+		c.countNew(k)
+	}
+	c.items[k] = item
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, item.Object)
+	}
+	if c.keyTags != nil {
+		c.untag(k)
+	}
+	if c.ordered != nil {
+		c.ordered.insert(k)
+	}
+	if c.deltas != nil {
+		delete(c.deltas, k)
 	}
 }
 
@@ -97,7 +188,11 @@ func (c *cache) Add(k string, x interface{}, d time.Duration) error {
 		return fmt.Errorf("Item %s already exists", k)
 	}
 	c.set(k, x, d)
+	b := c.budget
 	c.mu.Unlock()
+	if b != nil {
+		b.admit(c, k)
+	}
 	return nil
 }
 
@@ -116,9 +211,13 @@ func (c *cache) Replace(k string, x interface{}, d time.Duration) error {
 }
 
 // Get an item from the cache. Returns the item or nil, and a bool indicating
-// whether the key was found.
+// whether the key was found. With early expiration (see SetEarlyExpiration),
+// items may be reported as not found a little before they expire.
 func (c *cache) Get(k string) (interface{}, bool) {
 	c.mu.RLock()
+	if c.budget != nil {
+		c.budget.record(k)
+	}
 	// "Inlining" of get and Expired
 	item, found := c.items[k]
 	if !found {
@@ -126,21 +225,93 @@ func (c *cache) Get(k string) (interface{}, bool) {
 		return nil, false
 	}
 	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
+		now := time.Now().UnixNano()
+		if now > item.Expiration || c.beta > 0 && c.expiresEarly(k, item, now) {
 			c.mu.RUnlock()
 			return nil, false
 		}
 	}
 	c.mu.RUnlock()
+	if _, negative := item.Object.(notFound); negative {
+		c.negativeHits.Add(1)
+		return nil, false
+	}
 	return item.Object, true
 }
 
+// The result of a Lookup.
+type LookupStatus int
+
+const (
+	// There is no item for the key, or it has expired.
+	Unknown LookupStatus = iota
+	// There is a value for the key.
+	Found
+	// The key was cached as having no value, using SetNotFound.
+	NotFound
+)
+
+func (s LookupStatus) String() string {
+	switch s {
+	case Found:
+		return "found"
+	case NotFound:
+		return "not found"
+	}
+	return "unknown"
+}
+
+// notFound is the object of the items SetNotFound adds. It only has a field
+// because Gob can't encode structs without exported fields.
+type notFound struct{ NotFound bool }
+
+// Cache the fact that there is no value for the key, e.g. because the backend
+// it was loaded from said so, for the duration d, which is usually much
+// shorter than for actual values. d is interpreted as by Set. Get reports the
+// key as not found, as if it wasn't in the cache at all; use Lookup to tell the
+// two apart. Add treats the key as free, and Replace as missing.
+//
+// Negative entries are items like any other otherwise, so that e.g. ItemCount
+// counts them and Items returns them; Item.NotFound() tells them apart.
+func (c *cache) SetNotFound(k string, d time.Duration) {
+	c.Set(k, notFound{true}, d)
+}
+
+// Returns the number of times Get, GetWithExpiration or Lookup found a negative
+// entry added by SetNotFound, i.e. how many lookups of a key known to have no
+// value the cache answered.
+func (c *cache) NegativeHits() int64 {
+	return c.negativeHits.Load()
+}
+
+// Look up an item in the cache. Returns the item, and whether the key has a
+// value (Found), was cached as having none with SetNotFound (NotFound), or
+// isn't in the cache (Unknown). The item is only set for the first two; for
+// NotFound, only its Expiration is.
+func (c *cache) Lookup(k string) (Item, LookupStatus) {
+	c.mu.RLock()
+	// "Inlining" of get and Expired
+	item, found := c.items[k]
+	c.mu.RUnlock()
+	if !found || item.Expiration > 0 && time.Now().UnixNano() > item.Expiration {
+		return Item{}, Unknown
+	}
+	if _, negative := item.Object.(notFound); negative {
+		c.negativeHits.Add(1)
+		return Item{Expiration: item.Expiration}, NotFound
+	}
+	return item, Found
+}
+
 // GetWithExpiration returns an item and its expiration time from the cache.
 // It returns the item or nil, the expiration time if one is set (if the item
 // never expires a zero value for time.Time is returned), and a bool indicating
-// whether the key was found.
+// whether the key was found. Early expiration applies as for Get.
 func (c *cache) GetWithExpiration(k string) (interface{}, time.Time, bool) {
 	c.mu.RLock()
+	if c.budget != nil {
+		c.budget.record(k)
+	}
 	// "Inlining" of get and Expired
 	item, found := c.items[k]
 	if !found {
@@ -149,19 +320,25 @@ func (c *cache) GetWithExpiration(k string) (interface{}, time.Time, bool) {
 	}
 
 	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
+		now := time.Now().UnixNano()
+		if now > item.Expiration || c.beta > 0 && c.expiresEarly(k, item, now) {
 			c.mu.RUnlock()
 			return nil, time.Time{}, false
 		}
+	}
+	c.mu.RUnlock()
+	if _, negative := item.Object.(notFound); negative {
+		c.negativeHits.Add(1)
+		return nil, time.Time{}, false
+	}
 
+	if item.Expiration > 0 {
 		// Return the item and the expiration time
-		c.mu.RUnlock()
 		return item.Object, time.Unix(0, item.Expiration), true
 	}
 
 	// If expiration <= 0 (i.e. no expiration time set) then return the item
 	// and a zeroed time.Time
-	c.mu.RUnlock()
 	return item.Object, time.Time{}, true
 }
 
@@ -170,6 +347,9 @@ func (c *cache) get(k string) (interface{}, bool) {
 	if !found {
 		return nil, false
 	}
+	if _, negative := item.Object.(notFound); negative {
+		return nil, false
+	}
 	// "Inlining" of Expired
 	if item.Expiration > 0 {
 		if time.Now().UnixNano() > item.Expiration {
@@ -191,6 +371,21 @@ func (c *cache) Increment(k string, n int64) error {
 		c.mu.Unlock()
 		return fmt.Errorf("Item %s not found", k)
 	}
+	if !increment(&v, n) {
+		c.mu.Unlock()
+		return fmt.Errorf("The value for %s is not an integer", k)
+	}
+	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// increment adds n to the item's value. Returns false if the value isn't a
+// number.
+func increment(v *Item, n int64) bool {
 	switch v.Object.(type) {
 	case int:
 		v.Object = v.Object.(int) + int(n)
@@ -219,12 +414,9 @@ func (c *cache) Increment(k string, n int64) error {
 	case float64:
 		v.Object = v.Object.(float64) + float64(n)
 	default:
-		c.mu.Unlock()
-		return fmt.Errorf("The value for %s is not an integer", k)
+		return false
 	}
-	c.items[k] = v
-	c.mu.Unlock()
-	return nil
+	return true
 }
 
 // Increment an item of type float32 or float64 by n. Returns an error if the
@@ -249,6 +441,9 @@ func (c *cache) IncrementFloat(k string, n float64) error {
 		return fmt.Errorf("The value for %s does not have type float32 or float64", k)
 	}
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nil
 }
@@ -271,6 +466,9 @@ func (c *cache) IncrementInt(k string, n int) (int, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -293,6 +491,9 @@ func (c *cache) IncrementInt8(k string, n int8) (int8, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -315,6 +516,9 @@ func (c *cache) IncrementInt16(k string, n int16) (int16, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -337,6 +541,9 @@ func (c *cache) IncrementInt32(k string, n int32) (int32, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -359,6 +566,9 @@ func (c *cache) IncrementInt64(k string, n int64) (int64, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -381,6 +591,9 @@ func (c *cache) IncrementUint(k string, n uint) (uint, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -403,6 +616,9 @@ func (c *cache) IncrementUintptr(k string, n uintptr) (uintptr, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -425,6 +641,9 @@ func (c *cache) IncrementUint8(k string, n uint8) (uint8, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -447,6 +666,9 @@ func (c *cache) IncrementUint16(k string, n uint16) (uint16, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -469,6 +691,9 @@ func (c *cache) IncrementUint32(k string, n uint32) (uint32, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -491,6 +716,9 @@ func (c *cache) IncrementUint64(k string, n uint64) (uint64, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -513,6 +741,9 @@ func (c *cache) IncrementFloat32(k string, n float32) (float32, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -535,6 +766,9 @@ func (c *cache) IncrementFloat64(k string, n float64) (float64, error) {
 	nv := rv + n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -585,6 +819,9 @@ func (c *cache) Decrement(k string, n int64) error {
 		return fmt.Errorf("The value for %s is not an integer", k)
 	}
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nil
 }
@@ -611,6 +848,9 @@ func (c *cache) DecrementFloat(k string, n float64) error {
 		return fmt.Errorf("The value for %s does not have type float32 or float64", k)
 	}
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nil
 }
@@ -633,6 +873,9 @@ func (c *cache) DecrementInt(k string, n int) (int, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -655,6 +898,9 @@ func (c *cache) DecrementInt8(k string, n int8) (int8, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -677,6 +923,9 @@ func (c *cache) DecrementInt16(k string, n int16) (int16, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -699,6 +948,9 @@ func (c *cache) DecrementInt32(k string, n int32) (int32, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -721,6 +973,9 @@ func (c *cache) DecrementInt64(k string, n int64) (int64, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -743,6 +998,9 @@ func (c *cache) DecrementUint(k string, n uint) (uint, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -765,6 +1023,9 @@ func (c *cache) DecrementUintptr(k string, n uintptr) (uintptr, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -787,6 +1048,9 @@ func (c *cache) DecrementUint8(k string, n uint8) (uint8, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -809,6 +1073,9 @@ func (c *cache) DecrementUint16(k string, n uint16) (uint16, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -831,6 +1098,9 @@ func (c *cache) DecrementUint32(k string, n uint32) (uint32, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -853,6 +1123,9 @@ func (c *cache) DecrementUint64(k string, n uint64) (uint64, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -875,6 +1148,9 @@ func (c *cache) DecrementFloat32(k string, n float32) (float32, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
@@ -897,21 +1173,54 @@ func (c *cache) DecrementFloat64(k string, n float64) (float64, error) {
 	nv := rv - n
 	v.Object = nv
 	c.items[k] = v
+	if c.watchers != nil {
+		c.watchers.notify(EventSet, k, v.Object)
+	}
 	c.mu.Unlock()
 	return nv, nil
 }
 
 // Delete an item from the cache. Does nothing if the key is not in the cache.
 func (c *cache) Delete(k string) {
-	c.mu.Lock()
-	v, evicted := c.delete(k)
-	c.mu.Unlock()
+	v, evicted := c.remove(k)
 	if evicted {
 		c.onEvicted(k, v)
 	}
 }
 
+// remove deletes an item like Delete, but leaves calling the eviction function
+// to the caller.
+func (c *cache) remove(k string) (interface{}, bool) {
+	c.mu.Lock()
+	v, evicted := c.delete(k)
+	c.mu.Unlock()
+	return v, evicted
+}
+
 func (c *cache) delete(k string) (interface{}, bool) {
+	if c.keyTags != nil {
+		c.untag(k)
+	}
+	if c.ordered != nil {
+		c.ordered.remove(k)
+	}
+	if c.deltas != nil {
+		delete(c.deltas, k)
+	}
+	if c.budget != nil {
+		if _, found := c.items[k]; found {
+			c.budget.count.Add(-1)
+		}
+	}
+	if c.watchers != nil {
+		if v, found := c.items[k]; found {
+			t := EventDelete
+			if v.Expired() {
+				t = EventExpire
+			}
+			c.watchers.notify(t, k, v.Object)
+		}
+	}
 	if c.onEvicted != nil {
 		if v, found := c.items[k]; found {
 			delete(c.items, k)
@@ -927,8 +1236,100 @@ type keyAndValue struct {
 	value interface{}
 }
 
-// Delete all expired items from the cache.
+// callEvicted calls the eviction function for items evicted from the cache,
+// which must not be locked.
+func (c *cache) callEvicted(items []keyAndValue) {
+	for _, v := range items {
+		c.onEvicted(v.key, v.value)
+	}
+}
+
+// Add an item to the cache like Set, and tag it with the given tags so that it
+// can later be deleted together with every other item carrying one of them
+// using InvalidateTag. Setting the item again, with or without tags, replaces
+// its tags.
+func (c *cache) SetWithTags(k string, x interface{}, d time.Duration, tags ...string) {
+	c.mu.Lock()
+	c.set(k, x, d)
+	if len(tags) > 0 {
+		c.tag(k, tags)
+	}
+	b := c.budget
+	c.mu.Unlock()
+	if b != nil {
+		b.admit(c, k)
+	}
+}
+
+// Delete every item tagged with tag, as a single operation. The eviction
+// function, if any, is called for each of them afterwards.
+func (c *cache) InvalidateTag(tag string) {
+	c.callEvicted(c.removeTagged(tag))
+}
+
+// removeTagged deletes every item tagged with tag, and returns those to call
+// the eviction function for.
+func (c *cache) removeTagged(tag string) []keyAndValue {
+	var evictedItems []keyAndValue
+	c.mu.Lock()
+	for k := range c.tagged[tag] {
+		ov, evicted := c.delete(k)
+		if evicted {
+			evictedItems = append(evictedItems, keyAndValue{k, ov})
+		}
+	}
+	c.mu.Unlock()
+	return evictedItems
+}
+
+// tag tags the item k with tags. The cache must be locked.
+func (c *cache) tag(k string, tags []string) {
+	if c.keyTags == nil {
+		c.tagged = map[string]map[string]struct{}{}
+		c.keyTags = map[string][]string{}
+	}
+	for _, tag := range tags {
+		keys, found := c.tagged[tag]
+		if !found {
+			keys = map[string]struct{}{}
+			c.tagged[tag] = keys
+		}
+		keys[k] = struct{}{}
+	}
+	c.keyTags[k] = append([]string(nil), tags...)
+}
+
+// untag removes k from the tag index.
+func (c *cache) untag(k string) {
+	tags, found := c.keyTags[k]
+	if !found {
+		return
+	}
+	delete(c.keyTags, k)
+	for _, tag := range tags {
+		keys := c.tagged[tag]
+		delete(keys, k)
+		if len(keys) == 0 {
+			delete(c.tagged, tag)
+		}
+	}
+}
+
+// Delete all expired items from the cache, and from its namespaces.
 func (c *cache) DeleteExpired() {
+	c.deleteExpired()
+	for _, ns := range c.namespaceList() {
+		ns.DeleteExpired()
+	}
+}
+
+func (c *cache) deleteExpired() {
+	c.callEvicted(c.removeExpired())
+}
+
+// removeExpired deletes all expired items, and returns those to call the
+// eviction function for.
+func (c *cache) removeExpired() []keyAndValue {
 	var evictedItems []keyAndValue
 	now := time.Now().UnixNano()
 	c.mu.Lock()
@@ -942,9 +1343,7 @@ func (c *cache) DeleteExpired() {
 		}
 	}
 	c.mu.Unlock()
-	for _, v := range evictedItems {
-		c.onEvicted(v.key, v.value)
-	}
+	return evictedItems
 }
 
 // Sets an (optional) function that is called with the key and value when an
@@ -1005,13 +1404,36 @@ func (c *cache) Load(r io.Reader) error {
 	err := dec.Decode(&items)
 	if err == nil {
 		c.mu.Lock()
-		defer c.mu.Unlock()
+		b := c.budget
+		var added []string
 		for k, v := range items {
 			ov, found := c.items[k]
 			if !found || ov.Expired() {
+				if !found && b != nil {
+					b.count.Add(1)
+				}
+				if b != nil {
+					added = append(added, k)
+				}
 				c.items[k] = v
+				if c.watchers != nil {
+					c.watchers.notify(EventSet, k, v.Object)
+				}
+				if c.keyTags != nil {
+					c.untag(k)
+				}
+				if c.ordered != nil {
+					c.ordered.insert(k)
+				}
+				if c.deltas != nil {
+					delete(c.deltas, k)
+				}
 			}
 		}
+		c.mu.Unlock()
+		for _, k := range added {
+			b.admit(c, k)
+		}
 	}
 	return err
 }
@@ -1034,7 +1456,8 @@ func (c *cache) LoadFile(fname string) error {
 	return fp.Close()
 }
 
-// Copies all unexpired items in the cache into a new map and returns it.
+// Copies all unexpired items in the cache into a new map and returns it. To
+// look at every item without copying them, use Range.
 func (c *cache) Items() map[string]Item {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -1052,6 +1475,106 @@ func (c *cache) Items() map[string]Item {
 	return m
 }
 
+// How many items Range reads at a time before unlocking the cache to call the
+// function it was given.
+const rangeBatchSize = 64
+
+// Call f with the key and item of every unexpired item in the cache, in no
+// particular order, until f returns false. Unlike Items, this doesn't copy the
+// cache.
+//
+// The cache is only read-locked while the items are read a few at a time, and
+// not while f runs, so f may use the cache, including adding and deleting
+// items. As with a Go map, every item that is in the cache for the whole
+// iteration is seen exactly once, items deleted before they are reached are not
+// seen, and items added during the iteration may or may not be seen. If the
+// cache is flushed during the iteration, it stops, without seeing the items
+// added since. Use RangeSnapshot if the items must be seen as they were at a
+// single point in time.
+func (c *cache) Range(f func(k string, it Item) bool) {
+	var (
+		batch [rangeBatchSize]struct {
+			k  string
+			it Item
+		}
+		n   int
+		now = time.Now().UnixNano()
+	)
+	c.mu.RLock()
+	flushes := c.flushes
+	for k, v := range c.items {
+		// "Inlining" of Expired
+		if v.Expiration > 0 && now > v.Expiration {
+			continue
+		}
+		batch[n].k, batch[n].it = k, v
+		n++
+		if n < rangeBatchSize {
+			continue
+		}
+		// The map can be modified while the loop is paused here; Go
+		// defines what a range over it does in that case.
+		c.mu.RUnlock()
+		for i := 0; i < n; i++ {
+			if !f(batch[i].k, batch[i].it) {
+				return
+			}
+		}
+		n = 0
+		now = time.Now().UnixNano()
+		c.mu.RLock()
+		// Flush replaces the map rather than emptying it, so the loop
+		// would carry on over the items that were flushed.
+		if c.flushes != flushes {
+			c.mu.RUnlock()
+			return
+		}
+	}
+	c.mu.RUnlock()
+	for i := 0; i < n; i++ {
+		if !f(batch[i].k, batch[i].it) {
+			return
+		}
+	}
+}
+
+// Call f with the key and item of every unexpired item in the cache, in no
+// particular order, until f returns false, holding the cache's read lock
+// throughout so that the items are seen exactly as they were when RangeSnapshot
+// was called. Anything that wants to write to the cache waits until it returns,
+// and f must not call any of the cache's methods, or it may deadlock.
+func (c *cache) RangeSnapshot(f func(k string, it Item) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := time.Now().UnixNano()
+	for k, v := range c.items {
+		// "Inlining" of Expired
+		if v.Expiration > 0 && now > v.Expiration {
+			continue
+		}
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// Returns an iterator over the keys and items of all unexpired items in the
+// cache, for use with a for-range loop. See Range for how it behaves when the
+// cache is modified during the loop.
+func (c *cache) All() iter.Seq2[string, Item] {
+	return c.Range
+}
+
+// Returns an iterator over the keys of all unexpired items in the cache. See
+// Range for how it behaves when the cache is modified during the loop.
+func (c *cache) Keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		c.Range(func(k string, _ Item) bool {
+			return yield(k)
+		})
+	}
+}
+
 // Returns the number of items in the cache. This may include items that have
 // expired, but have not yet been cleaned up.
 func (c *cache) ItemCount() int {
@@ -1061,10 +1584,152 @@ func (c *cache) ItemCount() int {
 	return n
 }
 
-// Delete all items from the cache.
+// Delete all items whose keys start with prefix. The eviction function, if
+// any, is called for each of them afterwards.
+func (c *cache) DeletePrefix(prefix string) {
+	c.deleteWhere(func(k string) bool {
+		return strings.HasPrefix(k, prefix)
+	})
+}
+
+// Delete all items whose keys match the glob pattern, in which * matches any
+// run of bytes, ? matches any single byte, [abc] and [a-z] (or [^...] to
+// negate) match any byte in the set, and \ escapes the next byte. The eviction
+// function, if any, is called for each of them afterwards.
+func (c *cache) DeleteMatching(pattern string) {
+	c.deleteWhere(func(k string) bool {
+		return match(pattern, k)
+	})
+}
+
+func (c *cache) deleteWhere(f func(string) bool) {
+	c.callEvicted(c.removeWhere(f))
+}
+
+// removeWhere deletes all items whose keys f returns true for, and returns
+// those to call the eviction function for.
+func (c *cache) removeWhere(f func(string) bool) []keyAndValue {
+	var evictedItems []keyAndValue
+	c.mu.Lock()
+	for k := range c.items {
+		if f(k) {
+			ov, evicted := c.delete(k)
+			if evicted {
+				evictedItems = append(evictedItems, keyAndValue{k, ov})
+			}
+		}
+	}
+	c.mu.Unlock()
+	return evictedItems
+}
+
+// Scan iterates over the keys in the cache a few at a time, without copying
+// all of them at once like Items does. Start with a cursor of 0, and pass the
+// returned cursor to the next call until it returns 0 again. Only unexpired
+// keys matching the glob pattern (see DeleteMatching; "" matches everything)
+// are returned, about count of them per call.
+//
+// Keys are visited in the order of their hashes, and the cursor is the hash to
+// resume from, so every key that is in the cache for the whole scan is
+// returned exactly once no matter what else is added or removed meanwhile.
+// Keys added or removed during the scan may or may not be returned. Cursors
+// are only valid for the cache that returned them.
+//
+// A call with a cursor of 0 takes a snapshot of the keys, sorted by their
+// hashes, which later calls resume from, so scanning a cache of n keys takes
+// O(n log n) time overall. The snapshot is kept until a scan finishes, or the
+// cache is flushed; a new scan replaces it.
+func (c *cache) Scan(cursor uint64, pattern string, count int) ([]string, uint64) {
+	if count < 1 {
+		count = 1
+	}
+	now := time.Now().UnixNano()
+	live := func(k string, v Item) bool {
+		if v.Expiration > 0 && now > v.Expiration {
+			return false
+		}
+		return pattern == "" || match(pattern, k)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	snap := c.scan.Load()
+	if cursor == 0 || snap == nil {
+		snap = c.scanSnapshot()
+		c.scan.Store(snap)
+	}
+	i := sort.Search(len(snap.hashes), func(i int) bool {
+		return snap.hashes[i] >= cursor
+	})
+	var (
+		keys []string
+		last uint64
+	)
+	// Return every key with the same hash as the last one, so that keys
+	// with the same hash are never split across calls.
+	for ; i < len(snap.hashes) && (len(keys) < count || snap.hashes[i] == last); i++ {
+		k := snap.keys[i]
+		if v, found := c.items[k]; found && live(k, v) {
+			keys = append(keys, k)
+			last = snap.hashes[i]
+		}
+	}
+	if i == len(snap.hashes) {
+		// Let the snapshot go, unless another scan has replaced it.
+		c.scan.CompareAndSwap(snap, nil)
+		return keys, 0
+	}
+	return keys, snap.hashes[i]
+}
+
+// A scanSnapshot is the keys in a cache, sorted by their hashes, taken by a
+// Scan with a cursor of 0 for it and later calls to resume from.
+type scanSnapshot struct {
+	hashes []uint64
+	keys   []string
+}
+
+func (s *scanSnapshot) Len() int           { return len(s.hashes) }
+func (s *scanSnapshot) Less(i, j int) bool { return s.hashes[i] < s.hashes[j] }
+func (s *scanSnapshot) Swap(i, j int) {
+	s.hashes[i], s.hashes[j] = s.hashes[j], s.hashes[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// scanSnapshot returns a new snapshot of the keys in the cache, which must be
+// read-locked.
+func (c *cache) scanSnapshot() *scanSnapshot {
+	s := &scanSnapshot{
+		hashes: make([]uint64, 0, len(c.items)),
+		keys:   make([]string, 0, len(c.items)),
+	}
+	for k := range c.items {
+		s.hashes = append(s.hashes, maphash.String(c.seed, k))
+		s.keys = append(s.keys, k)
+	}
+	sort.Sort(s)
+	return s
+}
+
+// Delete all items from the cache. Its namespaces, if any, are left alone.
 func (c *cache) Flush() {
 	c.mu.Lock()
+	if c.budget != nil {
+		c.budget.count.Add(-int64(len(c.items)))
+	}
+	if c.watchers != nil {
+		for k, v := range c.items {
+			c.watchers.notify(EventDelete, k, v.Object)
+		}
+	}
 	c.items = map[string]Item{}
+	c.flushes++
+	c.scan.Store(nil)
+	c.tagged = nil
+	c.keyTags = nil
+	c.deltas = nil
+	if c.ordered != nil {
+		c.ordered = newSkiplist()
+	}
 	c.mu.Unlock()
 }
 
@@ -1073,7 +1738,12 @@ type janitor struct {
 	stop     chan bool
 }
 
-func (j *janitor) Run(c *cache) {
+// An expirer is anything a janitor can periodically clean up.
+type expirer interface {
+	DeleteExpired()
+}
+
+func (j *janitor) Run(c expirer) {
 	ticker := time.NewTicker(j.Interval)
 	for {
 		select {
@@ -1106,18 +1776,29 @@ func newCache(de time.Duration, m map[string]Item) *cache {
 	c := &cache{
 		defaultExpiration: de,
 		items:             m,
+		seed:              maphash.MakeSeed(),
 	}
 	return c
 }
 
-func newCacheWithJanitor(de time.Duration, ci time.Duration, m map[string]Item) *Cache {
+func newCacheWithJanitor(de time.Duration, ci time.Duration, m map[string]Item, opts ...Option) *Cache {
 	c := newCache(de, m)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return withJanitor(c, ci)
+}
+
+// An Option configures a cache when it is created with New() or NewFrom().
+type Option func(*cache)
+
+func withJanitor(c *cache, ci time.Duration) *Cache {
 	// This trick ensures that the janitor goroutine (which--granted it
 	// was enabled--is running DeleteExpired on c forever) does not keep
 	// the returned C object from being garbage collected. When it is
 	// garbage collected, the finalizer stops the janitor goroutine, after
 	// which c can be collected.
-	C := &Cache{c}
+	C := &Cache{cache: c}
 	if ci > 0 {
 		runJanitor(c, ci)
 		runtime.SetFinalizer(C, stopJanitor)
@@ -1129,10 +1810,11 @@ func newCacheWithJanitor(de time.Duration, ci time.Duration, m map[string]Item)
 // interval. If the expiration duration is less than one (or NoExpiration),
 // the items in the cache never expire (by default), and must be deleted
 // manually. If the cleanup interval is less than one, expired items are not
-// deleted from the cache before calling c.DeleteExpired().
-func New(defaultExpiration, cleanupInterval time.Duration) *Cache {
+// deleted from the cache before calling c.DeleteExpired(). Any options are
+// applied to the cache before it is returned.
+func New(defaultExpiration, cleanupInterval time.Duration, opts ...Option) *Cache {
 	items := make(map[string]Item)
-	return newCacheWithJanitor(defaultExpiration, cleanupInterval, items)
+	return newCacheWithJanitor(defaultExpiration, cleanupInterval, items, opts...)
 }
 
 // Return a new cache with a given default expiration duration and cleanup
@@ -1156,6 +1838,6 @@ func New(defaultExpiration, cleanupInterval time.Duration) *Cache {
 // gob.Register() the individual types stored in the cache before encoding a
 // map retrieved with c.Items(), and to register those same types before
 // decoding a blob containing an items map.
-func NewFrom(defaultExpiration, cleanupInterval time.Duration, items map[string]Item) *Cache {
-	return newCacheWithJanitor(defaultExpiration, cleanupInterval, items)
+func NewFrom(defaultExpiration, cleanupInterval time.Duration, items map[string]Item, opts ...Option) *Cache {
+	return newCacheWithJanitor(defaultExpiration, cleanupInterval, items, opts...)
 }
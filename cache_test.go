@@ -1574,6 +1574,120 @@ func benchmarkCacheGetManyConcurrent(b *testing.B, exp time.Duration) {
 	wg.Wait()
 }
 
+func BenchmarkReadMostlyCacheGetConcurrentExpiring(b *testing.B) {
+	benchmarkReadMostlyCacheGetConcurrent(b, 5*time.Minute)
+}
+
+func BenchmarkReadMostlyCacheGetConcurrentNotExpiring(b *testing.B) {
+	benchmarkReadMostlyCacheGetConcurrent(b, NoExpiration)
+}
+
+func benchmarkReadMostlyCacheGetConcurrent(b *testing.B, exp time.Duration) {
+	b.StopTimer()
+	tc := NewReadMostly(exp, 0)
+	tc.Set("foo", "bar", DefaultExpiration)
+	wg := new(sync.WaitGroup)
+	workers := runtime.NumCPU()
+	each := b.N / workers
+	wg.Add(workers)
+	b.StartTimer()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := 0; j < each; j++ {
+				tc.Get("foo")
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkReadMostlyCacheGetManyConcurrentExpiring(b *testing.B) {
+	benchmarkReadMostlyCacheGetManyConcurrent(b, 5*time.Minute)
+}
+
+func BenchmarkReadMostlyCacheGetManyConcurrentNotExpiring(b *testing.B) {
+	benchmarkReadMostlyCacheGetManyConcurrent(b, NoExpiration)
+}
+
+func benchmarkReadMostlyCacheGetManyConcurrent(b *testing.B, exp time.Duration) {
+	// Compare against BenchmarkCacheGetManyConcurrent.
+	b.StopTimer()
+	n := 10000
+	keys := make([]string, n)
+	xs := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k := "foo" + strconv.Itoa(i)
+		keys[i] = k
+		xs[k] = "bar"
+	}
+	tc := NewReadMostly(exp, 0)
+	tc.SetMany(xs, DefaultExpiration)
+	each := b.N / n
+	wg := new(sync.WaitGroup)
+	wg.Add(n)
+	for _, v := range keys {
+		go func(k string) {
+			for j := 0; j < each; j++ {
+				tc.Get(k)
+			}
+			wg.Done()
+		}(v)
+	}
+	b.StartTimer()
+	wg.Wait()
+}
+
+func BenchmarkCacheGetManyConcurrentWithWriter(b *testing.B) {
+	tc := New(NoExpiration, 0)
+	benchmarkGetManyConcurrentWithWriter(b, tc.Get, tc.Set)
+}
+
+func BenchmarkReadMostlyCacheGetManyConcurrentWithWriter(b *testing.B) {
+	tc := NewReadMostly(NoExpiration, 0)
+	benchmarkGetManyConcurrentWithWriter(b, tc.Get, tc.Set)
+}
+
+// benchmarkGetManyConcurrentWithWriter reads 1000 keys concurrently while
+// one of them is written every millisecond.
+func benchmarkGetManyConcurrentWithWriter(b *testing.B, get func(string) (interface{}, bool), set func(string, interface{}, time.Duration)) {
+	b.StopTimer()
+	n := 1000
+	keys := make([]string, n)
+	for i := 0; i < n; i++ {
+		keys[i] = "foo" + strconv.Itoa(i)
+		set(keys[i], "bar", DefaultExpiration)
+	}
+	stop := make(chan bool)
+	go func() {
+		t := time.NewTicker(time.Millisecond)
+		defer t.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				set(keys[i%n], "baz", DefaultExpiration)
+			}
+		}
+	}()
+	each := b.N / n
+	wg := new(sync.WaitGroup)
+	wg.Add(n)
+	b.StartTimer()
+	for _, v := range keys {
+		go func(k string) {
+			for j := 0; j < each; j++ {
+				get(k)
+			}
+			wg.Done()
+		}(v)
+	}
+	wg.Wait()
+	b.StopTimer()
+	close(stop)
+}
+
 func BenchmarkCacheSetExpiring(b *testing.B) {
 	benchmarkCacheSet(b, 5*time.Minute)
 }
@@ -1769,3 +1883,439 @@ func TestGetWithExpiration(t *testing.T) {
 		t.Error("expiration for e is in the past")
 	}
 }
+
+func TestInvalidateTag(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetWithTags("line:1", 1, DefaultExpiration, "pub:1", "acct:1")
+	tc.SetWithTags("line:2", 2, DefaultExpiration, "pub:1", "acct:2")
+	tc.SetWithTags("line:3", 3, DefaultExpiration, "pub:2", "acct:2")
+	tc.Set("other", 4, DefaultExpiration)
+
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.InvalidateTag("pub:1")
+	if _, found := tc.Get("line:1"); found {
+		t.Error("line:1 was found after its tag was invalidated")
+	}
+	if _, found := tc.Get("line:2"); found {
+		t.Error("line:2 was found after its tag was invalidated")
+	}
+	if _, found := tc.Get("line:3"); !found {
+		t.Error("line:3 was not found")
+	}
+	if len(evicted) != 2 {
+		t.Error("Expected 2 eviction callbacks, got", evicted)
+	}
+	if _, found := tc.tagged["acct:1"]; found {
+		t.Error("acct:1 is still in the tag index after its only item was deleted")
+	}
+
+	tc.InvalidateTag("acct:2")
+	if _, found := tc.Get("line:3"); found {
+		t.Error("line:3 was found after its tag was invalidated")
+	}
+	if _, found := tc.Get("other"); !found {
+		t.Error("other was deleted even though it has no tags")
+	}
+	if len(tc.tagged) != 0 || len(tc.keyTags) != 0 {
+		t.Error("Tag index was not cleaned up:", tc.tagged, tc.keyTags)
+	}
+}
+
+func TestTagIndexCleanup(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetWithTags("a", 1, 10*time.Millisecond, "t")
+	tc.SetWithTags("b", 2, DefaultExpiration, "t")
+	tc.SetWithTags("c", 3, DefaultExpiration, "t")
+	tc.SetWithTags("d", 4, DefaultExpiration, "t", "u")
+
+	tc.Delete("b")
+	tc.Set("c", 3, DefaultExpiration) // replaces c's tags with none
+	tc.SetWithTags("d", 4, DefaultExpiration, "u")
+	<-time.After(20 * time.Millisecond)
+	tc.DeleteExpired()
+	if _, found := tc.tagged["t"]; found {
+		t.Error("t is still in the tag index:", tc.tagged["t"])
+	}
+	if len(tc.keyTags) != 1 {
+		t.Error("Expected only d to have tags, got", tc.keyTags)
+	}
+
+	tc.InvalidateTag("t")
+	if _, found := tc.Get("c"); !found {
+		t.Error("c was deleted by a tag it no longer has")
+	}
+	tc.Flush()
+	if tc.tagged != nil || tc.keyTags != nil {
+		t.Error("Flush did not reset the tag index")
+	}
+	tc.InvalidateTag("u")
+}
+
+func BenchmarkCacheSetWithTags(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.SetWithTags("foo", "bar", DefaultExpiration, "baz")
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("pub:1:slot:1", 1, DefaultExpiration)
+	tc.Set("pub:1:slot:2", 2, DefaultExpiration)
+	tc.Set("pub:12:slot:1", 3, DefaultExpiration)
+	tc.Set("pub:2:slot:1", 4, DefaultExpiration)
+	evicted := 0
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted++
+	})
+	tc.DeletePrefix("pub:1:")
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("Expected 2 items left, got %d", n)
+	}
+	if evicted != 2 {
+		t.Errorf("Expected 2 eviction callbacks, got %d", evicted)
+	}
+	if _, found := tc.Get("pub:12:slot:1"); !found {
+		t.Error("pub:12:slot:1 was deleted")
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("pub:1:slot:4", 1, DefaultExpiration)
+	tc.Set("pub:2:slot:4", 2, DefaultExpiration)
+	tc.Set("pub:2:slot:5", 3, DefaultExpiration)
+	tc.Set("pub:2:slot:44", 4, DefaultExpiration)
+	tc.DeleteMatching("pub:*:slot:4")
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("Expected 2 items left, got %d", n)
+	}
+	if _, found := tc.Get("pub:2:slot:44"); !found {
+		t.Error("pub:2:slot:44 was deleted")
+	}
+}
+
+func TestScan(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if keys, next := tc.Scan(0, "", 10); len(keys) != 0 || next != 0 {
+		t.Error("Scan of an empty cache returned", keys, next)
+	}
+	n := 1000
+	for i := 0; i < n; i++ {
+		tc.Set("foo"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	tc.Set("expired", 0, time.Nanosecond)
+	tc.Set("bar", 0, DefaultExpiration)
+	<-time.After(time.Millisecond)
+
+	seen := map[string]int{}
+	cursor := uint64(0)
+	calls := 0
+	for {
+		var keys []string
+		keys, cursor = tc.Scan(cursor, "foo*", 64)
+		calls++
+		if len(keys) > 64 {
+			t.Errorf("Scan returned %d keys for a count of 64", len(keys))
+		}
+		for _, k := range keys {
+			seen[k]++
+		}
+		// Concurrent changes don't affect keys that stay put.
+		tc.Set("foonew"+strconv.Itoa(calls), 0, DefaultExpiration)
+		tc.Delete("foo" + strconv.Itoa(n-calls))
+		if cursor == 0 {
+			break
+		}
+	}
+	if calls < n/64 {
+		t.Errorf("Expected at least %d calls, got %d", n/64, calls)
+	}
+	for i := 0; i < n-calls; i++ {
+		k := "foo" + strconv.Itoa(i)
+		if seen[k] != 1 {
+			t.Errorf("%s was returned %d times", k, seen[k])
+		}
+	}
+	if seen["expired"] != 0 || seen["bar"] != 0 {
+		t.Error("Scan returned keys it shouldn't have")
+	}
+}
+
+func TestScanInterleaved(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	n := 1000
+	for i := 0; i < n; i++ {
+		tc.Set("foo"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	// Each scan replaces the other's snapshot, or lets it go when it
+	// finishes, and both still see every key once.
+	var (
+		seen    [2]map[string]int
+		cursors [2]uint64
+		done    [2]bool
+	)
+	seen[0], seen[1] = map[string]int{}, map[string]int{}
+	for calls := 0; !done[0] || !done[1]; calls++ {
+		if calls > n {
+			t.Fatal("The scans didn't finish")
+		}
+		for i := range cursors {
+			if done[i] {
+				continue
+			}
+			var keys []string
+			keys, cursors[i] = tc.Scan(cursors[i], "", 10+i*7)
+			for _, k := range keys {
+				seen[i][k]++
+			}
+			done[i] = cursors[i] == 0
+		}
+	}
+	for i := range seen {
+		if len(seen[i]) != n {
+			t.Errorf("Scan %d saw %d keys", i, len(seen[i]))
+		}
+		for k, times := range seen[i] {
+			if times != 1 {
+				t.Errorf("Scan %d returned %s %d times", i, k, times)
+			}
+		}
+	}
+}
+
+func BenchmarkScanAll(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < 100000; i++ {
+		tc.Set("foo"+strconv.Itoa(i), "bar", DefaultExpiration)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		var cursor uint64
+		for {
+			if _, cursor = tc.Scan(cursor, "", 10); cursor == 0 {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < 10000; i++ {
+		tc.Set("foo"+strconv.Itoa(i), "bar", DefaultExpiration)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Scan(0, "", 100)
+	}
+}
+
+func TestRange(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	n := 1000
+	for i := 0; i < n; i++ {
+		tc.Set("foo"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	tc.Set("expired", 0, time.Nanosecond)
+	<-time.After(time.Millisecond)
+
+	sum := 0
+	seen := map[string]int{}
+	tc.Range(func(k string, it Item) bool {
+		seen[k]++
+		sum += it.Object.(int)
+		return true
+	})
+	if len(seen) != n || sum != n*(n-1)/2 {
+		t.Errorf("Range saw %d keys adding up to %d", len(seen), sum)
+	}
+	if seen["expired"] != 0 {
+		t.Error("Range returned an expired item")
+	}
+
+	calls := 0
+	tc.Range(func(k string, it Item) bool {
+		calls++
+		return calls < 100
+	})
+	if calls != 100 {
+		t.Errorf("Range didn't stop when asked to, %d calls", calls)
+	}
+
+	// The function may modify the cache. Items that stay in it throughout
+	// are seen exactly once.
+	seen = map[string]int{}
+	tc.Range(func(k string, it Item) bool {
+		seen[k]++
+		if it.Object.(int)%2 == 0 {
+			tc.Delete(k)
+			tc.Set(k+"new", 1, DefaultExpiration)
+		}
+		return true
+	})
+	for i := 1; i < n; i += 2 {
+		if k := "foo" + strconv.Itoa(i); seen[k] != 1 {
+			t.Errorf("%s was seen %d times", k, seen[k])
+		}
+	}
+	if tc.ItemCount() != n+1 {
+		t.Errorf("Expected %d items, got %d", n+1, tc.ItemCount())
+	}
+
+	// Flushing the cache stops the iteration, rather than carrying on
+	// over the flushed items.
+	calls = 0
+	tc.Range(func(k string, it Item) bool {
+		if calls++; calls == 1 {
+			tc.Flush()
+		}
+		return true
+	})
+	if calls > rangeBatchSize {
+		t.Errorf("Range carried on after a flush, %d calls", calls)
+	}
+}
+
+func TestRangeSnapshot(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, 1*time.Millisecond)
+	<-time.After(5 * time.Millisecond)
+	got := map[string]interface{}{}
+	tc.RangeSnapshot(func(k string, it Item) bool {
+		got[k] = it.Object
+		return true
+	})
+	if len(got) != 2 || got["a"] != 1 || got["b"] != 2 {
+		t.Error("RangeSnapshot returned", got)
+	}
+}
+
+func TestAllKeys(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+	sum := 0
+	for k, it := range tc.All() {
+		if k == "" {
+			t.Error("All returned an empty key")
+		}
+		sum += it.Object.(int)
+	}
+	if sum != 6 {
+		t.Errorf("Expected the items to add up to 6, got %d", sum)
+	}
+	var keys []string
+	for k := range tc.Keys() {
+		keys = append(keys, k)
+		if len(keys) == 2 {
+			break
+		}
+	}
+	if len(keys) != 2 {
+		t.Errorf("Expected to break out after 2 keys, got %d", len(keys))
+	}
+}
+
+func BenchmarkItems(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < 10000; i++ {
+		tc.Set("foo"+strconv.Itoa(i), "bar", DefaultExpiration)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		for range tc.Items() {
+			n++
+		}
+	}
+}
+
+func BenchmarkRange(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < 10000; i++ {
+		tc.Set("foo"+strconv.Itoa(i), "bar", DefaultExpiration)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		tc.Range(func(k string, it Item) bool {
+			n++
+			return true
+		})
+	}
+}
+
+func TestSetNotFound(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("deal", "yes", DefaultExpiration)
+	tc.SetNotFound("nodeal", 1*time.Millisecond)
+
+	if it, status := tc.Lookup("deal"); status != Found || it.Object != "yes" {
+		t.Error("Lookup of a value returned", it, status)
+	}
+	if it, status := tc.Lookup("nodeal"); status != NotFound || it.Object != nil || it.Expiration == 0 {
+		t.Error("Lookup of a negative entry returned", it, status)
+	}
+	if _, status := tc.Lookup("unknown"); status != Unknown {
+		t.Error("Lookup of a missing key returned", status)
+	}
+	if x, found := tc.Get("nodeal"); found || x != nil {
+		t.Error("Get found a negative entry:", x)
+	}
+	if _, _, found := tc.GetWithExpiration("nodeal"); found {
+		t.Error("GetWithExpiration found a negative entry")
+	}
+	tc.Get("deal")
+	tc.Get("unknown")
+	if n := tc.NegativeHits(); n != 3 {
+		t.Error("Expected 3 negative hits, got", n)
+	}
+	if err := tc.Replace("nodeal", "yes", DefaultExpiration); err == nil {
+		t.Error("Replace succeeded on a negative entry")
+	}
+	if !tc.Items()["nodeal"].NotFound() || tc.Items()["deal"].NotFound() {
+		t.Error("Item.NotFound doesn't tell negative entries apart")
+	}
+
+	<-time.After(5 * time.Millisecond)
+	if _, status := tc.Lookup("nodeal"); status != Unknown {
+		t.Error("A negative entry didn't expire:", status)
+	}
+	if n := tc.NegativeHits(); n != 3 {
+		t.Error("An expired negative entry was counted as a hit:", n)
+	}
+	tc.SetNotFound("nodeal", DefaultExpiration)
+	if err := tc.Add("nodeal", "yes", DefaultExpiration); err != nil {
+		t.Error("Add failed on a negative entry:", err)
+	}
+	if x, found := tc.Get("nodeal"); !found || x != "yes" {
+		t.Error("Get didn't find the value added over a negative entry:", x)
+	}
+
+	// Negative entries survive serialization.
+	tc.SetNotFound("saved", DefaultExpiration)
+	fp := &bytes.Buffer{}
+	if err := tc.Save(fp); err != nil {
+		t.Fatal("Couldn't save cache to fp:", err)
+	}
+	oc := New(DefaultExpiration, 0)
+	if err := oc.Load(fp); err != nil {
+		t.Fatal("Couldn't load cache from fp:", err)
+	}
+	if _, status := oc.Lookup("saved"); status != NotFound {
+		t.Error("Loaded negative entry is", status)
+	}
+}
@@ -0,0 +1,344 @@
+// Package cluster spreads a cache across several processes, groupcache-style.
+//
+// Every key has a single owner among the peers, picked with consistent
+// hashing. A peer that needs a key it doesn't own asks the owner for it over
+// HTTP; the owner serves it from its own cache, loading it with the group's
+// Getter on a miss. Each value is therefore loaded once for the whole cluster
+// rather than once per peer. Non-owners keep a copy of one in ten of the
+// values they fetch in a small hot cache for a short while, so popular keys,
+// being fetched most often, don't all go to one peer.
+//
+// Concurrent requests for the same key are coalesced, both on the peer that
+// asks and on the owner that loads.
+//
+// Values travel between peers using Gob, so their types must be registered
+// with gob.Register() (basic types like strings and ints already are).
+package cluster
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// A Getter loads the value for a key on a cache miss, and returns it along
+// with how long it may be cached (DefaultExpiration for the group's default).
+// If there is no value for the key, it may return ErrNotFound along with a
+// positive duration to have that answer cached for that long, too.
+type Getter func(ctx context.Context, key string) (interface{}, time.Duration, error)
+
+// ErrNotFound may be returned by a Getter to report that there is no value for
+// a key. It is passed through to callers on other peers as is.
+var ErrNotFound = errors.New("cluster: not found")
+
+const (
+	defaultBasePath = "/_cache/"
+	defaultReplicas = 50
+	// One in this many values fetched from other peers is copied into the
+	// hot cache.
+	hotSampleRate = 10
+	// The default item limit of a group's hot cache.
+	defaultHotItems = 1000
+)
+
+// For tests.
+var hotRand = rand.IntN
+
+// A Pool is a peer in the cluster. It owns the groups created on it, knows the
+// other peers, and serves requests from them as an http.Handler, which must be
+// reachable at the pool's own URL plus BasePath.
+type Pool struct {
+	// BasePath is the path prefix the pool serves peer requests under. It
+	// defaults to "/_cache/".
+	BasePath string
+	// Client is the HTTP client used to ask other peers for keys. It
+	// defaults to http.DefaultClient.
+	Client *http.Client
+
+	self string
+
+	mu     sync.RWMutex
+	ring   *cache.HashRing
+	groups map[string]*Group
+}
+
+// Return a new pool for the peer reachable at the base URL self, e.g.
+// "http://10.0.0.1:8000".
+func NewPool(self string) *Pool {
+	return &Pool{
+		BasePath: defaultBasePath,
+		Client:   http.DefaultClient,
+		self:     self,
+		ring:     cache.NewHashRing(defaultReplicas, self),
+		groups:   map[string]*Group{},
+	}
+}
+
+// Set the base URLs of all peers in the cluster, which should include this
+// one. Every peer must be given the same list.
+func (p *Pool) Set(peers ...string) {
+	ring := cache.NewHashRing(defaultReplicas, peers...)
+	p.mu.Lock()
+	p.ring = ring
+	p.mu.Unlock()
+}
+
+// owner returns the base URL of the peer that owns k.
+func (p *Pool) owner(k string) string {
+	p.mu.RLock()
+	owner := p.ring.Get(k)
+	p.mu.RUnlock()
+	return owner
+}
+
+// A Group is a named, cluster-wide cache of values loaded by a Getter.
+type Group struct {
+	name   string
+	pool   *Pool
+	getter Getter
+	hotTTL time.Duration
+
+	// main holds the keys this peer owns; hot holds copies of keys owned
+	// by other peers.
+	main *cache.Cache
+	hot  *cache.Cache
+
+	loads flightGroup
+}
+
+// Create a group on the pool. Values loaded by getter are kept for
+// defaultExpiration (see cache.New()) by their owner, and copies fetched from
+// other peers for at most hotTTL, in a hot cache of at most 1000 items (see
+// SetMaxHotItems). Every peer must create the same groups.
+func (p *Pool) NewGroup(name string, defaultExpiration, hotTTL time.Duration, getter Getter) *Group {
+	g := &Group{
+		name:   name,
+		pool:   p,
+		getter: getter,
+		hotTTL: hotTTL,
+		main:   cache.New(defaultExpiration, defaultExpiration),
+		hot:    cache.New(hotTTL, hotTTL),
+	}
+	g.hot.SetMaxItems(defaultHotItems)
+	p.mu.Lock()
+	p.groups[name] = g
+	p.mu.Unlock()
+	return g
+}
+
+// Returns the group with the given name, if it has been created on the pool.
+func (p *Pool) Group(name string) (*Group, bool) {
+	p.mu.RLock()
+	g, found := p.groups[name]
+	p.mu.RUnlock()
+	return g, found
+}
+
+// Set the most items the group's hot cache, of copies of values owned by other
+// peers, may hold. Values are evicted arbitrarily when it's full.
+func (g *Group) SetMaxHotItems(n int) {
+	g.hot.SetMaxItems(n)
+}
+
+// Get the value for k, from this peer's caches, from the peer that owns it,
+// or by loading it if this peer is the owner. If the owner can't be reached,
+// the value is loaded locally but not cached.
+//
+// Concurrent Gets of k share a single load, which isn't canceled along with
+// ctx; a Get whose ctx is canceled returns ctx's error without waiting for it.
+func (g *Group) Get(ctx context.Context, k string) (interface{}, error) {
+	if it, status := g.main.Lookup(k); status != cache.Unknown {
+		return lookupResult(it, status)
+	}
+	if it, status := g.hot.Lookup(k); status != cache.Unknown {
+		return lookupResult(it, status)
+	}
+	owner := g.pool.owner(k)
+	if owner == "" || owner == g.pool.self {
+		return g.loadOwned(ctx, k)
+	}
+	return g.loads.do(ctx, k, func(ctx context.Context) (interface{}, error) {
+		x, exp, err := g.fetch(ctx, owner, k)
+		if err == nil || err == ErrNotFound {
+			if hotRand(hotSampleRate) != 0 {
+				return x, err
+			}
+			d := g.hotTTL
+			if !exp.IsZero() {
+				if remaining := time.Until(exp); remaining < d {
+					d = remaining
+				}
+			}
+			switch {
+			case d <= 0:
+			case err == nil:
+				g.hot.Set(k, x, d)
+			case !exp.IsZero():
+				// The owner cached the miss, so it's safe to do
+				// the same for a while.
+				g.hot.SetNotFound(k, d)
+			}
+			return x, err
+		}
+		x, _, err = g.getter(ctx, k)
+		return x, err
+	})
+}
+
+// loadOwned gets a key this peer owns, loading and caching it on a miss.
+func (g *Group) loadOwned(ctx context.Context, k string) (interface{}, error) {
+	return g.loads.do(ctx, k, func(ctx context.Context) (interface{}, error) {
+		if it, status := g.main.Lookup(k); status != cache.Unknown {
+			return lookupResult(it, status)
+		}
+		x, d, err := g.getter(ctx, k)
+		if err == ErrNotFound && d > 0 {
+			g.main.SetNotFound(k, d)
+		}
+		if err != nil {
+			return nil, err
+		}
+		g.main.Set(k, x, d)
+		return x, nil
+	})
+}
+
+// lookupResult turns the result of a successful Lookup into that of a Get.
+func lookupResult(it cache.Item, status cache.LookupStatus) (interface{}, error) {
+	if status == cache.NotFound {
+		return nil, ErrNotFound
+	}
+	return it.Object, nil
+}
+
+// Remove k from this peer's caches. Other peers may still have it.
+func (g *Group) Remove(k string) {
+	g.main.Delete(k)
+	g.hot.Delete(k)
+}
+
+// A response is what an owner sends back for a key.
+type response struct {
+	Value      interface{}
+	Expiration int64
+	NotFound   bool
+}
+
+func (g *Group) fetch(ctx context.Context, owner, k string) (interface{}, time.Time, error) {
+	u := strings.TrimSuffix(owner, "/") + g.pool.BasePath + url.PathEscape(g.name) + "/" + url.PathEscape(k)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	res, err := g.pool.Client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("cluster: %s returned %s", owner, res.Status)
+	}
+	var r response
+	if err := gob.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, time.Time{}, err
+	}
+	var exp time.Time
+	if r.Expiration > 0 {
+		exp = time.Unix(0, r.Expiration)
+	}
+	if r.NotFound {
+		return nil, exp, ErrNotFound
+	}
+	return r.Value, exp, nil
+}
+
+// ServeHTTP answers requests from other peers for keys this peer owns.
+func (p *Pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, p.BasePath) {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.SplitN(path[len(p.BasePath):], "/", 2)
+	if len(parts) != 2 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	name, err1 := url.PathUnescape(parts[0])
+	k, err2 := url.PathUnescape(parts[1])
+	if err1 != nil || err2 != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	g, found := p.Group(name)
+	if !found {
+		http.Error(w, "no such group: "+name, http.StatusNotFound)
+		return
+	}
+	var res response
+	x, err := g.loadOwned(r.Context(), k)
+	if err != nil && err != ErrNotFound {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Value, res.NotFound = x, err == ErrNotFound
+	// A miss only has an expiration if it was cached.
+	if it, status := g.main.Lookup(k); status != cache.Unknown {
+		res.Expiration = it.Expiration
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := gob.NewEncoder(w).Encode(&res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// A flightGroup coalesces concurrent calls for the same key into one.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// do calls f for k, unless a call for k is already running, and waits for it
+// to return, or for ctx to be done. f is called in its own goroutine, with a
+// context that has ctx's values but isn't canceled with it, so that callers
+// giving up don't fail the others waiting for the call.
+func (fg *flightGroup) do(ctx context.Context, k string, f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	fg.mu.Lock()
+	if fg.calls == nil {
+		fg.calls = map[string]*call{}
+	}
+	c, found := fg.calls[k]
+	if !found {
+		c = &call{done: make(chan struct{})}
+		fg.calls[k] = c
+		go func() {
+			c.val, c.err = f(context.WithoutCancel(ctx))
+			fg.mu.Lock()
+			delete(fg.calls, k)
+			fg.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	fg.mu.Unlock()
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
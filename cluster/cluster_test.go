@@ -0,0 +1,250 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+type testPeer struct {
+	pool   *Pool
+	group  *Group
+	loads  map[string]int
+	misses int32
+}
+
+// newCluster starts n peers on loopback, all loading keys with the same
+// getter, which counts how many times each peer loads each key.
+func newCluster(t *testing.T, n int, getter func(k string) (interface{}, error)) []*testPeer {
+	peers := make([]*testPeer, n)
+	urls := make([]string, n)
+	var mu sync.Mutex
+	for i := range peers {
+		var pool *Pool
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pool.ServeHTTP(w, r)
+		}))
+		t.Cleanup(ts.Close)
+		urls[i] = ts.URL
+		pool = NewPool(ts.URL)
+		p := &testPeer{pool: pool, loads: map[string]int{}}
+		p.group = pool.NewGroup("test", time.Minute, time.Second, func(ctx context.Context, k string) (interface{}, time.Duration, error) {
+			mu.Lock()
+			p.loads[k]++
+			mu.Unlock()
+			x, err := getter(k)
+			return x, cache.DefaultExpiration, err
+		})
+		peers[i] = p
+	}
+	for _, p := range peers {
+		p.pool.Set(urls...)
+	}
+	return peers
+}
+
+// alwaysHot makes non-owners copy every value they fetch into their hot
+// caches, until the test ends.
+func alwaysHot(t *testing.T) {
+	f := hotRand
+	t.Cleanup(func() { hotRand = f })
+	hotRand = func(int) int { return 0 }
+}
+
+func TestClusterGet(t *testing.T) {
+	alwaysHot(t)
+	peers := newCluster(t, 3, func(k string) (interface{}, error) {
+		return "value of " + k, nil
+	})
+	ctx := context.Background()
+	for i := 0; i < 30; i++ {
+		k := "key" + strconv.Itoa(i)
+		for _, p := range peers {
+			x, err := p.group.Get(ctx, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x != "value of "+k {
+				t.Fatalf("Unexpected value for %s: %v", k, x)
+			}
+		}
+	}
+	// Every key was loaded exactly once, by its owner.
+	for i := 0; i < 30; i++ {
+		k := "key" + strconv.Itoa(i)
+		owner := peers[0].pool.owner(k)
+		total := 0
+		for _, p := range peers {
+			total += p.loads[k]
+			if p.loads[k] > 0 && p.pool.self != owner {
+				t.Errorf("%s was loaded by %s, which doesn't own it", k, p.pool.self)
+			}
+		}
+		if total != 1 {
+			t.Errorf("%s was loaded %d times", k, total)
+		}
+	}
+	// Non-owners keep a hot copy.
+	for _, p := range peers {
+		if p.group.main.ItemCount()+p.group.hot.ItemCount() != 30 {
+			t.Errorf("Peer %s has %d owned and %d hot items", p.pool.self, p.group.main.ItemCount(), p.group.hot.ItemCount())
+		}
+	}
+}
+
+func TestClusterNotFound(t *testing.T) {
+	peers := newCluster(t, 2, func(k string) (interface{}, error) {
+		return nil, ErrNotFound
+	})
+	for _, p := range peers {
+		if _, err := p.group.Get(context.Background(), "missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound from %s, got %v", p.pool.self, err)
+		}
+	}
+}
+
+func TestClusterOwnerDown(t *testing.T) {
+	peers := newCluster(t, 1, func(k string) (interface{}, error) {
+		return k, nil
+	})
+	p := peers[0]
+	// Point the only key at a peer that isn't listening.
+	p.pool.Set("http://127.0.0.1:1")
+	x, err := p.group.Get(context.Background(), "foo")
+	if err != nil || x != "foo" {
+		t.Fatal("Fallback load failed:", x, err)
+	}
+	if p.group.main.ItemCount() != 0 || p.group.hot.ItemCount() != 0 {
+		t.Error("A value loaded for an unreachable owner was cached")
+	}
+}
+
+func TestClusterCoalescing(t *testing.T) {
+	var loads int32
+	release := make(chan struct{})
+	peers := newCluster(t, 3, func(k string) (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return k, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		p := peers[i%len(peers)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if x, err := p.group.Get(context.Background(), "hot"); err != nil || x != "hot" {
+				t.Error("Unexpected result:", x, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("Expected 1 load, got %d", n)
+	}
+}
+
+func TestClusterNegativeCaching(t *testing.T) {
+	alwaysHot(t)
+	peers := newCluster(t, 3, nil)
+	for _, p := range peers {
+		// Report every key as missing, and have the answer cached.
+		p.group.getter = func(ctx context.Context, k string) (interface{}, time.Duration, error) {
+			atomic.AddInt32(&p.misses, 1)
+			return nil, time.Minute, ErrNotFound
+		}
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		for _, p := range peers {
+			if _, err := p.group.Get(ctx, "nodeal"); err != ErrNotFound {
+				t.Fatalf("Expected ErrNotFound from %s, got %v", p.pool.self, err)
+			}
+		}
+	}
+	misses := int32(0)
+	for _, p := range peers {
+		misses += atomic.LoadInt32(&p.misses)
+		_, main := p.group.main.Lookup("nodeal")
+		_, hot := p.group.hot.Lookup("nodeal")
+		if main != cache.NotFound && hot != cache.NotFound {
+			t.Errorf("Peer %s didn't cache the miss", p.pool.self)
+		}
+	}
+	if misses != 1 {
+		t.Errorf("Expected the miss to be loaded once, it was loaded %d times", misses)
+	}
+}
+
+func TestClusterHotSampling(t *testing.T) {
+	peers := newCluster(t, 2, func(k string) (interface{}, error) {
+		return k, nil
+	})
+	ctx := context.Background()
+	for _, p := range peers {
+		p.group.SetMaxHotItems(50)
+	}
+	for i := 0; i < 2000; i++ {
+		for _, p := range peers {
+			if _, err := p.group.Get(ctx, "key"+strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, p := range peers {
+		if n := p.group.hot.ItemCount(); n == 0 || n > 50 {
+			t.Errorf("Expected between 1 and 50 hot items on %s, got %d", p.pool.self, n)
+		}
+	}
+}
+
+func TestClusterCancel(t *testing.T) {
+	release := make(chan struct{})
+	peers := newCluster(t, 1, func(k string) (interface{}, error) {
+		<-release
+		return k, nil
+	})
+	g := peers[0].group
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := g.Get(ctx, "foo")
+		canceled <- err
+	}()
+	// Wait for the first Get's load to start, so that the second shares it.
+	for {
+		g.loads.mu.Lock()
+		n := len(g.loads.calls)
+		g.loads.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waited := make(chan error)
+	go func() {
+		x, err := g.Get(context.Background(), "foo")
+		if err == nil && x != "foo" {
+			err = fmt.Errorf("unexpected value %v", x)
+		}
+		waited <- err
+	}()
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Error("Expected the canceled Get to return context.Canceled, got", err)
+	}
+	close(release)
+	if err := <-waited; err != nil {
+		t.Error("Canceling one Get failed another waiting for the same load:", err)
+	}
+}
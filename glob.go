@@ -0,0 +1,91 @@
+package cache
+
+import "strings"
+
+// Match reports whether k matches the Redis-style glob pattern used by
+// DeleteMatching and Scan, where * matches any run of bytes, ? any single
+// byte, [abc] and [a-z] (or [^...] to negate) any byte in the set, and \
+// escapes the next byte.
+func Match(pattern, k string) bool {
+	return match(pattern, k)
+}
+
+// match reports whether s matches the glob pattern (see Match). Only the last
+// * seen is backtracked to, which is enough since a later * can match
+// anything an earlier one could, so matching takes at most
+// O(len(pattern)·len(s)) time.
+func match(pattern, s string) bool {
+	p, i := 0, 0
+	// Where in pattern and s to resume after the last *, if any.
+	star, next := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			if p == len(pattern) {
+				return true
+			}
+			star, next = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if n, ok := matchByte(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last * match one more byte.
+		next++
+		p, i = star, next
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte reports whether the byte b matches the first element of pattern,
+// which isn't a *, and returns the element's length.
+func matchByte(pattern string, b byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 1 {
+			// No closing bracket; treat [ literally.
+			return 1, b == '['
+		}
+		set := pattern[1 : end+1]
+		negate := set[0] == '^'
+		if negate {
+			set = set[1:]
+		}
+		matched := false
+		for i := 0; i < len(set); i++ {
+			if i+2 < len(set) && set[i+1] == '-' {
+				lo, hi := set[i], set[i+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				if b >= lo && b <= hi {
+					matched = true
+				}
+				i += 2
+			} else if set[i] == b {
+				matched = true
+			}
+		}
+		return end + 2, matched != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, b == pattern[1]
+		}
+	}
+	return 1, b == pattern[0]
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"pub:*:slot:4", "pub:123:slot:4", true},
+		{"pub:*:slot:4", "pub:123:slot:5", false},
+		{"a[", "a[", true},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"a*b*c", "abbbc", true},
+		{"a*?", "a", false},
+		{"a**", "a", true},
+		{"*[0-9]", "abc5", true},
+		{`*\*`, "ab*", true},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, tc := range cases {
+		if got := match(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestMatchBacktracking(t *testing.T) {
+	// Backtracking to every * in turn would take exponential time.
+	pattern := strings.Repeat("a*", 12) + "b"
+	s := strings.Repeat("a", 40)
+	start := time.Now()
+	if match(pattern, s) {
+		t.Error("The pattern matched a key without a b")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Error("Matching took", d)
+	}
+}
@@ -0,0 +1,164 @@
+// Package invalidation keeps the caches of several replicas of a service
+// coherent by broadcasting invalidations between them.
+//
+// Each replica wraps its cache in an Invalidator connected to a Bus. Deleting
+// or flushing through the Invalidator applies the change locally and publishes
+// it, and every other replica drops the affected items from its own cache when
+// the event arrives. Remote events are applied to the cache directly and never
+// republished, and each event carries the ID of the replica it came from so
+// that a replica ignores its own events, so there are no echo loops.
+package invalidation
+
+import (
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// EventKind is the kind of change an Event describes.
+type EventKind uint8
+
+const (
+	// The item with the event's key was deleted.
+	Delete EventKind = iota + 1
+	// All items were deleted.
+	Flush
+	// The item with the event's key was set to the event's version. Items
+	// set with an older version, or without one, are stale.
+	SetVersion
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Delete:
+		return "delete"
+	case Flush:
+		return "flush"
+	case SetVersion:
+		return "set-version"
+	}
+	return "unknown"
+}
+
+// An Event is a change made by one replica that the others should apply.
+type Event struct {
+	Kind    EventKind
+	Origin  string
+	Key     string
+	Version uint64
+}
+
+// A Bus delivers events published by one replica to all the others. Delivery
+// is best-effort: a replica that is down when an event is published misses it,
+// so caches relying on a bus should still expire their items eventually.
+type Bus interface {
+	// Publish sends an event to every other replica on the bus.
+	Publish(e Event) error
+	// Subscribe registers a function to call with each event received
+	// from another replica. It may be called concurrently.
+	Subscribe(f func(Event))
+	// Close disconnects from the bus.
+	Close() error
+}
+
+// An Invalidator applies changes to a cache and broadcasts them on a bus, and
+// applies changes broadcast by other replicas to the cache.
+type Invalidator struct {
+	c   *cache.Cache
+	bus Bus
+	id  string
+
+	mu       sync.Mutex
+	versions map[string]uint64
+}
+
+// Return a new invalidator for the cache c, identified as id on the bus. The
+// ID must be unique among the replicas sharing the bus.
+func New(id string, c *cache.Cache, bus Bus) *Invalidator {
+	inv := &Invalidator{
+		c:        c,
+		bus:      bus,
+		id:       id,
+		versions: map[string]uint64{},
+	}
+	bus.Subscribe(inv.apply)
+	return inv
+}
+
+// Delete an item from the local cache and from the caches of all other
+// replicas.
+func (inv *Invalidator) Delete(k string) error {
+	inv.mu.Lock()
+	delete(inv.versions, k)
+	inv.c.Delete(k)
+	inv.mu.Unlock()
+	return inv.bus.Publish(Event{Kind: Delete, Origin: inv.id, Key: k})
+}
+
+// Delete all items from the local cache and from the caches of all other
+// replicas.
+func (inv *Invalidator) Flush() error {
+	inv.mu.Lock()
+	inv.versions = map[string]uint64{}
+	inv.c.Flush()
+	inv.mu.Unlock()
+	return inv.bus.Publish(Event{Kind: Flush, Origin: inv.id})
+}
+
+// Set an item in the local cache at the given version, and tell all other
+// replicas to drop their copy of it unless theirs is at least as new. Versions
+// should increase with every change to an item, e.g. a row version or an
+// update timestamp from the source of truth.
+func (inv *Invalidator) SetVersion(k string, x interface{}, d time.Duration, version uint64) error {
+	inv.mu.Lock()
+	if len(inv.versions) > 2*inv.c.ItemCount()+64 {
+		inv.pruneVersions()
+	}
+	inv.versions[k] = version
+	inv.c.Set(k, x, d)
+	inv.mu.Unlock()
+	return inv.bus.Publish(Event{Kind: SetVersion, Origin: inv.id, Key: k, Version: version})
+}
+
+// Returns the version an item was last set to with SetVersion, and whether
+// it has one.
+func (inv *Invalidator) Version(k string) (uint64, bool) {
+	inv.mu.Lock()
+	v, found := inv.versions[k]
+	inv.mu.Unlock()
+	return v, found
+}
+
+// pruneVersions forgets the versions of items that are no longer in the
+// cache, e.g. because they expired.
+func (inv *Invalidator) pruneVersions() {
+	for k := range inv.versions {
+		if _, found := inv.c.Get(k); !found {
+			delete(inv.versions, k)
+		}
+	}
+}
+
+// apply applies an event received from another replica to the local cache.
+func (inv *Invalidator) apply(e Event) {
+	if e.Origin == inv.id {
+		return
+	}
+	inv.mu.Lock()
+	switch e.Kind {
+	case Delete:
+		delete(inv.versions, e.Key)
+		inv.c.Delete(e.Key)
+	case Flush:
+		inv.versions = map[string]uint64{}
+		inv.c.Flush()
+	case SetVersion:
+		if v, found := inv.versions[e.Key]; found && v >= e.Version {
+			break
+		}
+		delete(inv.versions, e.Key)
+		inv.c.Delete(e.Key)
+	}
+	inv.mu.Unlock()
+}
@@ -0,0 +1,226 @@
+package invalidation
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+type replica struct {
+	c   *cache.Cache
+	inv *Invalidator
+}
+
+func newReplicas(t *testing.T, buses []Bus) []replica {
+	rs := make([]replica, len(buses))
+	for i, b := range buses {
+		c := cache.New(cache.DefaultExpiration, 0)
+		rs[i] = replica{c: c, inv: New("r"+strconv.Itoa(i), c, b)}
+		t.Cleanup(func() { b.Close() })
+	}
+	return rs
+}
+
+func fill(rs []replica, k string, x interface{}) {
+	for _, r := range rs {
+		r.c.Set(k, x, cache.DefaultExpiration)
+	}
+}
+
+// eventually polls f until it returns true or a deadline passes.
+func eventually(t *testing.T, msg string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testInvalidation(t *testing.T, rs []replica) {
+	fill(rs, "a", 1)
+	fill(rs, "b", 2)
+	var evicted int32
+	rs[2].c.OnEvicted(func(k string, v interface{}) {
+		atomic.AddInt32(&evicted, 1)
+	})
+	if err := rs[0].inv.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range rs {
+		eventually(t, "a was not deleted on replica "+strconv.Itoa(i), func() bool {
+			_, found := r.c.Get("a")
+			return !found
+		})
+		if _, found := r.c.Get("b"); !found {
+			t.Errorf("b was deleted on replica %d", i)
+		}
+	}
+	if n := atomic.LoadInt32(&evicted); n != 1 {
+		t.Errorf("Expected 1 eviction on replica 2, got %d", n)
+	}
+
+	rs[0].inv.SetVersion("cfg", "v2", cache.DefaultExpiration, 2)
+	rs[1].inv.SetVersion("cfg", "v3", cache.DefaultExpiration, 3)
+	rs[2].c.Set("cfg", "v1", cache.DefaultExpiration)
+	rs[0].inv.SetVersion("cfg", "v2", cache.DefaultExpiration, 2)
+	eventually(t, "cfg at v1 was not invalidated", func() bool {
+		_, found := rs[2].c.Get("cfg")
+		return !found
+	})
+	// Replica 1 already has a newer version, so it keeps it.
+	time.Sleep(10 * time.Millisecond)
+	if x, found := rs[1].c.Get("cfg"); !found || x != "v3" {
+		t.Error("cfg at v3 was invalidated by an older version:", x, found)
+	}
+	if v, _ := rs[1].inv.Version("cfg"); v != 3 {
+		t.Error("Unexpected version for cfg on replica 1:", v)
+	}
+
+	if err := rs[1].inv.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range rs {
+		eventually(t, "replica "+strconv.Itoa(i)+" was not flushed", func() bool {
+			return r.c.ItemCount() == 0
+		})
+	}
+}
+
+func TestInvalidationMemory(t *testing.T) {
+	hub := NewHub()
+	testInvalidation(t, newReplicas(t, []Bus{hub.Connect(), hub.Connect(), hub.Connect()}))
+}
+
+func TestInvalidationTCPMesh(t *testing.T) {
+	meshes := make([]*TCPMesh, 3)
+	for i := range meshes {
+		m, err := NewTCPMesh("127.0.0.1:0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meshes[i] = m
+	}
+	buses := make([]Bus, len(meshes))
+	for i, m := range meshes {
+		var peers []string
+		for j, p := range meshes {
+			if i != j {
+				peers = append(peers, p.Addr().String())
+			}
+		}
+		m.SetPeers(peers)
+		buses[i] = m
+	}
+	testInvalidation(t, newReplicas(t, buses))
+}
+
+func TestNoEcho(t *testing.T) {
+	hub := NewHub()
+	b := hub.Connect()
+	c := cache.New(cache.DefaultExpiration, 0)
+	inv := New("r0", c, b)
+	// An event with our own origin, e.g. relayed back by a misbehaving
+	// bus, is ignored.
+	c.Set("a", 1, cache.DefaultExpiration)
+	inv.apply(Event{Kind: Delete, Origin: "r0", Key: "a"})
+	if _, found := c.Get("a"); !found {
+		t.Error("a was deleted by an event from ourselves")
+	}
+
+	published := 0
+	other := hub.Connect()
+	other.Subscribe(func(e Event) {
+		published++
+	})
+	// Applying a remote event must not republish it.
+	hub.Connect().Publish(Event{Kind: Delete, Origin: "r1", Key: "a"})
+	if _, found := c.Get("a"); found {
+		t.Error("a was not deleted by a remote event")
+	}
+	if published != 1 {
+		t.Errorf("Expected the remote event to be seen once, got %d", published)
+	}
+}
+
+func TestTCPMeshPeerDown(t *testing.T) {
+	a, err := NewTCPMesh("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewTCPMesh("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := b.Addr().String()
+	b.Close()
+	a.SetPeers([]string{addr})
+	if err := a.Publish(Event{Kind: Flush, Origin: "a"}); err == nil {
+		t.Error("Publishing to a peer that is down succeeded")
+	}
+	a.Close()
+	if err := a.Publish(Event{Kind: Flush, Origin: "a"}); err != errBusClosed {
+		t.Error("Publishing on a closed mesh returned", err)
+	}
+}
+
+func TestTCPMeshSlowPeer(t *testing.T) {
+	// A peer that accepts connections, but never reads from them.
+	slow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := slow.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	a, err := NewTCPMesh("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Timeout = time.Minute
+	b, err := NewTCPMesh("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	received := make(chan Event, 1)
+	b.Subscribe(func(e Event) {
+		received <- e
+	})
+	a.SetPeers([]string{slow.Addr().String(), b.Addr().String()})
+
+	// An event too big to fit in the slow peer's socket buffers blocks
+	// sending to it, but not to the other peer.
+	published := make(chan error)
+	go func() {
+		published <- a.Publish(Event{Kind: Delete, Origin: "a", Key: strings.Repeat("x", 64<<20)})
+	}()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The event wasn't sent to a peer while another was slow")
+	}
+	select {
+	case err := <-published:
+		t.Fatal("Publish returned before the slow peer read the event:", err)
+	default:
+	}
+	slow.Close()
+	(<-accepted).Close()
+	if err := <-published; err == nil {
+		t.Error("Publishing to a peer that hung up succeeded")
+	}
+}
@@ -0,0 +1,86 @@
+package invalidation
+
+import (
+	"errors"
+	"sync"
+)
+
+var errBusClosed = errors.New("invalidation: bus closed")
+
+// A Hub connects in-process buses to each other, for tests and for running
+// several replicas in one process. Events are delivered synchronously, before
+// Publish returns.
+type Hub struct {
+	mu    sync.RWMutex
+	buses map[*memoryBus]struct{}
+}
+
+// Return a new hub with no buses connected to it.
+func NewHub() *Hub {
+	return &Hub{buses: map[*memoryBus]struct{}{}}
+}
+
+// Connect returns a new bus connected to the hub. Events published on it are
+// delivered to every other bus connected to the hub.
+func (h *Hub) Connect() Bus {
+	b := &memoryBus{hub: h}
+	h.mu.Lock()
+	h.buses[b] = struct{}{}
+	h.mu.Unlock()
+	return b
+}
+
+type memoryBus struct {
+	hub *Hub
+
+	mu     sync.RWMutex
+	subs   []func(Event)
+	closed bool
+}
+
+func (b *memoryBus) Publish(e Event) error {
+	b.mu.RLock()
+	closed := b.closed
+	b.mu.RUnlock()
+	if closed {
+		return errBusClosed
+	}
+	b.hub.mu.RLock()
+	peers := make([]*memoryBus, 0, len(b.hub.buses))
+	for p := range b.hub.buses {
+		if p != b {
+			peers = append(peers, p)
+		}
+	}
+	b.hub.mu.RUnlock()
+	for _, p := range peers {
+		p.deliver(e)
+	}
+	return nil
+}
+
+func (b *memoryBus) deliver(e Event) {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, f := range subs {
+		f(e)
+	}
+}
+
+func (b *memoryBus) Subscribe(f func(Event)) {
+	b.mu.Lock()
+	b.subs = append(b.subs[:len(b.subs):len(b.subs)], f)
+	b.mu.Unlock()
+}
+
+func (b *memoryBus) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.subs = nil
+	b.mu.Unlock()
+	b.hub.mu.Lock()
+	delete(b.hub.buses, b)
+	b.hub.mu.Unlock()
+	return nil
+}
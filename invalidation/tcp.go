@@ -0,0 +1,231 @@
+package invalidation
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A TCPMesh is a bus that connects every replica directly to every other one
+// over TCP. Each replica listens for events from its peers, and sends the
+// events it publishes to each peer over a long-lived connection that is
+// redialed when it breaks. Events are never relayed, so every replica must
+// list every other one as a peer.
+type TCPMesh struct {
+	// Timeout bounds how long dialing a peer and writing an event to it may
+	// take. It defaults to 1 second.
+	Timeout time.Duration
+
+	l  net.Listener
+	wg sync.WaitGroup
+
+	mu     sync.Mutex
+	peers  []*peerConn
+	in     map[net.Conn]struct{}
+	closed bool
+
+	subMu sync.RWMutex
+	subs  []func(Event)
+}
+
+// A peerConn is the connection to a peer. Its lock is held while dialing and
+// writing to it, so that a slow peer only holds up events sent to it.
+type peerConn struct {
+	addr   string
+	mu     sync.Mutex
+	conn   net.Conn
+	enc    *gob.Encoder
+	closed bool
+}
+
+// Return a new mesh that listens for events on the TCP address listenAddr
+// and publishes events to the given peer addresses.
+func NewTCPMesh(listenAddr string, peers []string) (*TCPMesh, error) {
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	m := &TCPMesh{
+		Timeout: time.Second,
+		l:       l,
+		in:      map[net.Conn]struct{}{},
+	}
+	for _, addr := range peers {
+		m.peers = append(m.peers, &peerConn{addr: addr})
+	}
+	m.wg.Add(1)
+	go m.accept()
+	return m, nil
+}
+
+// Returns the address the mesh is listening on.
+func (m *TCPMesh) Addr() net.Addr {
+	return m.l.Addr()
+}
+
+// Replace the set of peers events are published to, e.g. when replicas are
+// added or removed. Connections to peers that are no longer listed are closed.
+func (m *TCPMesh) SetPeers(peers []string) {
+	m.mu.Lock()
+	old := map[string]*peerConn{}
+	for _, pc := range m.peers {
+		old[pc.addr] = pc
+	}
+	m.peers = nil
+	for _, addr := range peers {
+		pc, found := old[addr]
+		if found {
+			delete(old, addr)
+		} else {
+			pc = &peerConn{addr: addr}
+		}
+		m.peers = append(m.peers, pc)
+	}
+	m.mu.Unlock()
+	for _, pc := range old {
+		pc.close()
+	}
+}
+
+// Publish sends e to every peer at once, and returns the errors for any it
+// couldn't be sent to.
+func (m *TCPMesh) Publish(e Event) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return errBusClosed
+	}
+	peers := m.peers
+	timeout := m.Timeout
+	m.mu.Unlock()
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, pc := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pc.send(e, timeout); err != nil {
+				errs[i] = fmt.Errorf("invalidation: publishing to %s: %w", pc.addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// send writes e to the peer, redialing once if the existing connection turns
+// out to be broken. Events for a peer that has been removed, or whose mesh
+// has been closed, since they were published are dropped.
+func (pc *peerConn) send(e Event, timeout time.Duration) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if pc.closed {
+			return nil
+		}
+		if pc.conn == nil {
+			conn, err := net.DialTimeout("tcp", pc.addr, timeout)
+			if err != nil {
+				return err
+			}
+			pc.conn, pc.enc = conn, gob.NewEncoder(conn)
+		}
+		pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+		err := pc.enc.Encode(&e)
+		if err == nil {
+			return nil
+		}
+		pc.conn.Close()
+		pc.conn, pc.enc = nil, nil
+		if attempt == 1 {
+			return err
+		}
+	}
+}
+
+// close closes the connection to the peer, waiting for any event being sent to
+// it, and keeps it from being redialed.
+func (pc *peerConn) close() {
+	pc.mu.Lock()
+	pc.closed = true
+	if pc.conn != nil {
+		pc.conn.Close()
+		pc.conn, pc.enc = nil, nil
+	}
+	pc.mu.Unlock()
+}
+
+func (m *TCPMesh) Subscribe(f func(Event)) {
+	m.subMu.Lock()
+	m.subs = append(m.subs[:len(m.subs):len(m.subs)], f)
+	m.subMu.Unlock()
+}
+
+// Close stops listening, closes all connections and waits for the goroutines
+// receiving events to exit.
+func (m *TCPMesh) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	err := m.l.Close()
+	peers := m.peers
+	m.peers = nil
+	for conn := range m.in {
+		conn.Close()
+	}
+	m.mu.Unlock()
+	for _, pc := range peers {
+		pc.close()
+	}
+	m.wg.Wait()
+	return err
+}
+
+func (m *TCPMesh) accept() {
+	defer m.wg.Done()
+	for {
+		conn, err := m.l.Accept()
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			conn.Close()
+			return
+		}
+		m.in[conn] = struct{}{}
+		m.wg.Add(1)
+		m.mu.Unlock()
+		go m.receive(conn)
+	}
+}
+
+func (m *TCPMesh) receive(conn net.Conn) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.in, conn)
+		m.mu.Unlock()
+		conn.Close()
+		m.wg.Done()
+	}()
+	dec := gob.NewDecoder(conn)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			return
+		}
+		m.subMu.RLock()
+		subs := m.subs
+		m.subMu.RUnlock()
+		for _, f := range subs {
+			f(e)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// A Jitter randomizes how long items are kept: given the duration an item would
+// be kept for, it returns the one it will be kept for instead. Spreading out
+// the expiration times of items that are added together keeps them from all
+// expiring (and being reloaded) at once.
+type Jitter func(d time.Duration) time.Duration
+
+// Returns a Jitter that lengthens or shortens durations by a uniformly random
+// amount of up to pct percent, e.g. 10 for a 1-hour duration to become
+// anything from 54 to 66 minutes.
+//
+// Random numbers are drawn from src, or from the global source of math/rand/v2
+// if src is nil. Pass a seeded source, e.g. rand.NewPCG(1, 2), to get the same
+// durations every time. The source is locked while in use, but should not be
+// used elsewhere.
+//
+// Panics if pct isn't between 0 and 100.
+func JitterPercent(pct float64, src rand.Source) Jitter {
+	if !(pct >= 0 && pct <= 100) {
+		panic(fmt.Sprintf("cache: jitter percentage %v is not between 0 and 100", pct))
+	}
+	random := rand.Float64
+	if src != nil {
+		var mu sync.Mutex
+		r := rand.New(src)
+		random = func() float64 {
+			mu.Lock()
+			f := r.Float64()
+			mu.Unlock()
+			return f
+		}
+	}
+	return func(d time.Duration) time.Duration {
+		// A factor between 1-pct/100 and 1+pct/100.
+		f := 1 + pct/100*(2*random()-1)
+		return time.Duration(float64(d) * f)
+	}
+}
+
+// Returns an option that applies j to the lifetime of every item added to the
+// cache with an expiration time, whether it's the cache's default expiration or
+// one given explicitly.
+func WithJitter(j Jitter) Option {
+	return func(c *cache) {
+		c.jitter = j
+	}
+}
+
+// Add an item to the cache like Set, using j instead of the cache's own Jitter
+// (see WithJitter), if any, to randomize its lifetime. If j is nil, the item is
+// kept for exactly d.
+func (c *cache) SetWithJitter(k string, x interface{}, d time.Duration, j Jitter) {
+	c.mu.Lock()
+	c.setJittered(k, x, d, j)
+	b := c.budget
+	c.mu.Unlock()
+	if b != nil {
+		b.admit(c, k)
+	}
+}
+
+// applyJitter applies j to d, making sure an item that was meant to expire still
+// does.
+func applyJitter(j Jitter, d time.Duration) time.Duration {
+	if d = j(d); d < 1 {
+		d = 1
+	}
+	return d
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJitterPercent(t *testing.T) {
+	j := JitterPercent(10, rand.NewPCG(1, 2))
+	lo, hi := time.Hour, time.Duration(0)
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 1000; i++ {
+		d := j(time.Hour)
+		if d < 54*time.Minute || d > 66*time.Minute {
+			t.Fatalf("%v is more than 10%% off an hour", d)
+		}
+		if d < lo {
+			lo = d
+		}
+		if d > hi {
+			hi = d
+		}
+		seen[d] = true
+	}
+	if lo > 55*time.Minute || hi < 65*time.Minute || len(seen) < 900 {
+		t.Errorf("Durations aren't spread out: %v to %v, %d distinct", lo, hi, len(seen))
+	}
+
+	// The same seed gives the same durations.
+	j1 := JitterPercent(10, rand.NewPCG(1, 2))
+	j2 := JitterPercent(10, rand.NewPCG(1, 2))
+	for i := 0; i < 100; i++ {
+		if d1, d2 := j1(time.Hour), j2(time.Hour); d1 != d2 {
+			t.Fatalf("Seeded jitters differ: %v and %v", d1, d2)
+		}
+	}
+}
+
+func TestJitterPercentRange(t *testing.T) {
+	for _, pct := range []float64{-1, 101, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("JitterPercent(%v) didn't panic", pct)
+				}
+			}()
+			JitterPercent(pct, nil)
+		}()
+	}
+	// 100% may shorten a duration to nothing, but the item still expires.
+	j := JitterPercent(100, rand.NewPCG(1, 2))
+	for i := 0; i < 1000; i++ {
+		if d := applyJitter(j, time.Second); d < 1 || d > 2*time.Second {
+			t.Fatal("Jittered duration out of range:", d)
+		}
+	}
+}
+
+func TestWithJitter(t *testing.T) {
+	// A custom distribution that always adds a minute.
+	j := func(d time.Duration) time.Duration {
+		return d + time.Minute
+	}
+	tc := New(time.Hour, 0, WithJitter(j))
+	check := func(k string, want time.Duration) {
+		t.Helper()
+		_, exp, found := tc.GetWithExpiration(k)
+		if !found {
+			t.Fatalf("%s wasn't found", k)
+		}
+		if got := time.Until(exp); got < want-time.Second || got > want {
+			t.Errorf("%s expires in %v, should be %v", k, got, want)
+		}
+	}
+	tc.Set("set", 1, DefaultExpiration)
+	check("set", 61*time.Minute)
+	tc.Set("explicit", 1, time.Minute)
+	check("explicit", 2*time.Minute)
+	tc.Add("add", 1, DefaultExpiration)
+	check("add", 61*time.Minute)
+	tc.SetWithTags("tagged", 1, DefaultExpiration, "tag")
+	check("tagged", 61*time.Minute)
+	tc.Set("forever", 1, NoExpiration)
+	if _, exp, _ := tc.GetWithExpiration("forever"); !exp.IsZero() {
+		t.Error("An item that never expires got an expiration time")
+	}
+
+	tc.SetWithJitter("percall", 1, time.Minute, func(d time.Duration) time.Duration {
+		return 2 * d
+	})
+	check("percall", 2*time.Minute)
+	tc.SetWithJitter("none", 1, time.Minute, nil)
+	check("none", time.Minute)
+
+	// Jitter can't make an item that should expire live forever.
+	tc.SetWithJitter("short", 1, time.Minute, func(d time.Duration) time.Duration {
+		return -d
+	})
+	<-time.After(time.Millisecond)
+	if _, found := tc.Get("short"); found {
+		t.Error("An item jittered to a negative lifetime didn't expire")
+	}
+}
+
+func TestJitterSpreadsExpiration(t *testing.T) {
+	tc := New(time.Hour, 0, WithJitter(JitterPercent(20, rand.NewPCG(3, 4))))
+	for i := 0; i < 1000; i++ {
+		tc.SetDefault("foo"+strconv.Itoa(i), i)
+	}
+	buckets := map[int64]int{}
+	for _, v := range tc.Items() {
+		buckets[v.Expiration/int64(time.Minute)]++
+	}
+	// 24 minutes' worth of spread, so about 40 items a minute.
+	for _, n := range buckets {
+		if n > 100 {
+			t.Errorf("%d items expire in the same minute", n)
+		}
+	}
+}
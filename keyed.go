@@ -0,0 +1,397 @@
+package cache
+
+import (
+	"fmt"
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A KeyedCache is a cache whose keys are of a comparable type K, e.g. an
+// integer or a struct of them, so that keys don't need to be formatted as
+// strings. It has the core methods of Cache.
+type KeyedCache[K comparable] struct {
+	*keyedCache[K]
+	// If this is confusing, see the comment at the bottom of New()
+}
+
+type keyedCache[K comparable] struct {
+	defaultExpiration time.Duration
+	items             map[K]Item
+	mu                sync.RWMutex
+	onEvicted         func(K, interface{})
+	janitor           *janitor
+}
+
+// Add an item to the cache, replacing any existing item. If the duration is 0
+// (DefaultExpiration), the cache's default expiration time is used. If it is -1
+// (NoExpiration), the item never expires.
+func (c *keyedCache[K]) Set(k K, x interface{}, d time.Duration) {
+	// "Inlining" of set
+	var e int64
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	if d > 0 {
+		e = time.Now().Add(d).UnixNano()
+	}
+	c.mu.Lock()
+	c.items[k] = Item{
+		Object:     x,
+		Expiration: e,
+	}
+	c.mu.Unlock()
+}
+
+func (c *keyedCache[K]) set(k K, x interface{}, d time.Duration) {
+	var e int64
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	if d > 0 {
+		e = time.Now().Add(d).UnixNano()
+	}
+	c.items[k] = Item{
+		Object:     x,
+		Expiration: e,
+	}
+}
+
+// Add an item to the cache, replacing any existing item, using the default
+// expiration.
+func (c *keyedCache[K]) SetDefault(k K, x interface{}) {
+	c.Set(k, x, DefaultExpiration)
+}
+
+// Add an item to the cache only if an item doesn't already exist for the given
+// key, or if the existing item has expired. Returns an error otherwise.
+func (c *keyedCache[K]) Add(k K, x interface{}, d time.Duration) error {
+	c.mu.Lock()
+	_, found := c.get(k)
+	if found {
+		c.mu.Unlock()
+		return fmt.Errorf("Item %v already exists", k)
+	}
+	c.set(k, x, d)
+	c.mu.Unlock()
+	return nil
+}
+
+// Set a new value for the cache key only if it already exists, and the existing
+// item hasn't expired. Returns an error otherwise.
+func (c *keyedCache[K]) Replace(k K, x interface{}, d time.Duration) error {
+	c.mu.Lock()
+	_, found := c.get(k)
+	if !found {
+		c.mu.Unlock()
+		return fmt.Errorf("Item %v doesn't exist", k)
+	}
+	c.set(k, x, d)
+	c.mu.Unlock()
+	return nil
+}
+
+// Get an item from the cache. Returns the item or nil, and a bool indicating
+// whether the key was found.
+func (c *keyedCache[K]) Get(k K) (interface{}, bool) {
+	c.mu.RLock()
+	// "Inlining" of get and Expired
+	item, found := c.items[k]
+	if !found {
+		c.mu.RUnlock()
+		return nil, false
+	}
+	if item.Expiration > 0 {
+		if time.Now().UnixNano() > item.Expiration {
+			c.mu.RUnlock()
+			return nil, false
+		}
+	}
+	c.mu.RUnlock()
+	return item.Object, true
+}
+
+// GetWithExpiration returns an item and its expiration time from the cache.
+// It returns the item or nil, the expiration time if one is set (if the item
+// never expires a zero value for time.Time is returned), and a bool indicating
+// whether the key was found.
+func (c *keyedCache[K]) GetWithExpiration(k K) (interface{}, time.Time, bool) {
+	c.mu.RLock()
+	// "Inlining" of get and Expired
+	item, found := c.items[k]
+	if !found {
+		c.mu.RUnlock()
+		return nil, time.Time{}, false
+	}
+	if item.Expiration > 0 {
+		if time.Now().UnixNano() > item.Expiration {
+			c.mu.RUnlock()
+			return nil, time.Time{}, false
+		}
+		c.mu.RUnlock()
+		return item.Object, time.Unix(0, item.Expiration), true
+	}
+	c.mu.RUnlock()
+	return item.Object, time.Time{}, true
+}
+
+func (c *keyedCache[K]) get(k K) (interface{}, bool) {
+	item, found := c.items[k]
+	if !found {
+		return nil, false
+	}
+	// "Inlining" of Expired
+	if item.Expiration > 0 {
+		if time.Now().UnixNano() > item.Expiration {
+			return nil, false
+		}
+	}
+	return item.Object, true
+}
+
+// Increment an item of type int, int8, int16, int32, int64, uintptr, uint,
+// uint8, uint32, or uint64, float32 or float64 by n. Returns an error if the
+// item's value is not an integer, if it was not found, or if it is not
+// possible to increment it by n.
+func (c *keyedCache[K]) Increment(k K, n int64) error {
+	c.mu.Lock()
+	v, found := c.items[k]
+	if !found || v.Expired() {
+		c.mu.Unlock()
+		return fmt.Errorf("Item %v not found", k)
+	}
+	if !increment(&v, n) {
+		c.mu.Unlock()
+		return fmt.Errorf("The value for %v is not an integer", k)
+	}
+	c.items[k] = v
+	c.mu.Unlock()
+	return nil
+}
+
+// Decrement an item of type int, int8, int16, int32, int64, uintptr, uint,
+// uint8, uint32, or uint64, float32 or float64 by n. Returns an error if the
+// item's value is not an integer, if it was not found, or if it is not
+// possible to decrement it by n.
+func (c *keyedCache[K]) Decrement(k K, n int64) error {
+	return c.Increment(k, -n)
+}
+
+// Delete an item from the cache. Does nothing if the key is not in the cache.
+func (c *keyedCache[K]) Delete(k K) {
+	c.mu.Lock()
+	v, evicted := c.delete(k)
+	c.mu.Unlock()
+	if evicted {
+		c.onEvicted(k, v)
+	}
+}
+
+func (c *keyedCache[K]) delete(k K) (interface{}, bool) {
+	if c.onEvicted != nil {
+		if v, found := c.items[k]; found {
+			delete(c.items, k)
+			return v.Object, true
+		}
+	}
+	delete(c.items, k)
+	return nil, false
+}
+
+// Delete all expired items from the cache.
+func (c *keyedCache[K]) DeleteExpired() {
+	type keyAndValue struct {
+		key   K
+		value interface{}
+	}
+	var evictedItems []keyAndValue
+	now := time.Now().UnixNano()
+	c.mu.Lock()
+	for k, v := range c.items {
+		// "Inlining" of expired
+		if v.Expiration > 0 && now > v.Expiration {
+			ov, evicted := c.delete(k)
+			if evicted {
+				evictedItems = append(evictedItems, keyAndValue{k, ov})
+			}
+		}
+	}
+	c.mu.Unlock()
+	for _, v := range evictedItems {
+		c.onEvicted(v.key, v.value)
+	}
+}
+
+// Sets an (optional) function that is called with the key and value when an
+// item is evicted from the cache. (Including when it is deleted manually, but
+// not when it is overwritten.) Set to nil to disable.
+func (c *keyedCache[K]) OnEvicted(f func(K, interface{})) {
+	c.mu.Lock()
+	c.onEvicted = f
+	c.mu.Unlock()
+}
+
+// Copies all unexpired items in the cache into a new map and returns it.
+func (c *keyedCache[K]) Items() map[K]Item {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m := make(map[K]Item, len(c.items))
+	now := time.Now().UnixNano()
+	for k, v := range c.items {
+		// "Inlining" of Expired
+		if v.Expiration > 0 {
+			if now > v.Expiration {
+				continue
+			}
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// Returns the number of items in the cache. This may include items that have
+// expired, but have not yet been cleaned up.
+func (c *keyedCache[K]) ItemCount() int {
+	c.mu.RLock()
+	n := len(c.items)
+	c.mu.RUnlock()
+	return n
+}
+
+// Delete all items from the cache.
+func (c *keyedCache[K]) Flush() {
+	c.mu.Lock()
+	c.items = map[K]Item{}
+	c.mu.Unlock()
+}
+
+func stopKeyedJanitor[K comparable](c *KeyedCache[K]) {
+	c.janitor.stop <- true
+}
+
+func newKeyedCache[K comparable](de time.Duration) *keyedCache[K] {
+	if de == 0 {
+		de = -1
+	}
+	return &keyedCache[K]{
+		defaultExpiration: de,
+		items:             map[K]Item{},
+	}
+}
+
+// Return a new cache with keys of type K, and a given default expiration
+// duration and cleanup interval (see New()).
+func NewKeyed[K comparable](defaultExpiration, cleanupInterval time.Duration) *KeyedCache[K] {
+	c := newKeyedCache[K](defaultExpiration)
+	C := &KeyedCache[K]{c}
+	if cleanupInterval > 0 {
+		c.janitor = &janitor{
+			Interval: cleanupInterval,
+			stop:     make(chan bool),
+		}
+		go c.janitor.Run(c)
+		runtime.SetFinalizer(C, stopKeyedJanitor[K])
+	}
+	return C
+}
+
+// A sharded cache with keys of type K. See shardedCache.
+type unexportedShardedKeyedCache[K comparable] struct {
+	*shardedKeyedCache[K]
+}
+
+type shardedKeyedCache[K comparable] struct {
+	hash    func(K) uint32
+	cs      []*keyedCache[K]
+	janitor *janitor
+}
+
+func (sc *shardedKeyedCache[K]) bucket(k K) *keyedCache[K] {
+	return sc.cs[sc.hash(k)%uint32(len(sc.cs))]
+}
+
+func (sc *shardedKeyedCache[K]) Set(k K, x interface{}, d time.Duration) {
+	sc.bucket(k).Set(k, x, d)
+}
+
+func (sc *shardedKeyedCache[K]) Add(k K, x interface{}, d time.Duration) error {
+	return sc.bucket(k).Add(k, x, d)
+}
+
+func (sc *shardedKeyedCache[K]) Replace(k K, x interface{}, d time.Duration) error {
+	return sc.bucket(k).Replace(k, x, d)
+}
+
+func (sc *shardedKeyedCache[K]) Get(k K) (interface{}, bool) {
+	return sc.bucket(k).Get(k)
+}
+
+func (sc *shardedKeyedCache[K]) Increment(k K, n int64) error {
+	return sc.bucket(k).Increment(k, n)
+}
+
+func (sc *shardedKeyedCache[K]) Decrement(k K, n int64) error {
+	return sc.bucket(k).Decrement(k, n)
+}
+
+func (sc *shardedKeyedCache[K]) Delete(k K) {
+	sc.bucket(k).Delete(k)
+}
+
+func (sc *shardedKeyedCache[K]) DeleteExpired() {
+	for _, v := range sc.cs {
+		v.DeleteExpired()
+	}
+}
+
+// Returns the items in each shard. See shardedCache.Items.
+func (sc *shardedKeyedCache[K]) Items() []map[K]Item {
+	res := make([]map[K]Item, len(sc.cs))
+	for i, v := range sc.cs {
+		res[i] = v.Items()
+	}
+	return res
+}
+
+func (sc *shardedKeyedCache[K]) Flush() {
+	for _, v := range sc.cs {
+		v.Flush()
+	}
+}
+
+func stopShardedKeyedJanitor[K comparable](sc *unexportedShardedKeyedCache[K]) {
+	sc.janitor.stop <- true
+}
+
+// Like unexportedNewSharded, but for keys of type K, which are hashed with
+// hash/maphash.
+func unexportedNewShardedKeyed[K comparable](defaultExpiration, cleanupInterval time.Duration, shards int) *unexportedShardedKeyedCache[K] {
+	seed := maphash.MakeSeed()
+	return unexportedNewShardedKeyedWithHash(defaultExpiration, cleanupInterval, shards, func(k K) uint32 {
+		h := maphash.Comparable(seed, k)
+		return uint32(h ^ h>>32)
+	})
+}
+
+// Like unexportedNewShardedKeyed, but picks shards for keys with the given
+// hash function, which may be faster for keys that are already hashes.
+func unexportedNewShardedKeyedWithHash[K comparable](defaultExpiration, cleanupInterval time.Duration, shards int, hash func(K) uint32) *unexportedShardedKeyedCache[K] {
+	sc := &shardedKeyedCache[K]{
+		hash: hash,
+		cs:   make([]*keyedCache[K], shards),
+	}
+	for i := range sc.cs {
+		sc.cs[i] = newKeyedCache[K](defaultExpiration)
+	}
+	SC := &unexportedShardedKeyedCache[K]{sc}
+	if cleanupInterval > 0 {
+		sc.janitor = &janitor{
+			Interval: cleanupInterval,
+			stop:     make(chan bool),
+		}
+		go sc.janitor.Run(sc)
+		runtime.SetFinalizer(SC, stopShardedKeyedJanitor[K])
+	}
+	return SC
+}
@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type slotKey struct {
+	PubID, SlotID int64
+}
+
+func TestKeyedCache(t *testing.T) {
+	tc := NewKeyed[slotKey](DefaultExpiration, 0)
+	k := slotKey{1, 2}
+	if _, found := tc.Get(k); found {
+		t.Error("Getting a key found value that shouldn't exist")
+	}
+	tc.Set(k, 10, DefaultExpiration)
+	if x, found := tc.Get(slotKey{1, 2}); !found || x != 10 {
+		t.Error("Expected 10 for an equal key, got", x)
+	}
+	if _, found := tc.Get(slotKey{2, 1}); found {
+		t.Error("Found a value for a different key")
+	}
+	if err := tc.Add(k, 1, DefaultExpiration); err == nil {
+		t.Error("Added a key that already exists")
+	}
+	if err := tc.Replace(slotKey{3, 3}, 1, DefaultExpiration); err == nil {
+		t.Error("Replaced a key that doesn't exist")
+	} else if err.Error() != "Item {3 3} doesn't exist" {
+		t.Error("Unexpected error:", err)
+	}
+	if err := tc.Increment(k, 5); err != nil {
+		t.Error(err)
+	}
+	if err := tc.Decrement(k, 1); err != nil {
+		t.Error(err)
+	}
+	if x, _ := tc.Get(k); x != 14 {
+		t.Error("Expected 14, got", x)
+	}
+
+	var evicted []slotKey
+	tc.OnEvicted(func(k slotKey, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Delete(k)
+	if len(evicted) != 1 || evicted[0] != k {
+		t.Error("Expected the key to be evicted, got", evicted)
+	}
+	tc.Set(slotKey{4, 4}, "x", DefaultExpiration)
+	if tc.ItemCount() != 1 || len(tc.Items()) != 1 {
+		t.Error("Expected 1 item, got", tc.Items())
+	}
+	tc.Flush()
+	if tc.ItemCount() != 0 {
+		t.Error("Flush left items in the cache")
+	}
+}
+
+func TestKeyedCacheExpiration(t *testing.T) {
+	tc := NewKeyed[uint64](50*time.Millisecond, time.Millisecond)
+	tc.Set(1, "a", DefaultExpiration)
+	tc.Set(2, "b", NoExpiration)
+	tc.Set(3, "c", 20*time.Millisecond)
+	if _, e, _ := tc.GetWithExpiration(2); !e.IsZero() {
+		t.Error("2 has an expiration time:", e)
+	}
+	<-time.After(25 * time.Millisecond)
+	if _, found := tc.Get(3); found {
+		t.Error("Found 3 when it should have been automatically deleted")
+	}
+	if err := tc.Increment(3, 1); err == nil {
+		t.Error("Incremented an expired item")
+	}
+	<-time.After(30 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for tc.ItemCount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("The janitor didn't delete the expired items")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShardedKeyedCache(t *testing.T) {
+	tc := unexportedNewShardedKeyed[slotKey](DefaultExpiration, 0, 13)
+	for i := int64(0); i < 1000; i++ {
+		tc.Set(slotKey{i, i * 2}, i, DefaultExpiration)
+	}
+	for i := int64(0); i < 1000; i++ {
+		if x, found := tc.Get(slotKey{i, i * 2}); !found || x != i {
+			t.Fatalf("Expected %d, got %v", i, x)
+		}
+	}
+	empty := 0
+	total := 0
+	for _, items := range tc.Items() {
+		if len(items) == 0 {
+			empty++
+		}
+		total += len(items)
+	}
+	if empty > 0 || total != 1000 {
+		t.Errorf("Expected 1000 items spread over every shard, got %d with %d empty shards", total, empty)
+	}
+	tc.Delete(slotKey{0, 0})
+	if _, found := tc.Get(slotKey{0, 0}); found {
+		t.Error("Delete didn't delete the item")
+	}
+
+	hashes := unexportedNewShardedKeyedWithHash(DefaultExpiration, 0, 8, func(k uint64) uint32 {
+		return uint32(k)
+	})
+	hashes.Set(0xdeadbeef, "x", DefaultExpiration)
+	if x, _ := hashes.cs[0xdeadbeef%8].Get(0xdeadbeef); x != "x" {
+		t.Error("The given hash function wasn't used")
+	}
+}
+
+func BenchmarkCacheSetSprintfKey(b *testing.B) {
+	b.ReportAllocs()
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < b.N; i++ {
+		tc.Set(fmt.Sprintf("%d:%d", int64(i%1000), int64(7)), "bar", DefaultExpiration)
+	}
+}
+
+func BenchmarkKeyedCacheSetStructKey(b *testing.B) {
+	b.ReportAllocs()
+	tc := NewKeyed[slotKey](DefaultExpiration, 0)
+	for i := 0; i < b.N; i++ {
+		tc.Set(slotKey{int64(i % 1000), 7}, "bar", DefaultExpiration)
+	}
+}
+
+func BenchmarkCacheGetSprintfKey(b *testing.B) {
+	b.ReportAllocs()
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	tc.Set("1:7", "bar", DefaultExpiration)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Get(fmt.Sprintf("%d:%d", int64(1), int64(7)))
+	}
+}
+
+func BenchmarkKeyedCacheGetStructKey(b *testing.B) {
+	b.ReportAllocs()
+	b.StopTimer()
+	tc := NewKeyed[slotKey](DefaultExpiration, 0)
+	tc.Set(slotKey{1, 7}, "bar", DefaultExpiration)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Get(slotKey{1, 7})
+	}
+}
+
+func BenchmarkKeyedCacheGetUint64Key(b *testing.B) {
+	b.ReportAllocs()
+	b.StopTimer()
+	tc := NewKeyed[uint64](DefaultExpiration, 0)
+	tc.Set(0xdeadbeef, "bar", DefaultExpiration)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Get(0xdeadbeef)
+	}
+}
+
+func BenchmarkShardedCacheGetSprintfKey(b *testing.B) {
+	b.ReportAllocs()
+	b.StopTimer()
+	tc := unexportedNewSharded(DefaultExpiration, 0, 10)
+	tc.Set("1:7", "bar", DefaultExpiration)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Get(fmt.Sprintf("%d:%d", int64(1), int64(7)))
+	}
+}
+
+func BenchmarkShardedKeyedCacheGetStructKey(b *testing.B) {
+	b.ReportAllocs()
+	b.StopTimer()
+	tc := unexportedNewShardedKeyed[slotKey](DefaultExpiration, 0, 10)
+	tc.Set(slotKey{1, 7}, "bar", DefaultExpiration)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Get(slotKey{1, 7})
+	}
+}
@@ -0,0 +1,623 @@
+// Package memcached serves a cache over TCP using the memcached text protocol,
+// so that programs not written in Go can read and write the same data.
+//
+// Supported commands are get, gets, set, add, replace, cas, delete, incr, decr,
+// touch, flush_all, stats, version and quit.
+//
+// Values set through the protocol are stored in the cache as Entry values,
+// except for values that are the canonical decimal form of a uint64 and have
+// no flags, which are stored as uint64 so that incr and decr can use the
+// cache's IncrementUint64 and DecrementUint64. Their CAS uniques are kept by
+// the server, and only apply while the value is the one the server last saw.
+// Values of other types set directly on the cache, and uint64 values changed
+// directly, are served with no flags and a CAS unique of 0: strings and
+// []byte values as-is, and anything else formatted with fmt.Sprint.
+//
+// An exptime of 0 means the cache's default expiration, a negative exptime
+// means the item expires immediately, values up to 30 days are relative
+// numbers of seconds, and larger values are absolute Unix timestamps.
+package memcached
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// An Entry is a value stored through the protocol.
+type Entry struct {
+	Flags uint32
+	Data  []byte
+	CAS   uint64
+}
+
+// A counter is the value of a uint64 stored through the protocol, and its CAS
+// unique, which changes whenever it's incremented, decremented or touched.
+type counter struct {
+	value uint64
+	cas   uint64
+}
+
+const (
+	maxKeyLen       = 250
+	maxLineLen      = 2048
+	maxRelativeTime = 60 * 60 * 24 * 30
+	minPruneAt      = 1024
+	version         = "go-cache"
+)
+
+var (
+	errClosed      = errors.New("memcached: server closed")
+	errLineTooLong = errors.New("memcached: line too long")
+)
+
+// A Server serves a *cache.Cache over the memcached text protocol.
+type Server struct {
+	c *cache.Cache
+
+	// MaxValueSize is the largest value, in bytes, a client may store. It
+	// defaults to 1 MB, like memcached's default item size limit.
+	MaxValueSize int
+
+	// mu serializes the server's read-modify-write commands (add, replace,
+	// cas, touch, incr and decr). Writes made to the cache directly, not
+	// through the server, aren't covered by it.
+	mu  sync.Mutex
+	cas uint64
+	// The flush scheduled by flush_all with a delay, if any.
+	flushTimer *time.Timer
+
+	// The counters set through the server. Keys that no longer hold the
+	// value recorded for them are pruned whenever the map has doubled in
+	// size since it was last pruned.
+	countersMu sync.Mutex
+	counters   map[string]counter
+	pruneAt    int
+
+	connMu    sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// Return a new server for the given cache.
+func NewServer(c *cache.Cache) *Server {
+	return &Server{
+		c:            c,
+		MaxValueSize: 1 << 20,
+		counters:     map[string]counter{},
+		pruneAt:      minPruneAt,
+		listeners:    map[net.Listener]struct{}{},
+		conns:        map[net.Conn]struct{}{},
+	}
+}
+
+// Listen on the TCP network address addr and serve connections on it. It
+// returns when Close is called or the listener fails.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Accept connections on l and serve each of them in its own goroutine. It
+// returns when Close is called or l fails, and always closes l.
+func (s *Server) Serve(l net.Listener) error {
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		l.Close()
+		return errClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.connMu.Unlock()
+	defer func() {
+		s.connMu.Lock()
+		delete(s.listeners, l)
+		s.connMu.Unlock()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.connMu.Lock()
+			closed := s.closed
+			s.connMu.Unlock()
+			if closed {
+				return errClosed
+			}
+			return err
+		}
+		s.connMu.Lock()
+		if s.closed {
+			s.connMu.Unlock()
+			conn.Close()
+			return errClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.connMu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops all listeners and closes all open connections, and waits for
+// their goroutines to exit.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	s.mu.Unlock()
+	s.connMu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connMu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.connMu.Lock()
+		delete(s.conns, conn)
+		s.connMu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if err == errLineTooLong {
+			// The rest of the line can't be skipped without reading it,
+			// so drop the connection like memcached does.
+			io.WriteString(w, "CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if err := s.dispatch(r, w, strings.Fields(line)); err != nil {
+			w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLine reads a line terminated by \r\n (or just \n) and strips the
+// terminator. Returns errLineTooLong if the line is longer than maxLineLen.
+func readLine(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		frag, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		sb.Write(frag)
+		if sb.Len() > maxLineLen {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return sb.String(), nil
+		}
+	}
+}
+
+// dispatch runs a single command. A non-nil error means the connection should
+// be closed.
+func (s *Server) dispatch(r *bufio.Reader, w *bufio.Writer, args []string) error {
+	if len(args) == 0 {
+		io.WriteString(w, "ERROR\r\n")
+		return nil
+	}
+	switch args[0] {
+	case "get":
+		return s.get(w, args[1:], false)
+	case "gets":
+		return s.get(w, args[1:], true)
+	case "set", "add", "replace", "cas":
+		return s.store(r, w, args)
+	case "delete":
+		return s.delete(w, args[1:])
+	case "incr", "decr":
+		return s.incrDecr(w, args)
+	case "touch":
+		return s.touch(w, args[1:])
+	case "flush_all":
+		return s.flushAll(w, args[1:])
+	case "stats":
+		return s.stats(w)
+	case "version":
+		io.WriteString(w, "VERSION "+version+"\r\n")
+		return nil
+	case "quit":
+		return io.EOF
+	}
+	io.WriteString(w, "ERROR\r\n")
+	return nil
+}
+
+func clientError(w *bufio.Writer, msg string) error {
+	io.WriteString(w, "CLIENT_ERROR "+msg+"\r\n")
+	return nil
+}
+
+func validKey(k string) bool {
+	if len(k) == 0 || len(k) > maxKeyLen {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] <= ' ' || k[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// noreply strips a trailing "noreply" from args.
+func noreply(args []string) ([]string, bool) {
+	if n := len(args); n > 0 && args[n-1] == "noreply" {
+		return args[:n-1], true
+	}
+	return args, false
+}
+
+// reply writes msg unless the client asked for no reply.
+func reply(w *bufio.Writer, quiet bool, msg string) {
+	if !quiet {
+		io.WriteString(w, msg+"\r\n")
+	}
+}
+
+// duration converts a memcached exptime into a duration to pass to Set. The
+// bool is false if the item should expire immediately.
+func duration(exptime int64) (time.Duration, bool) {
+	switch {
+	case exptime == 0:
+		return cache.DefaultExpiration, true
+	case exptime < 0:
+		return 0, false
+	case exptime <= maxRelativeTime:
+		return time.Duration(exptime) * time.Second, true
+	}
+	d := time.Until(time.Unix(exptime, 0))
+	return d, d > 0
+}
+
+// encode renders the cached value of k as memcached flags, data and CAS
+// unique.
+func (s *Server) encode(k string, x interface{}) (uint32, []byte, uint64) {
+	switch v := x.(type) {
+	case Entry:
+		return v.Flags, v.Data, v.CAS
+	case uint64:
+		s.countersMu.Lock()
+		c, found := s.counters[k]
+		s.countersMu.Unlock()
+		var cas uint64
+		if found && c.value == v {
+			cas = c.cas
+		}
+		return 0, []byte(strconv.FormatUint(v, 10)), cas
+	case []byte:
+		return 0, v, 0
+	case string:
+		return 0, []byte(v), 0
+	}
+	return 0, []byte(fmt.Sprint(x)), 0
+}
+
+// decode turns data stored by a client into the value to put in the cache.
+func (s *Server) decode(flags uint32, data []byte) interface{} {
+	if flags == 0 {
+		if n, err := strconv.ParseUint(string(data), 10, 64); err == nil && strconv.FormatUint(n, 10) == string(data) {
+			return n
+		}
+	}
+	return Entry{
+		Flags: flags,
+		Data:  data,
+		CAS:   s.nextCAS(),
+	}
+}
+
+// nextCAS returns a new CAS unique.
+func (s *Server) nextCAS() uint64 {
+	return atomic.AddUint64(&s.cas, 1)
+}
+
+// setCAS records the value x just stored for k, giving it a new CAS unique if
+// it's a counter, and forgetting any counter k held otherwise.
+func (s *Server) setCAS(k string, x interface{}) {
+	s.countersMu.Lock()
+	defer s.countersMu.Unlock()
+	v, ok := x.(uint64)
+	if !ok {
+		delete(s.counters, k)
+		return
+	}
+	s.counters[k] = counter{value: v, cas: s.nextCAS()}
+	if len(s.counters) < s.pruneAt {
+		return
+	}
+	for k, c := range s.counters {
+		if x, found := s.c.Get(k); !found || x != c.value {
+			delete(s.counters, k)
+		}
+	}
+	s.pruneAt = max(2*len(s.counters), minPruneAt)
+}
+
+func (s *Server) get(w *bufio.Writer, keys []string, withCAS bool) error {
+	if len(keys) == 0 {
+		io.WriteString(w, "ERROR\r\n")
+		return nil
+	}
+	for _, k := range keys {
+		x, found := s.c.Get(k)
+		if !found {
+			continue
+		}
+		flags, data, cas := s.encode(k, x)
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", k, flags, len(data), cas)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", k, flags, len(data))
+		}
+		w.Write(data)
+		io.WriteString(w, "\r\n")
+	}
+	io.WriteString(w, "END\r\n")
+	return nil
+}
+
+func (s *Server) store(r *bufio.Reader, w *bufio.Writer, args []string) error {
+	cmd := args[0]
+	args, quiet := noreply(args[1:])
+	want := 4
+	if cmd == "cas" {
+		want = 5
+	}
+	if len(args) != want {
+		io.WriteString(w, "ERROR\r\n")
+		return nil
+	}
+	k := args[0]
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+		return clientError(w, "bad command line format")
+	}
+	var unique uint64
+	if cmd == "cas" {
+		var err error
+		if unique, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+			return clientError(w, "bad command line format")
+		}
+	}
+	if size > s.MaxValueSize {
+		// The data block can't be skipped reliably, so drop the
+		// connection like memcached does.
+		io.WriteString(w, "SERVER_ERROR object too large for cache\r\n")
+		return errors.New("value too large")
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		io.WriteString(w, "CLIENT_ERROR bad data chunk\r\n")
+		return errors.New("bad data chunk")
+	}
+	data = data[:size]
+	if !validKey(k) {
+		return clientError(w, "bad key")
+	}
+
+	d, live := duration(exptime)
+	x := s.decode(uint32(flags), data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd {
+	case "add":
+		if _, found := s.c.Get(k); found {
+			reply(w, quiet, "NOT_STORED")
+			return nil
+		}
+	case "replace":
+		if _, found := s.c.Get(k); !found {
+			reply(w, quiet, "NOT_STORED")
+			return nil
+		}
+	case "cas":
+		old, found := s.c.Get(k)
+		if !found {
+			reply(w, quiet, "NOT_FOUND")
+			return nil
+		}
+		if _, _, cas := s.encode(k, old); cas != unique {
+			reply(w, quiet, "EXISTS")
+			return nil
+		}
+	}
+	if live {
+		s.c.Set(k, x, d)
+		s.setCAS(k, x)
+	} else {
+		s.c.Delete(k)
+		s.setCAS(k, nil)
+	}
+	reply(w, quiet, "STORED")
+	return nil
+}
+
+func (s *Server) delete(w *bufio.Writer, args []string) error {
+	args, quiet := noreply(args)
+	// Older clients send a "0" time argument; accept and ignore it.
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 {
+		io.WriteString(w, "ERROR\r\n")
+		return nil
+	}
+	k := args[0]
+	s.mu.Lock()
+	_, found := s.c.Get(k)
+	s.c.Delete(k)
+	s.setCAS(k, nil)
+	s.mu.Unlock()
+	if !found {
+		reply(w, quiet, "NOT_FOUND")
+		return nil
+	}
+	reply(w, quiet, "DELETED")
+	return nil
+}
+
+func (s *Server) incrDecr(w *bufio.Writer, args []string) error {
+	cmd := args[0]
+	args, quiet := noreply(args[1:])
+	if len(args) != 2 {
+		io.WriteString(w, "ERROR\r\n")
+		return nil
+	}
+	k := args[0]
+	n, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return clientError(w, "invalid numeric delta argument")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	x, found := s.c.Get(k)
+	if !found {
+		reply(w, quiet, "NOT_FOUND")
+		return nil
+	}
+	cur, ok := x.(uint64)
+	if !ok {
+		return clientError(w, "cannot increment or decrement non-numeric value")
+	}
+	var nv uint64
+	if cmd == "incr" {
+		nv, err = s.c.IncrementUint64(k, n)
+	} else {
+		// memcached clamps decrements at 0 instead of wrapping around.
+		if n > cur {
+			n = cur
+		}
+		nv, err = s.c.DecrementUint64(k, n)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "SERVER_ERROR %s\r\n", err)
+		return nil
+	}
+	s.setCAS(k, nv)
+	reply(w, quiet, strconv.FormatUint(nv, 10))
+	return nil
+}
+
+func (s *Server) touch(w *bufio.Writer, args []string) error {
+	args, quiet := noreply(args)
+	if len(args) != 2 {
+		io.WriteString(w, "ERROR\r\n")
+		return nil
+	}
+	k := args[0]
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return clientError(w, "invalid exptime argument")
+	}
+	d, live := duration(exptime)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	x, found := s.c.Get(k)
+	if !found {
+		reply(w, quiet, "NOT_FOUND")
+		return nil
+	}
+	if live {
+		s.c.Set(k, x, d)
+		s.setCAS(k, x)
+	} else {
+		s.c.Delete(k)
+		s.setCAS(k, nil)
+	}
+	reply(w, quiet, "TOUCHED")
+	return nil
+}
+
+func (s *Server) flushAll(w *bufio.Writer, args []string) error {
+	args, quiet := noreply(args)
+	var delay int64
+	if len(args) > 1 {
+		io.WriteString(w, "ERROR\r\n")
+		return nil
+	}
+	if len(args) == 1 {
+		var err error
+		if delay, err = strconv.ParseInt(args[0], 10, 64); err != nil || delay < 0 {
+			return clientError(w, "invalid exptime argument")
+		}
+	}
+	s.mu.Lock()
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if delay == 0 {
+		s.flush()
+	} else {
+		s.flushTimer = time.AfterFunc(time.Duration(delay)*time.Second, s.flush)
+	}
+	s.mu.Unlock()
+	reply(w, quiet, "OK")
+	return nil
+}
+
+// flush deletes all items, and the counters' CAS uniques.
+func (s *Server) flush() {
+	s.c.Flush()
+	s.countersMu.Lock()
+	clear(s.counters)
+	s.pruneAt = minPruneAt
+	s.countersMu.Unlock()
+}
+
+func (s *Server) stats(w *bufio.Writer) error {
+	s.connMu.Lock()
+	conns := len(s.conns)
+	s.connMu.Unlock()
+	fmt.Fprintf(w, "STAT time %d\r\n", time.Now().Unix())
+	fmt.Fprintf(w, "STAT version %s\r\n", version)
+	fmt.Fprintf(w, "STAT curr_connections %d\r\n", conns)
+	fmt.Fprintf(w, "STAT curr_items %d\r\n", s.c.ItemCount())
+	io.WriteString(w, "END\r\n")
+	return nil
+}
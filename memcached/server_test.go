@@ -0,0 +1,282 @@
+package memcached
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+type testClient struct {
+	t    *testing.T
+	s    *Server
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestServer(t *testing.T) (*testClient, *cache.Cache) {
+	tc := cache.New(cache.DefaultExpiration, 0)
+	s := NewServer(tc)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, s: s, conn: conn, r: bufio.NewReader(conn)}, tc
+}
+
+// do sends a request and reads lines until one of them starts with a
+// terminal response, returning everything read.
+func (c *testClient) do(req string, lines int) string {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, req); err != nil {
+		c.t.Fatal(err)
+	}
+	var sb strings.Builder
+	for i := 0; i < lines; i++ {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("Reading response to %q: %v (got %q)", req, err, sb.String())
+		}
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
+
+func (c *testClient) expect(req string, want string) {
+	c.t.Helper()
+	if got := c.do(req, strings.Count(want, "\n")); got != want {
+		c.t.Errorf("%q: expected %q, got %q", req, want, got)
+	}
+}
+
+func TestSetGet(t *testing.T) {
+	c, tc := newTestServer(t)
+	c.expect("set foo 5 0 3\r\nbar\r\n", "STORED\r\n")
+	c.expect("get foo\r\n", "VALUE foo 5 3\r\nbar\r\nEND\r\n")
+	c.expect("get missing\r\n", "END\r\n")
+	c.expect("set n 0 0 2\r\n42\r\n", "STORED\r\n")
+	if x, _ := tc.Get("n"); x != uint64(42) {
+		t.Errorf("Expected n to be stored as uint64(42), got %T %v", x, x)
+	}
+	c.expect("set z 0 0 2\r\n07\r\n", "STORED\r\n")
+	c.expect("get z\r\n", "VALUE z 0 2\r\n07\r\nEND\r\n")
+
+	tc.Set("gostr", "hello", cache.DefaultExpiration)
+	tc.Set("goint", 7, cache.DefaultExpiration)
+	c.expect("get foo gostr goint missing\r\n",
+		"VALUE foo 5 3\r\nbar\r\nVALUE gostr 0 5\r\nhello\r\nVALUE goint 0 1\r\n7\r\nEND\r\n")
+
+	c.expect("set foo 0 0 3 noreply\r\nbaz\r\nget foo\r\n", "VALUE foo 0 3\r\nbaz\r\nEND\r\n")
+	c.expect("set foo 0 0 3\r\nbarbaz\r\n", "CLIENT_ERROR bad data chunk\r\n")
+}
+
+func TestLineTooLong(t *testing.T) {
+	c, _ := newTestServer(t)
+	c.expect("get "+strings.Repeat("x", maxLineLen)+"\r\n", "CLIENT_ERROR line too long\r\n")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("Connection was not closed after a line that was too long")
+	}
+}
+
+func TestAddReplaceDelete(t *testing.T) {
+	c, _ := newTestServer(t)
+	c.expect("add foo 0 0 1\r\na\r\n", "STORED\r\n")
+	c.expect("add foo 0 0 1\r\nb\r\n", "NOT_STORED\r\n")
+	c.expect("replace bar 0 0 1\r\nb\r\n", "NOT_STORED\r\n")
+	c.expect("replace foo 0 0 1\r\nc\r\n", "STORED\r\n")
+	c.expect("get foo\r\n", "VALUE foo 0 1\r\nc\r\nEND\r\n")
+	c.expect("delete foo\r\n", "DELETED\r\n")
+	c.expect("delete foo\r\n", "NOT_FOUND\r\n")
+	c.expect("get foo\r\n", "END\r\n")
+}
+
+func TestCAS(t *testing.T) {
+	c, _ := newTestServer(t)
+	c.expect("cas foo 0 0 1 1\r\na\r\n", "NOT_FOUND\r\n")
+	c.expect("set foo 0 0 1\r\na\r\n", "STORED\r\n")
+	res := c.do("gets foo\r\n", 3)
+	var unique uint64
+	if _, err := fmt.Sscanf(res, "VALUE foo 0 1 %d\r\n", &unique); err != nil {
+		t.Fatalf("Couldn't parse gets response %q: %v", res, err)
+	}
+	c.expect(fmt.Sprintf("cas foo 0 0 1 %d\r\nb\r\n", unique), "STORED\r\n")
+	c.expect(fmt.Sprintf("cas foo 0 0 1 %d\r\nc\r\n", unique), "EXISTS\r\n")
+	c.expect("get foo\r\n", "VALUE foo 0 1\r\nb\r\nEND\r\n")
+}
+
+// gets returns the CAS unique of the item k.
+func (c *testClient) gets(k string) uint64 {
+	c.t.Helper()
+	res := c.do("gets "+k+"\r\n", 3)
+	var unique uint64
+	if _, err := fmt.Sscanf(res, "VALUE "+k+" %d %d %d\r\n", new(int), new(int), &unique); err != nil {
+		c.t.Fatalf("Couldn't parse gets response %q: %v", res, err)
+	}
+	return unique
+}
+
+func TestCounterCAS(t *testing.T) {
+	c, _ := newTestServer(t)
+	c.expect("set n 0 0 1\r\n5\r\n", "STORED\r\n")
+	c.expect("set m 0 0 1\r\n5\r\n", "STORED\r\n")
+	unique := c.gets("n")
+	if c.gets("m") == unique {
+		t.Error("Two counters with the same value have the same CAS unique")
+	}
+	// Back to the same value, but changed since gets.
+	c.expect("incr n 1\r\n", "6\r\n")
+	c.expect("decr n 1\r\n", "5\r\n")
+	c.expect(fmt.Sprintf("cas n 0 0 1 %d\r\n7\r\n", unique), "EXISTS\r\n")
+	unique = c.gets("n")
+	c.expect("touch n 100\r\n", "TOUCHED\r\n")
+	c.expect(fmt.Sprintf("cas n 0 0 1 %d\r\n7\r\n", unique), "EXISTS\r\n")
+	c.expect(fmt.Sprintf("cas n 0 0 1 %d\r\n7\r\n", c.gets("n")), "STORED\r\n")
+}
+
+func TestCounterCASChangedDirectly(t *testing.T) {
+	c, tc := newTestServer(t)
+	c.expect("set n 0 0 1\r\n5\r\n", "STORED\r\n")
+	unique := c.gets("n")
+	tc.IncrementUint64("n", 1)
+	if c.gets("n") == unique {
+		t.Error("A counter changed directly kept its CAS unique")
+	}
+	c.expect(fmt.Sprintf("cas n 0 0 1 %d\r\n7\r\n", unique), "EXISTS\r\n")
+
+	// The uniques of counters that are gone are forgotten eventually.
+	for i := 0; i < 10*minPruneAt; i++ {
+		k := "k" + strconv.Itoa(i)
+		c.expect("set "+k+" 0 0 1\r\n1\r\n", "STORED\r\n")
+		tc.Delete(k)
+	}
+	c.s.countersMu.Lock()
+	n := len(c.s.counters)
+	c.s.countersMu.Unlock()
+	if n > 2*minPruneAt {
+		t.Error("Expected the counters that were flushed to be forgotten, got", n)
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	c, tc := newTestServer(t)
+	c.expect("incr n 1\r\n", "NOT_FOUND\r\n")
+	c.expect("set n 0 0 2\r\n10\r\n", "STORED\r\n")
+	c.expect("incr n 5\r\n", "15\r\n")
+	c.expect("decr n 3\r\n", "12\r\n")
+	c.expect("decr n 100\r\n", "0\r\n")
+	c.expect("incr n 18446744073709551615\r\n", "18446744073709551615\r\n")
+	c.expect("incr n 2\r\n", "1\r\n")
+	if x, _ := tc.Get("n"); x != uint64(1) {
+		t.Errorf("Expected n to be uint64(1), got %T %v", x, x)
+	}
+	// Counters can be changed both directly and through the protocol.
+	if n, err := tc.IncrementUint64("n", 2); err != nil || n != 3 {
+		t.Error("IncrementUint64 of a counter set through the protocol returned", n, err)
+	}
+	c.expect("incr n 1\r\n", "4\r\n")
+	tc.Set("u", uint64(7), cache.DefaultExpiration)
+	c.expect("incr u 1\r\n", "8\r\n")
+	c.expect("set s 0 0 1\r\na\r\n", "STORED\r\n")
+	c.expect("incr s 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	c.expect("incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n")
+}
+
+func TestExptime(t *testing.T) {
+	c, tc := newTestServer(t)
+	c.expect("set a 0 1 1\r\na\r\n", "STORED\r\n")
+	if _, exp, _ := tc.GetWithExpiration("a"); time.Until(exp) > time.Second || time.Until(exp) <= 0 {
+		t.Error("Relative exptime was not applied:", exp)
+	}
+	abs := time.Now().Add(time.Hour).Unix()
+	c.expect(fmt.Sprintf("set b 0 %d 1\r\nb\r\n", abs), "STORED\r\n")
+	if _, exp, _ := tc.GetWithExpiration("b"); exp.Unix() < abs-1 || exp.Unix() > abs+1 {
+		t.Error("Absolute exptime was not applied:", exp)
+	}
+	c.expect("set c 0 -1 1\r\nc\r\n", "STORED\r\n")
+	c.expect("get c\r\n", "END\r\n")
+	c.expect("set d 0 0 1\r\nd\r\n", "STORED\r\n")
+	if _, exp, found := tc.GetWithExpiration("d"); !found || !exp.IsZero() {
+		t.Error("exptime 0 did not use the default expiration:", exp, found)
+	}
+
+	c.expect("touch d 100\r\n", "TOUCHED\r\n")
+	if _, exp, _ := tc.GetWithExpiration("d"); exp.IsZero() {
+		t.Error("touch did not set an expiration")
+	}
+	c.expect("touch missing 100\r\n", "NOT_FOUND\r\n")
+	c.expect("touch d -1\r\n", "TOUCHED\r\n")
+	c.expect("get d\r\n", "END\r\n")
+}
+
+func TestFlushAllAndStats(t *testing.T) {
+	c, tc := newTestServer(t)
+	c.expect("set a 0 0 1\r\na\r\n", "STORED\r\n")
+	c.expect("set b 0 0 1\r\nb\r\n", "STORED\r\n")
+	res := c.do("stats\r\n", 5)
+	if !strings.Contains(res, "STAT curr_items 2\r\n") || !strings.HasSuffix(res, "END\r\n") {
+		t.Errorf("Unexpected stats response %q", res)
+	}
+	c.expect("flush_all\r\n", "OK\r\n")
+	if n := tc.ItemCount(); n != 0 {
+		t.Errorf("Expected 0 items after flush_all, got %d", n)
+	}
+	c.expect("set a 0 0 1\r\na\r\n", "STORED\r\n")
+	c.expect("flush_all 1\r\n", "OK\r\n")
+	c.s.Close()
+	time.Sleep(1500 * time.Millisecond)
+	if n := tc.ItemCount(); n != 1 {
+		t.Error("A delayed flush_all ran after Close")
+	}
+}
+
+func TestVersionAndQuit(t *testing.T) {
+	c, _ := newTestServer(t)
+	c.expect("version\r\n", "VERSION "+version+"\r\n")
+	c.expect("bogus\r\n", "ERROR\r\n")
+	io.WriteString(c.conn, "quit\r\n")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Error("Connection was not closed after quit:", err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := NewServer(cache.New(cache.DefaultExpiration, 0))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "version\r\n")
+	bufio.NewReader(conn).ReadString('\n')
+	s.Close()
+	select {
+	case err := <-done:
+		if err != errClosed {
+			t.Error("Serve returned", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection was not closed by Close")
+	}
+}
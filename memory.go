@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// Caches with more items than this estimate their memory usage from a
+	// sample of about this many of them.
+	memorySampleSize = 1000
+	// Bytes used by each item besides its key's and value's contents: the
+	// key's string header and the Item. The map's own overhead isn't
+	// counted.
+	itemOverhead = int64(unsafe.Sizeof("") + unsafe.Sizeof(Item{}))
+	// Rough size of a map's header, and of each entry besides its key and
+	// value.
+	mapOverhead      = 48
+	mapEntryOverhead = 2
+)
+
+// The functions registered with RegisterSizer. The map is replaced rather than
+// modified, so that sizeOf can use it without holding the lock while it calls
+// them, which may call RegisterSizer.
+var sizers struct {
+	sync.Mutex
+	m atomic.Pointer[map[reflect.Type]func(interface{}) int64]
+}
+
+// Registers f to return the number of bytes used by values of type T,
+// including the value itself (unsafe.Sizeof) and anything it refers to, for
+// ApproxMemoryUsage. This is useful for types that the default, which walks
+// values with reflection, gets wrong or is slow for, like ones holding
+// handles to memory that isn't managed by Go, or large pointer-free trees.
+// It replaces any function already registered for T. Set f to nil to
+// unregister it.
+func RegisterSizer[T any](f func(T) int64) {
+	t := reflect.TypeFor[T]()
+	sizers.Lock()
+	m := map[reflect.Type]func(interface{}) int64{}
+	if old := sizers.m.Load(); old != nil {
+		for k, v := range *old {
+			m[k] = v
+		}
+	}
+	if f == nil {
+		delete(m, t)
+	} else {
+		m[t] = func(x interface{}) int64 { return f(x.(T)) }
+	}
+	sizers.m.Store(&m)
+	sizers.Unlock()
+}
+
+// Returns the approximate number of bytes used by the value x, including
+// anything it refers to, using the functions registered with RegisterSizer
+// for its type and the types it refers to. Memory that's referred to more
+// than once is only counted once.
+func sizeOf(x interface{}) int64 {
+	if x == nil {
+		return 0
+	}
+	s := sizer{seen: map[sizerRef]bool{}}
+	if m := sizers.m.Load(); m != nil {
+		s.funcs = *m
+	}
+	v := reflect.ValueOf(x)
+	n := s.indirect(v)
+	if !pointerShaped(v.Kind()) {
+		// A value that isn't a pointer is copied to the heap when it's
+		// stored in an interface.
+		n += int64(v.Type().Size())
+	}
+	return n
+}
+
+type sizerRef struct {
+	p uintptr
+	t reflect.Type
+}
+
+type sizer struct {
+	funcs map[reflect.Type]func(interface{}) int64
+	seen  map[sizerRef]bool
+}
+
+// visit reports whether the memory at p, of type t, hasn't been seen yet, and
+// marks it as seen.
+func (s *sizer) visit(p uintptr, t reflect.Type) bool {
+	r := sizerRef{p, t}
+	if s.seen[r] {
+		return false
+	}
+	s.seen[r] = true
+	return true
+}
+
+// indirect returns the number of bytes used by what v refers to, but not by v
+// itself.
+func (s *sizer) indirect(v reflect.Value) int64 {
+	t := v.Type()
+	if f, found := s.funcs[t]; found && v.CanInterface() {
+		if n := f(v.Interface()) - int64(t.Size()); n > 0 {
+			return n
+		}
+		return 0
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Pointer:
+		if v.IsNil() || !s.visit(v.Pointer(), t) {
+			return 0
+		}
+		e := v.Elem()
+		return int64(e.Type().Size()) + s.indirect(e)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		e := v.Elem()
+		n := s.indirect(e)
+		if !pointerShaped(e.Kind()) {
+			n += int64(e.Type().Size())
+		}
+		return n
+	case reflect.Slice:
+		if v.IsNil() || !s.visit(v.Pointer(), t) {
+			return 0
+		}
+		n := int64(v.Cap()) * int64(t.Elem().Size())
+		if s.hasIndirect(t.Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				n += s.indirect(v.Index(i))
+			}
+		}
+		return n
+	case reflect.Array:
+		var n int64
+		if s.hasIndirect(t.Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				n += s.indirect(v.Index(i))
+			}
+		}
+		return n
+	case reflect.Struct:
+		var n int64
+		for i := 0; i < v.NumField(); i++ {
+			if s.hasIndirect(t.Field(i).Type) {
+				n += s.indirect(v.Field(i))
+			}
+		}
+		return n
+	case reflect.Map:
+		if v.IsNil() || !s.visit(v.Pointer(), t) {
+			return 0
+		}
+		n := int64(mapOverhead) + int64(v.Len())*(int64(t.Key().Size()+t.Elem().Size())+mapEntryOverhead)
+		if s.hasIndirect(t.Key()) || s.hasIndirect(t.Elem()) {
+			it := v.MapRange()
+			for it.Next() {
+				n += s.indirect(it.Key()) + s.indirect(it.Value())
+			}
+		}
+		return n
+	case reflect.Chan:
+		if v.IsNil() || !s.visit(v.Pointer(), t) {
+			return 0
+		}
+		return int64(v.Cap()) * int64(t.Elem().Size())
+	}
+	// Numbers, bools, functions and unsafe pointers.
+	return 0
+}
+
+// pointerShaped reports whether values of kind k are stored in an interface
+// directly, rather than being copied to the heap.
+func pointerShaped(k reflect.Kind) bool {
+	switch k {
+	case reflect.Pointer, reflect.Map, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return true
+	}
+	return false
+}
+
+// hasIndirect reports whether values of type t may refer to other memory, or
+// have a registered size function.
+func (s *sizer) hasIndirect(t reflect.Type) bool {
+	if _, found := s.funcs[t]; found {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return false
+	case reflect.Array:
+		return t.Len() > 0 && s.hasIndirect(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if s.hasIndirect(t.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Returns an estimate of the number of bytes used by the cache's items: their
+// keys, values, and whatever the values refer to, found by walking them with
+// reflection, or with the functions registered with RegisterSizer. If the
+// cache has more than about a thousand items, only a sample of them is
+// walked, and the estimate is scaled up from it. The cache's own bookkeeping,
+// like its maps and the indexes kept for tags, isn't counted, and memory
+// shared by several values is counted once for each.
+func (c *cache) ApproxMemoryUsage() int64 {
+	return sizeSample(c.memorySample())
+}
+
+// memorySample returns a sample of the cache's items for ApproxMemoryUsage, and
+// how many items the cache has.
+func (c *cache) memorySample() ([]keyAndValue, int) {
+	c.mu.RLock()
+	n := len(c.items)
+	stride := 1
+	if n > memorySampleSize {
+		stride = n / memorySampleSize
+	}
+	sample := make([]keyAndValue, 0, n/stride+1)
+	i := 0
+	// Map iteration starts at a random point, so every stride-th item
+	// is a fair sample.
+	for k, v := range c.items {
+		if i%stride == 0 {
+			sample = append(sample, keyAndValue{k, v.Object})
+		}
+		i++
+	}
+	c.mu.RUnlock()
+	return sample, n
+}
+
+// sizeSample returns the approximate number of bytes used by n items, given a
+// sample of them.
+func sizeSample(sample []keyAndValue, n int) int64 {
+	if len(sample) == 0 {
+		return 0
+	}
+	var total int64
+	for _, v := range sample {
+		total += itemOverhead + int64(len(v.key)) + sizeOf(v.value)
+	}
+	return total * int64(n) / int64(len(sample))
+}
+
+// Returns an estimate of the number of bytes used by the items in all
+// shards. See cache.ApproxMemoryUsage.
+func (sc *shardedCache) ApproxMemoryUsage() int64 {
+	var total int64
+	for _, n := range sc.ApproxMemoryUsageByShard() {
+		total += n
+	}
+	return total
+}
+
+// Returns an estimate of the number of bytes used by the items in each shard.
+// A shard using much more than the others holds larger values, or more
+// items, which may mean that the keys are spread unevenly.
+func (sc *shardedCache) ApproxMemoryUsageByShard() []int64 {
+	type shardSample struct {
+		sample []keyAndValue
+		n      int
+	}
+	// Only take the samples while the shards are held, so that walking
+	// them doesn't hold up a split.
+	var samples []shardSample
+	sc.each(func(c *cache) {
+		sample, n := c.memorySample()
+		samples = append(samples, shardSample{sample, n})
+	})
+	res := make([]int64, len(samples))
+	for i, v := range samples {
+		res[i] = sizeSample(v.sample, v.n)
+	}
+	return res
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type sizedNode struct {
+	name string
+	next *sizedNode
+	data []byte
+}
+
+func TestSizeOf(t *testing.T) {
+	n := &sizedNode{name: "abc", data: make([]byte, 10, 100)}
+	n.next = n
+	cyclic := map[string]interface{}{"n": n}
+	cyclic["self"] = cyclic
+	for _, v := range []struct {
+		x        interface{}
+		min, max int64
+	}{
+		{nil, 0, 0},
+		{1, 8, 8},
+		{strings.Repeat("x", 1000), 1016, 1016},
+		{make([]int64, 10, 20), 160 + 24, 160 + 24},
+		{[]string{"ab", "cd"}, 2*16 + 4 + 24, 2*16 + 4 + 24},
+		{n, 100 + 3 + 48, 100 + 3 + 48},
+		{cyclic, 100 + 3 + 48 + 2*(16+1+16), 1000},
+	} {
+		if n := sizeOf(v.x); n < v.min || n > v.max {
+			t.Errorf("sizeOf(%T) = %d, expected between %d and %d", v.x, n, v.min, v.max)
+		}
+	}
+}
+
+type externalBuffer struct {
+	handle uintptr
+	size   int
+}
+
+func TestRegisterSizer(t *testing.T) {
+	defer RegisterSizer[externalBuffer](nil)
+	b := externalBuffer{handle: 1, size: 1 << 20}
+	if n := sizeOf(b); n != 16 {
+		t.Error("Expected 16 bytes before registering a sizer, got", n)
+	}
+	RegisterSizer(func(b externalBuffer) int64 {
+		return 16 + int64(b.size)
+	})
+	if n := sizeOf(b); n != 16+1<<20 {
+		t.Error("The registered sizer wasn't used for a value:", n)
+	}
+	if n := sizeOf([]externalBuffer{b, b}); n != 24+2*(16+1<<20) {
+		t.Error("The registered sizer wasn't used for slice elements:", n)
+	}
+	RegisterSizer[externalBuffer](nil)
+	if n := sizeOf(b); n != 16 {
+		t.Error("Expected 16 bytes after unregistering the sizer, got", n)
+	}
+}
+
+type lazilySized struct{}
+
+func TestRegisterSizerFromSizer(t *testing.T) {
+	defer RegisterSizer[lazilySized](nil)
+	defer RegisterSizer[externalBuffer](nil)
+	RegisterSizer(func(lazilySized) int64 {
+		// E.g. registering a sizer for a type on first use.
+		RegisterSizer(func(b externalBuffer) int64 {
+			return 16 + int64(b.size)
+		})
+		return 1
+	})
+	if n := sizeOf(lazilySized{}); n != 1 {
+		t.Error("Expected 1 byte, got", n)
+	}
+	if n := sizeOf(externalBuffer{size: 100}); n != 116 {
+		t.Error("The sizer registered by another wasn't used:", n)
+	}
+}
+
+func TestApproxMemoryUsage(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if n := tc.ApproxMemoryUsage(); n != 0 {
+		t.Error("Expected an empty cache to use 0 bytes, got", n)
+	}
+	tc.Set("a", strings.Repeat("x", 1000), DefaultExpiration)
+	if n := tc.ApproxMemoryUsage(); n != itemOverhead+1+1016 {
+		t.Errorf("Expected %d bytes, got %d", itemOverhead+1+1016, n)
+	}
+
+	// Big enough to be sampled.
+	const items = 100000
+	per := itemOverhead + 6 + 16 + 1000
+	for i := 0; i < items; i++ {
+		tc.Set("k"+strconv.Itoa(100000+i), strings.Repeat("x", 1000), DefaultExpiration)
+	}
+	want := per * items
+	if n := tc.ApproxMemoryUsage(); n < want*9/10 || n > want*11/10 {
+		t.Errorf("Expected about %d bytes, got %d", want, n)
+	}
+}
+
+func TestShardedApproxMemoryUsage(t *testing.T) {
+	tc := unexportedNewSharded(DefaultExpiration, 0, 4)
+	for i := 0; i < 1000; i++ {
+		tc.Set(strconv.Itoa(i), make([]byte, 100), DefaultExpiration)
+	}
+	shards := tc.ApproxMemoryUsageByShard()
+	if len(shards) != 4 {
+		t.Fatal("Expected 4 shards, got", shards)
+	}
+	var total int64
+	for _, n := range shards {
+		if n == 0 {
+			t.Error("Expected every shard to use memory:", shards)
+		}
+		total += n
+	}
+	if n := tc.ApproxMemoryUsage(); n != total {
+		t.Errorf("Expected the total, %d, to be the sum of the shards', got %d", total, n)
+	}
+	if total < 1000*124 {
+		t.Error("Expected at least 124 bytes per item, got", total)
+	}
+}
+
+func BenchmarkApproxMemoryUsage(b *testing.B) {
+	tc := New(DefaultExpiration, 0)
+	for i := 0; i < 100000; i++ {
+		tc.Set(strconv.Itoa(i), &sizedNode{name: "node", data: make([]byte, 64)}, DefaultExpiration)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tc.ApproxMemoryUsage()
+	}
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Returns the namespace of c with the given name, creating it if it doesn't
+// exist yet. A namespace is a cache of its own, with its own keys, default
+// expiration and eviction function, so that e.g. Flush on a namespace only
+// empties that namespace. It has no janitor of its own, though: its expired
+// items are deleted along with c's, by c's janitor or by c.DeleteExpired(). It
+// also shares c's item limit (see SetMaxItems.)
+//
+// If defaultExpiration is DefaultExpiration, c's default expiration is used.
+// It is ignored if the namespace already exists.
+func (c *Cache) Namespace(name string, defaultExpiration time.Duration) *Cache {
+	c.mu.Lock()
+	nc, found := c.namespaces[name]
+	if !found {
+		if c.budget == nil {
+			c.startBudget()
+		}
+		if defaultExpiration == DefaultExpiration {
+			defaultExpiration = c.defaultExpiration
+		}
+		nc = newCache(defaultExpiration, map[string]Item{})
+		nc.budget = c.budget
+		if c.namespaces == nil {
+			c.namespaces = map[string]*cache{}
+		}
+		c.namespaces[name] = nc
+	}
+	c.mu.Unlock()
+	// c doesn't point back to the wrapper, so that the wrapper (and c) can
+	// still be garbage collected once neither is in use.
+	return &Cache{cache: nc, parent: c}
+}
+
+// Get the namespace of c with the given name, without creating it. Returns
+// false if it doesn't exist.
+func (c *Cache) GetNamespace(name string) (*Cache, bool) {
+	c.mu.RLock()
+	nc, found := c.namespaces[name]
+	c.mu.RUnlock()
+	if !found {
+		return nil, false
+	}
+	return &Cache{cache: nc, parent: c}, true
+}
+
+// Delete the namespace of c with the given name, along with its items and its
+// own namespaces, if it exists. Namespaces already returned for it keep
+// working, but as caches of their own, with no janitor or item limit; calling
+// Namespace with the name again creates a new, empty namespace.
+func (c *cache) DropNamespace(name string) {
+	c.mu.Lock()
+	nc, found := c.namespaces[name]
+	delete(c.namespaces, name)
+	c.mu.Unlock()
+	if found {
+		nc.detach()
+	}
+}
+
+// detach takes c and its namespaces off their item budget, and empties them.
+func (c *cache) detach() {
+	for _, nc := range c.namespaceList() {
+		nc.detach()
+	}
+	c.mu.Lock()
+	if c.budget != nil {
+		c.budget.count.Add(-int64(len(c.items)))
+		c.budget = nil
+	}
+	c.mu.Unlock()
+	c.Flush()
+}
+
+// Returns the names of the cache's namespaces, in sorted order.
+func (c *cache) Namespaces() []string {
+	c.mu.RLock()
+	names := make([]string, 0, len(c.namespaces))
+	for name := range c.namespaces {
+		names = append(names, name)
+	}
+	c.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+func (c *cache) namespaceList() []*cache {
+	c.mu.RLock()
+	if len(c.namespaces) == 0 {
+		c.mu.RUnlock()
+		return nil
+	}
+	list := make([]*cache, 0, len(c.namespaces))
+	for _, nc := range c.namespaces {
+		list = append(list, nc)
+	}
+	c.mu.RUnlock()
+	return list
+}
+
+// Limit the number of items in the cache and all of its namespaces together to
+// n, or remove the limit if n is less than one (the default.) Whenever there are
+// more items than that, arbitrary items are evicted from whichever of the cache
+// and its namespaces has the most items, so that one that fills up quickly
+// can't push the items of the others out, unless an admission filter is on
+// (see SetAdmission). The eviction function, if any, is called for each item
+// evicted.
+//
+// Called on a namespace, this sets the limit it shares with its parent.
+func (c *cache) SetMaxItems(n int) {
+	c.mu.Lock()
+	if c.budget == nil {
+		c.startBudget()
+	}
+	b := c.budget
+	c.mu.Unlock()
+	b.maxItems.Store(int64(n))
+	if b.filter.Load() != nil {
+		b.filter.Store(newTinyLFU(n))
+	}
+	b.enforce()
+}
+
+// startBudget sets up an item budget for c, which must be locked.
+func (c *cache) startBudget() {
+	c.budget = &budget{root: c}
+	c.budget.count.Store(int64(len(c.items)))
+}
+
+// countNew counts k against the cache's budget if it isn't in the cache yet.
+// The cache must be locked.
+func (c *cache) countNew(k string) {
+	if _, found := c.items[k]; !found {
+		c.budget.count.Add(1)
+	}
+}
+
+// A budget tracks the number of items in a cache and its namespaces, and
+// evicts items when there are too many.
+type budget struct {
+	root     *cache
+	maxItems atomic.Int64
+	count    atomic.Int64
+	// Admission filter, set by SetAdmission.
+	filter atomic.Pointer[tinyLFU]
+}
+
+// enforce evicts items until there are no more than maxItems.
+func (b *budget) enforce() {
+	for {
+		max := b.maxItems.Load()
+		if max < 1 || b.count.Load() <= max {
+			return
+		}
+		victim, _ := b.root.largest()
+		if !victim.evictOne() {
+			return
+		}
+	}
+}
+
+// largest returns whichever of c and its namespaces (and theirs) has the most
+// items, and how many that is.
+func (c *cache) largest() (*cache, int) {
+	best, most := c, c.ItemCount()
+	for _, nc := range c.namespaceList() {
+		if v, n := nc.largest(); n > most {
+			best, most = v, n
+		}
+	}
+	return best, most
+}
+
+// evictOne deletes an arbitrary item from the cache. Returns false if the cache
+// is empty.
+func (c *cache) evictOne() bool {
+	c.mu.Lock()
+	for k := range c.items {
+		v, evicted := c.delete(k)
+		c.mu.Unlock()
+		if evicted {
+			c.onEvicted(k, v)
+		}
+		return true
+	}
+	c.mu.Unlock()
+	return false
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNamespace(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	users := tc.Namespace("users", DefaultExpiration)
+	slots := tc.Namespace("slots", 1*time.Millisecond)
+
+	tc.Set("foo", "root", DefaultExpiration)
+	users.Set("foo", "user", DefaultExpiration)
+	slots.Set("foo", "slot", DefaultExpiration)
+	for _, v := range []struct {
+		c    *Cache
+		want string
+	}{{tc, "root"}, {users, "user"}, {slots, "slot"}} {
+		if x, found := v.c.Get("foo"); !found || x != v.want {
+			t.Errorf("Expected %s, got %v", v.want, x)
+		}
+	}
+	if x, _ := tc.Namespace("users", DefaultExpiration).Get("foo"); x != "user" {
+		t.Error("Namespace didn't return the existing namespace")
+	}
+	if names := tc.Namespaces(); len(names) != 2 || names[0] != "slots" || names[1] != "users" {
+		t.Error("Namespaces returned", names)
+	}
+
+	users.Flush()
+	if _, found := users.Get("foo"); found {
+		t.Error("Flush didn't empty the namespace")
+	}
+	if _, found := tc.Get("foo"); !found {
+		t.Error("Flushing a namespace emptied its parent")
+	}
+
+	// The namespace's own default expiration applies, and the parent
+	// cleans it up.
+	<-time.After(5 * time.Millisecond)
+	if _, found := slots.Get("foo"); found {
+		t.Error("Found an item that should have expired")
+	}
+	tc.DeleteExpired()
+	if n := slots.ItemCount(); n != 0 {
+		t.Errorf("DeleteExpired on the parent left %d items in the namespace", n)
+	}
+}
+
+func TestDropNamespace(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetMaxItems(10)
+	ns := tc.Namespace("ns", DefaultExpiration)
+	for i := 0; i < 5; i++ {
+		ns.Set("foo"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	ns.Namespace("inner", DefaultExpiration).Set("foo", "bar", DefaultExpiration)
+	if _, found := tc.GetNamespace("ns"); !found {
+		t.Fatal("GetNamespace didn't find the namespace")
+	}
+
+	tc.DropNamespace("ns")
+	if _, found := tc.GetNamespace("ns"); found {
+		t.Error("GetNamespace found a dropped namespace")
+	}
+	if names := tc.Namespaces(); len(names) != 0 {
+		t.Error("Namespaces returned", names)
+	}
+	if n := ns.ItemCount(); n != 0 {
+		t.Errorf("Dropped namespace still has %d items", n)
+	}
+	// The dropped items no longer count against the limit.
+	for i := 0; i < 10; i++ {
+		tc.Set("foo"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if n := tc.ItemCount(); n != 10 {
+		t.Errorf("Expected 10 items, got %d", n)
+	}
+	// And the old handle no longer does.
+	ns.Set("foo", "bar", DefaultExpiration)
+	if n := tc.ItemCount(); n != 10 {
+		t.Errorf("Expected 10 items, got %d", n)
+	}
+	if x := tc.Namespace("ns", DefaultExpiration).ItemCount(); x != 0 {
+		t.Errorf("Recreated namespace has %d items", x)
+	}
+}
+
+func TestNamespaceJanitor(t *testing.T) {
+	tc := New(DefaultExpiration, 1*time.Millisecond)
+	ns := tc.Namespace("ns", DefaultExpiration)
+	ns.Set("foo", "bar", 1*time.Millisecond)
+	<-time.After(25 * time.Millisecond)
+	if n := ns.ItemCount(); n != 0 {
+		t.Errorf("The parent's janitor left %d items in the namespace", n)
+	}
+}
+
+func TestSetMaxItems(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	evicted := 0
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted++
+	})
+	for i := 0; i < 100; i++ {
+		tc.Set("foo"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	tc.SetMaxItems(50)
+	if n := tc.ItemCount(); n != 50 {
+		t.Errorf("Expected 50 items, got %d", n)
+	}
+	for i := 0; i < 100; i++ {
+		tc.Add("bar"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if n := tc.ItemCount(); n != 50 {
+		t.Errorf("Expected 50 items, got %d", n)
+	}
+	if evicted != 150 {
+		t.Errorf("Expected 150 evictions, got %d", evicted)
+	}
+	tc.Flush()
+	tc.Set("foo", "bar", DefaultExpiration)
+	if tc.budget.count.Load() != 1 {
+		t.Errorf("Expected a count of 1 after Flush, got %d", tc.budget.count.Load())
+	}
+}
+
+func TestNamespaceBudgetFairness(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetMaxItems(100)
+	big := tc.Namespace("big", DefaultExpiration)
+	small := tc.Namespace("small", DefaultExpiration)
+	for i := 0; i < 20; i++ {
+		small.Set("foo"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	for i := 0; i < 1000; i++ {
+		big.Set("foo"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if n := small.ItemCount(); n != 20 {
+		t.Errorf("The small namespace lost items to the big one, it has %d", n)
+	}
+	if n := big.ItemCount(); n != 80 {
+		t.Errorf("Expected 80 items in the big namespace, got %d", n)
+	}
+	// Once both are full, they are evicted from evenly.
+	for i := 20; i < 1000; i++ {
+		small.Set("foo"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if s, b := small.ItemCount(), big.ItemCount(); s+b != 100 || s < 49 || s > 51 {
+		t.Errorf("Expected the namespaces to share the budget evenly, they have %d and %d items", s, b)
+	}
+}
+
+func BenchmarkCacheSetWithMaxItems(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	tc.SetMaxItems(1000)
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "foo" + strconv.Itoa(i)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Set(keys[i%len(keys)], "bar", DefaultExpiration)
+	}
+}
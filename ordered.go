@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"math/bits"
+	"time"
+)
+
+// An OrderedCache is a Cache that also keeps its keys in sorted order, so that
+// they can be iterated over in order and queried by range, e.g. to read all
+// time-bucketed keys like "bucket:20261016T1200" between two times. Expiration
+// and eviction work exactly as they do for a Cache.
+//
+// Its Range method takes bounds and visits keys in order; the unordered Range
+// of the embedded Cache is still available as c.Cache.Range.
+//
+// Keeping the index costs an O(log n) insertion on every Set of a new key and
+// an O(log n) removal on every Delete.
+type OrderedCache struct {
+	*Cache
+}
+
+// Return a new ordered cache with a given default expiration duration and
+// cleanup interval. See New() for what they mean.
+func NewOrdered(defaultExpiration, cleanupInterval time.Duration) *OrderedCache {
+	c := newCache(defaultExpiration, map[string]Item{})
+	c.ordered = newSkiplist()
+	return &OrderedCache{withJanitor(c, cleanupInterval)}
+}
+
+// How many items the iterators copy out at a time. The cache is unlocked while
+// the function passed to them runs, so it may use the cache freely.
+const orderedBatchSize = 64
+
+// Call f with the key and value of every unexpired item whose key is at least
+// from and less than to, in ascending order, until f returns false. If to is
+// "", there is no upper bound.
+//
+// The items are read a few at a time, and the cache isn't locked while f runs,
+// so items added or removed during the iteration may or may not be seen.
+func (c *OrderedCache) Range(from, to string, f func(k string, x interface{}) bool) {
+	inclusive := true
+	for {
+		batch := make([]keyAndValue, 0, orderedBatchSize)
+		now := time.Now().UnixNano()
+		c.mu.RLock()
+		n := c.ordered.seek(from)
+		if !inclusive && n != nil && n.key == from {
+			n = n.next[0]
+		}
+		for ; n != nil && len(batch) < orderedBatchSize; n = n.next[0] {
+			if to != "" && n.key >= to {
+				break
+			}
+			// "Inlining" of Expired
+			v := c.items[n.key]
+			if v.Expiration > 0 && now > v.Expiration {
+				continue
+			}
+			batch = append(batch, keyAndValue{n.key, v.Object})
+		}
+		done := n == nil || to != "" && n.key >= to
+		c.mu.RUnlock()
+		for _, v := range batch {
+			if !f(v.key, v.value) {
+				return
+			}
+		}
+		if done {
+			return
+		}
+		from, inclusive = batch[len(batch)-1].key, false
+	}
+}
+
+// Call f with the key and value of every unexpired item in ascending order of
+// their keys, until f returns false. See Range.
+func (c *OrderedCache) Ascend(f func(k string, x interface{}) bool) {
+	c.Range("", "", f)
+}
+
+// Call f with the key and value of every unexpired item in descending order of
+// their keys, until f returns false. See Range.
+func (c *OrderedCache) Descend(f func(k string, x interface{}) bool) {
+	var before string
+	started := false
+	for {
+		batch := make([]keyAndValue, 0, orderedBatchSize)
+		now := time.Now().UnixNano()
+		c.mu.RLock()
+		n := c.ordered.tail
+		if started {
+			n = c.ordered.before(before)
+		}
+		for ; n != nil && len(batch) < orderedBatchSize; n = n.prev {
+			v := c.items[n.key]
+			if v.Expiration > 0 && now > v.Expiration {
+				continue
+			}
+			batch = append(batch, keyAndValue{n.key, v.Object})
+		}
+		c.mu.RUnlock()
+		for _, v := range batch {
+			if !f(v.key, v.value) {
+				return
+			}
+		}
+		if n == nil {
+			return
+		}
+		before, started = batch[len(batch)-1].key, true
+	}
+}
+
+// Returns the unexpired item with the smallest key, and a bool indicating
+// whether there was one.
+func (c *OrderedCache) First() (string, interface{}, bool) {
+	now := time.Now().UnixNano()
+	c.mu.RLock()
+	for n := c.ordered.head.next[0]; n != nil; n = n.next[0] {
+		v := c.items[n.key]
+		if v.Expiration > 0 && now > v.Expiration {
+			continue
+		}
+		c.mu.RUnlock()
+		return n.key, v.Object, true
+	}
+	c.mu.RUnlock()
+	return "", nil, false
+}
+
+// Returns the unexpired item with the largest key, and a bool indicating
+// whether there was one.
+func (c *OrderedCache) Last() (string, interface{}, bool) {
+	now := time.Now().UnixNano()
+	c.mu.RLock()
+	for n := c.ordered.tail; n != nil; n = n.prev {
+		v := c.items[n.key]
+		if v.Expiration > 0 && now > v.Expiration {
+			continue
+		}
+		c.mu.RUnlock()
+		return n.key, v.Object, true
+	}
+	c.mu.RUnlock()
+	return "", nil, false
+}
+
+const skiplistMaxLevel = 32
+
+// A skiplist is a sorted set of keys. Every node is linked into the bottom
+// level, and into each level above with probability 1/2, so that a search can
+// skip ahead along the upper levels in O(log n) steps. The bottom level is
+// doubly linked to allow iterating backwards.
+type skiplist struct {
+	head  skipNode
+	tail  *skipNode
+	level int
+	rand  uint64
+}
+
+type skipNode struct {
+	key  string
+	prev *skipNode // nil for the first node
+	next []*skipNode
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  skipNode{next: make([]*skipNode, skiplistMaxLevel)},
+		level: 1,
+		rand:  uint64(time.Now().UnixNano()) | 1,
+	}
+}
+
+// randomLevel returns a level between 1 and skiplistMaxLevel, each one half
+// as likely as the one below it.
+func (l *skiplist) randomLevel() int {
+	// xorshift64
+	l.rand ^= l.rand << 13
+	l.rand ^= l.rand >> 7
+	l.rand ^= l.rand << 17
+	level := bits.TrailingZeros64(l.rand) + 1
+	if level > skiplistMaxLevel {
+		level = skiplistMaxLevel
+	}
+	return level
+}
+
+// preds fills update with the last node before k on each level.
+func (l *skiplist) preds(k string, update *[skiplistMaxLevel]*skipNode) {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < k {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+}
+
+// insert adds k to the list if it isn't in it already.
+func (l *skiplist) insert(k string) {
+	var update [skiplistMaxLevel]*skipNode
+	l.preds(k, &update)
+	if n := update[0].next[0]; n != nil && n.key == k {
+		return
+	}
+	level := l.randomLevel()
+	for i := l.level; i < level; i++ {
+		update[i] = &l.head
+	}
+	if level > l.level {
+		l.level = level
+	}
+	n := &skipNode{key: k, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	if update[0] != &l.head {
+		n.prev = update[0]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n
+	} else {
+		l.tail = n
+	}
+}
+
+// remove deletes k from the list if it is in it.
+func (l *skiplist) remove(k string) {
+	var update [skiplistMaxLevel]*skipNode
+	l.preds(k, &update)
+	n := update[0].next[0]
+	if n == nil || n.key != k {
+		return
+	}
+	for i := 0; i < len(n.next); i++ {
+		update[i].next[i] = n.next[i]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n.prev
+	} else {
+		l.tail = n.prev
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+}
+
+// seek returns the first node with a key of at least k, or nil.
+func (l *skiplist) seek(k string) *skipNode {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < k {
+			x = x.next[i]
+		}
+	}
+	return x.next[0]
+}
+
+// before returns the last node with a key less than k, or nil.
+func (l *skiplist) before(k string) *skipNode {
+	if n := l.seek(k); n != nil {
+		return n.prev
+	}
+	return l.tail
+}
@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOrderedRange(t *testing.T) {
+	tc := NewOrdered(DefaultExpiration, 0)
+	for h := 23; h >= 0; h-- {
+		tc.Set(fmt.Sprintf("bucket:20261016T%02d00", h), h, DefaultExpiration)
+	}
+	tc.Set("other", 0, DefaultExpiration)
+
+	var got []int
+	tc.Range("bucket:20261016T1200", "bucket:20261016T1500", func(k string, x interface{}) bool {
+		got = append(got, x.(int))
+		return true
+	})
+	if fmt.Sprint(got) != "[12 13 14]" {
+		t.Error("Range returned", got)
+	}
+
+	got = nil
+	tc.Range("bucket:20261016T2200", "", func(k string, x interface{}) bool {
+		got = append(got, x.(int))
+		return true
+	})
+	if fmt.Sprint(got) != "[22 23 0]" {
+		t.Error("Unbounded Range returned", got)
+	}
+
+	got = nil
+	tc.Range("bucket:", "bucket;", func(k string, x interface{}) bool {
+		got = append(got, x.(int))
+		return len(got) < 3
+	})
+	if fmt.Sprint(got) != "[0 1 2]" {
+		t.Error("Range didn't stop when asked to:", got)
+	}
+}
+
+func TestOrderedAscendDescend(t *testing.T) {
+	tc := NewOrdered(DefaultExpiration, 0)
+	var want []string
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(rand.Int())
+		tc.Set(k, i, DefaultExpiration)
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	want = dedupe(want)
+
+	var got []string
+	tc.Ascend(func(k string, x interface{}) bool {
+		got = append(got, k)
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Error("Ascend didn't return the keys in order")
+	}
+
+	got = nil
+	tc.Descend(func(k string, x interface{}) bool {
+		got = append(got, k)
+		return true
+	})
+	sort.Sort(sort.Reverse(sort.StringSlice(want)))
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Error("Descend didn't return the keys in order")
+	}
+}
+
+func dedupe(s []string) []string {
+	out := s[:0]
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func TestOrderedExpiration(t *testing.T) {
+	tc := NewOrdered(DefaultExpiration, 0)
+	if _, _, found := tc.First(); found {
+		t.Error("First found an item in an empty cache")
+	}
+	tc.Set("a", 1, 1*time.Millisecond)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Set("c", 3, DefaultExpiration)
+	tc.Set("d", 4, 1*time.Millisecond)
+	<-time.After(5 * time.Millisecond)
+
+	if k, x, found := tc.First(); !found || k != "b" || x.(int) != 2 {
+		t.Error("First returned", k, x, found)
+	}
+	if k, x, found := tc.Last(); !found || k != "c" || x.(int) != 3 {
+		t.Error("Last returned", k, x, found)
+	}
+	n := 0
+	tc.Ascend(func(k string, x interface{}) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Errorf("Ascend returned %d items instead of 2", n)
+	}
+
+	tc.DeleteExpired()
+	if tc.ordered.seek("a").key != "b" || tc.ordered.tail.key != "c" {
+		t.Error("DeleteExpired didn't remove expired keys from the index")
+	}
+	tc.Delete("b")
+	if k, _, _ := tc.First(); k != "c" {
+		t.Error("First returned a deleted key:", k)
+	}
+	tc.Flush()
+	if _, _, found := tc.Last(); found {
+		t.Error("Last found an item in a flushed cache")
+	}
+}
+
+func TestOrderedModifyWhileIterating(t *testing.T) {
+	tc := NewOrdered(DefaultExpiration, 0)
+	for i := 0; i < 500; i++ {
+		tc.Set(fmt.Sprintf("%04d", i), i, DefaultExpiration)
+	}
+	seen := map[string]int{}
+	tc.Ascend(func(k string, x interface{}) bool {
+		// Deleting the current key and adding others mustn't deadlock
+		// or derail the iteration.
+		tc.Delete(k)
+		if x.(int)%2 == 0 {
+			tc.Set(k+"x", -1, DefaultExpiration)
+		}
+		seen[k]++
+		return true
+	})
+	for i := 0; i < 500; i++ {
+		if k := fmt.Sprintf("%04d", i); seen[k] != 1 {
+			t.Errorf("%s was seen %d times", k, seen[k])
+		}
+	}
+	// Keys added behind the iteration's batch may or may not be seen.
+	if n := tc.ItemCount() + len(seen) - 500; n != 250 {
+		t.Errorf("Expected 250 added keys to be seen or left over, got %d", n)
+	}
+}
+
+func TestSkiplist(t *testing.T) {
+	l := newSkiplist()
+	present := map[string]bool{}
+	for i := 0; i < 10000; i++ {
+		k := strconv.Itoa(rand.Intn(2000))
+		if rand.Intn(3) == 0 {
+			l.remove(k)
+			delete(present, k)
+		} else {
+			l.insert(k)
+			present[k] = true
+		}
+	}
+	var want []string
+	for k := range present {
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	var got, back []string
+	for n := l.head.next[0]; n != nil; n = n.next[0] {
+		got = append(got, n.key)
+	}
+	for n := l.tail; n != nil; n = n.prev {
+		back = append([]string{n.key}, back...)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Error("Skiplist isn't sorted or has the wrong keys")
+	}
+	if fmt.Sprint(back) != fmt.Sprint(want) {
+		t.Error("Skiplist's backward links are broken")
+	}
+	for i := 1; i < l.level; i++ {
+		prev := ""
+		for n := l.head.next[i]; n != nil; n = n.next[i] {
+			if n.key <= prev || !present[n.key] {
+				t.Fatalf("Level %d is broken at %s", i, n.key)
+			}
+			prev = n.key
+		}
+	}
+}
+
+func BenchmarkOrderedCacheSet(b *testing.B) {
+	b.StopTimer()
+	tc := NewOrdered(DefaultExpiration, 0)
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(rand.Int())
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Set(keys[i%len(keys)], "bar", DefaultExpiration)
+	}
+}
+
+func BenchmarkOrderedCacheRange(b *testing.B) {
+	b.StopTimer()
+	tc := NewOrdered(DefaultExpiration, 0)
+	for i := 0; i < 10000; i++ {
+		tc.Set(fmt.Sprintf("%05d", i), "bar", DefaultExpiration)
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Range("05000", "05100", func(k string, x interface{}) bool {
+			return true
+		})
+	}
+}
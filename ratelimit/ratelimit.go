@@ -0,0 +1,298 @@
+// Package ratelimit limits how often something may happen per key, keeping the
+// state of each key in a cache so that idle keys expire on their own.
+//
+// Three algorithms are provided:
+//
+//   - FixedWindow allows a number of events in each window of time, e.g. 100
+//     per minute starting on the minute. It needs one small item per key, but
+//     lets through up to twice the limit around the edge of a window.
+//   - SlidingLog remembers when each event in the last window happened, and
+//     allows a number of events in any window-long span of time. It is exact,
+//     but needs memory proportional to the limit for each key.
+//   - TokenBucket refills a bucket of tokens at a steady rate, up to a burst
+//     size, and takes a token for each event.
+//
+// Checking and updating the state of a key is a single atomic operation, so
+// concurrent callers never let more events through than the limit allows.
+//
+// Limiters store their state under the keys they limit, so it's best to give
+// each limiter a cache, or a namespace (see cache.Cache.Namespace()), of its
+// own. A limiter that finds another kind of value under a key, e.g. one left
+// by a different kind of limiter, starts that key afresh. Items are kept for
+// no longer than they matter, measured with the system clock.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// ErrExceedsLimit is returned by Wait if the limit is too low for the event to
+// ever be allowed.
+var ErrExceedsLimit = errors.New("ratelimit: event exceeds the limit")
+
+// A Limiter decides whether events for a key may happen now.
+type Limiter interface {
+	// Reports whether an event for key may happen now, and if so, counts
+	// it.
+	Allow(key string) bool
+	// Reports whether n events for key may happen now, and if so, counts
+	// them. Either all n are allowed or none are. Zero events are always
+	// allowed, and a negative number never is.
+	AllowN(key string, n int) bool
+	// Wait until an event for key may happen, and count it. Returns the
+	// context's error if it is done first.
+	Wait(ctx context.Context, key string) error
+}
+
+// A Clock tells the time. It can be replaced for testing.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+var (
+	_ Limiter = (*FixedWindow)(nil)
+	_ Limiter = (*SlidingLog)(nil)
+	_ Limiter = (*TokenBucket)(nil)
+)
+
+// Number of locks keys are spread over.
+const stripes = 64
+
+// limiter holds what the limiters have in common.
+type limiter struct {
+	// Clock is what the limiter tells the time with. It defaults to the
+	// system clock, and may be replaced before the limiter is first used.
+	Clock Clock
+
+	c     *cache.Cache
+	seed  maphash.Seed
+	locks [stripes]sync.Mutex
+	// take counts n events for k at now if they are allowed. If not, it
+	// returns how long until they might be, or a negative duration if they
+	// never will be.
+	take func(k string, n int, now time.Time) (bool, time.Duration)
+}
+
+func (l *limiter) init(c *cache.Cache, take func(string, int, time.Time) (bool, time.Duration)) {
+	l.Clock = systemClock{}
+	l.c = c
+	l.seed = maphash.MakeSeed()
+	l.take = take
+}
+
+// Reports whether an event for key may happen now, and if so, counts it.
+func (l *limiter) Allow(key string) bool {
+	return l.AllowN(key, 1)
+}
+
+// Reports whether n events for key may happen now, and if so, counts them.
+// Zero events are always allowed, and a negative number never is.
+func (l *limiter) AllowN(key string, n int) bool {
+	if n < 1 {
+		return n == 0
+	}
+	ok, _ := l.lockedTake(key, n)
+	return ok
+}
+
+// Wait until an event for key may happen, and count it. Returns the context's
+// error if it is done first, or ErrExceedsLimit if the event will never be
+// allowed.
+func (l *limiter) Wait(ctx context.Context, key string) error {
+	for {
+		ok, wait := l.lockedTake(key, 1)
+		if ok {
+			return nil
+		}
+		if wait < 0 {
+			return ErrExceedsLimit
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.Clock.After(wait):
+		}
+	}
+}
+
+func (l *limiter) lockedTake(key string, n int) (bool, time.Duration) {
+	mu := &l.locks[maphash.String(l.seed, key)%stripes]
+	mu.Lock()
+	ok, wait := l.take(key, n, l.Clock.Now())
+	mu.Unlock()
+	return ok, wait
+}
+
+// A FixedWindow allows up to a limit of events per key in each window of time.
+// Windows start at multiples of their length since the zero time, so e.g.
+// one-minute windows start on the minute.
+type FixedWindow struct {
+	limiter
+	limit  int
+	window time.Duration
+}
+
+type fixedWindow struct {
+	start int64
+	count int
+}
+
+// Return a new fixed-window limiter allowing limit events per key in each
+// window, keeping its state in c.
+func NewFixedWindow(c *cache.Cache, limit int, window time.Duration) *FixedWindow {
+	l := &FixedWindow{
+		limit:  limit,
+		window: window,
+	}
+	l.init(c, l.takeN)
+	return l
+}
+
+func (l *FixedWindow) takeN(k string, n int, now time.Time) (bool, time.Duration) {
+	if n > l.limit {
+		return false, -1
+	}
+	start := now.Truncate(l.window)
+	end := start.Add(l.window)
+	w := fixedWindow{start: start.UnixNano()}
+	if x, found := l.c.Get(k); found {
+		if v, ok := x.(fixedWindow); ok && v.start == w.start {
+			w = v
+		}
+	}
+	if w.count+n > l.limit {
+		return false, end.Sub(now)
+	}
+	w.count += n
+	l.c.Set(k, w, end.Sub(now))
+	return true, 0
+}
+
+// A SlidingLog allows up to a limit of events per key in any span of time as
+// long as its window. It remembers when each of the events in the last window
+// happened.
+type SlidingLog struct {
+	limiter
+	limit  int
+	window time.Duration
+}
+
+// Return a new sliding-window-log limiter allowing limit events per key in
+// any window, keeping its state in c.
+func NewSlidingLog(c *cache.Cache, limit int, window time.Duration) *SlidingLog {
+	l := &SlidingLog{
+		limit:  limit,
+		window: window,
+	}
+	l.init(c, l.takeN)
+	return l
+}
+
+func (l *SlidingLog) takeN(k string, n int, now time.Time) (bool, time.Duration) {
+	if n > l.limit {
+		return false, -1
+	}
+	// The times of the events in the last window, oldest first.
+	var log []int64
+	if x, found := l.c.Get(k); found {
+		log, _ = x.([]int64)
+	}
+	cutoff := now.Add(-l.window).UnixNano()
+	i := 0
+	for i < len(log) && log[i] <= cutoff {
+		i++
+	}
+	log = log[i:]
+	if len(log)+n > l.limit {
+		// Wait for enough of the events to fall out of the window.
+		oldest := time.Unix(0, log[len(log)+n-l.limit-1])
+		return false, oldest.Add(l.window).Sub(now)
+	}
+	// Copy rather than append, so as not to change a slice someone may
+	// have gotten from the cache.
+	next := make([]int64, len(log), len(log)+n)
+	copy(next, log)
+	for j := 0; j < n; j++ {
+		next = append(next, now.UnixNano())
+	}
+	l.c.Set(k, next, l.window)
+	return true, 0
+}
+
+// A TokenBucket gives each key a bucket that holds up to burst tokens and
+// refills at rate tokens per second. Each event takes a token, and is only
+// allowed if there is one. A key that has been idle long enough to have a full
+// bucket is removed from the cache.
+type TokenBucket struct {
+	limiter
+	rate  float64
+	burst int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   int64
+}
+
+// Return a new token-bucket limiter refilling at rate tokens per second up to
+// burst tokens, keeping its state in c. Panics if rate isn't positive.
+func NewTokenBucket(c *cache.Cache, rate float64, burst int) *TokenBucket {
+	if !(rate > 0) {
+		panic(fmt.Sprintf("ratelimit: token bucket rate %v is not positive", rate))
+	}
+	l := &TokenBucket{
+		rate:  rate,
+		burst: burst,
+	}
+	l.init(c, l.takeN)
+	return l
+}
+
+func (l *TokenBucket) takeN(k string, n int, now time.Time) (bool, time.Duration) {
+	if n > l.burst {
+		return false, -1
+	}
+	b := tokenBucket{tokens: float64(l.burst)}
+	x, _ := l.c.Get(k)
+	if v, ok := x.(tokenBucket); ok {
+		b = v
+		elapsed := now.Sub(time.Unix(0, b.last)).Seconds()
+		if elapsed > 0 {
+			b.tokens = math.Min(float64(l.burst), b.tokens+elapsed*l.rate)
+		}
+	}
+	if b.tokens < float64(n) {
+		return false, secondsToDuration((float64(n) - b.tokens) / l.rate)
+	}
+	b.tokens -= float64(n)
+	b.last = now.UnixNano()
+	// Once the bucket would be full again, a missing item means the same.
+	full := secondsToDuration((float64(l.burst) - b.tokens) / l.rate)
+	l.c.Set(k, b, full)
+	return true, 0
+}
+
+// secondsToDuration converts s to a duration, rounding up so that waiting for
+// it is always long enough, and to at least a nanosecond so that it isn't
+// taken to mean a default.
+func secondsToDuration(s float64) time.Duration {
+	d := time.Duration(math.Ceil(s * float64(time.Second)))
+	if d < 1 {
+		d = 1
+	}
+	return d
+}
@@ -0,0 +1,298 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// fakeClock only moves when told to. Every call to After is announced on
+// waiting, so that tests know when a Wait has gone to sleep.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC),
+		waiting: make(chan struct{}, 100),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{c.now.Add(d), ch})
+	c.waiting <- struct{}{}
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		if !t.at.After(c.now) {
+			t.c <- c.now
+		} else {
+			timers = append(timers, t)
+		}
+	}
+	c.timers = timers
+}
+
+func allowed(l Limiter, key string, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if l.Allow(key) {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestFixedWindow(t *testing.T) {
+	clock := newFakeClock()
+	l := NewFixedWindow(cache.New(cache.DefaultExpiration, 0), 10, time.Minute)
+	l.Clock = clock
+	if n := allowed(l, "a", 15); n != 10 {
+		t.Errorf("Expected 10 events to be allowed, got %d", n)
+	}
+	if n := allowed(l, "b", 15); n != 10 {
+		t.Error("Keys aren't limited separately")
+	}
+	clock.Advance(59 * time.Second)
+	if l.Allow("a") {
+		t.Error("An event was allowed before the window ended")
+	}
+	clock.Advance(time.Second)
+	if n := allowed(l, "a", 15); n != 10 {
+		t.Errorf("Expected 10 events to be allowed in the next window, got %d", n)
+	}
+	if l.AllowN("c", 11) {
+		t.Error("More events than the limit were allowed at once")
+	}
+	if !l.AllowN("c", 6) || l.AllowN("c", 5) || !l.AllowN("c", 4) {
+		t.Error("AllowN didn't count events correctly")
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	clock := newFakeClock()
+	l := NewSlidingLog(cache.New(cache.DefaultExpiration, 0), 10, time.Minute)
+	l.Clock = clock
+	for i := 0; i < 10; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("Event %d was not allowed", i)
+		}
+		clock.Advance(time.Second)
+	}
+	if l.Allow("a") {
+		t.Error("An 11th event was allowed within the window")
+	}
+	// One event falls out of the window every second from now on.
+	clock.Advance(50 * time.Second)
+	if !l.Allow("a") || l.Allow("a") {
+		t.Error("Expected exactly one event to be allowed")
+	}
+	clock.Advance(2 * time.Second)
+	if !l.AllowN("a", 2) || l.Allow("a") {
+		t.Error("Expected exactly two events to be allowed")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := newFakeClock()
+	c := cache.New(cache.DefaultExpiration, 0)
+	l := NewTokenBucket(c, 2, 5)
+	l.Clock = clock
+	if n := allowed(l, "a", 10); n != 5 {
+		t.Errorf("Expected a burst of 5, got %d", n)
+	}
+	clock.Advance(time.Second)
+	if n := allowed(l, "a", 10); n != 2 {
+		t.Errorf("Expected 2 tokens after a second, got %d", n)
+	}
+	clock.Advance(10 * time.Second)
+	if n := allowed(l, "a", 10); n != 5 {
+		t.Errorf("Expected the bucket to stop filling at 5, got %d", n)
+	}
+	if l.AllowN("b", 6) {
+		t.Error("More events than the burst were allowed at once")
+	}
+	// An unused key is dropped from the cache once its bucket is full
+	// again, by the system clock.
+	l = NewTokenBucket(c, 1000, 1)
+	l.Allow("fast")
+	<-time.After(5 * time.Millisecond)
+	c.DeleteExpired()
+	if _, found := c.Get("fast"); found {
+		t.Error("A full bucket was kept in the cache")
+	}
+}
+
+func TestWait(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		l    Limiter
+	}{
+		{"FixedWindow", NewFixedWindow(cache.New(cache.DefaultExpiration, 0), 1, time.Minute)},
+		{"SlidingLog", NewSlidingLog(cache.New(cache.DefaultExpiration, 0), 1, time.Minute)},
+		{"TokenBucket", NewTokenBucket(cache.New(cache.DefaultExpiration, 0), 1.0/60, 1)},
+	} {
+		clock := newFakeClock()
+		switch l := v.l.(type) {
+		case *FixedWindow:
+			l.Clock = clock
+		case *SlidingLog:
+			l.Clock = clock
+		case *TokenBucket:
+			l.Clock = clock
+		}
+		if err := v.l.Wait(context.Background(), "a"); err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		done := make(chan error)
+		go func() {
+			done <- v.l.Wait(context.Background(), "a")
+		}()
+		<-clock.waiting
+		select {
+		case <-done:
+			t.Fatalf("%s: Wait returned before the limit allowed it", v.name)
+		default:
+		}
+		clock.Advance(2 * time.Minute)
+		if err := <-done; err != nil {
+			t.Errorf("%s: %v", v.name, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			done <- v.l.Wait(ctx, "a")
+		}()
+		<-clock.waiting
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("%s: Expected context.Canceled, got %v", v.name, err)
+		}
+	}
+
+	l := NewTokenBucket(cache.New(cache.DefaultExpiration, 0), 1, 0)
+	if err := l.Wait(context.Background(), "a"); err != ErrExceedsLimit {
+		t.Error("Expected ErrExceedsLimit, got", err)
+	}
+}
+
+func TestTokenBucketRate(t *testing.T) {
+	for _, rate := range []float64{0, -1, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewTokenBucket with a rate of %v didn't panic", rate)
+				}
+			}()
+			NewTokenBucket(cache.New(cache.DefaultExpiration, 0), rate, 1)
+		}()
+	}
+}
+
+func TestAllowNonPositive(t *testing.T) {
+	c := cache.New(cache.DefaultExpiration, 0)
+	for _, l := range []Limiter{
+		NewFixedWindow(c.Namespace("fixed", 0), 10, time.Hour),
+		NewSlidingLog(c.Namespace("log", 0), 10, time.Hour),
+		NewTokenBucket(c.Namespace("bucket", 0), 0.001, 10),
+	} {
+		if n := allowed(l, "a", 10); n != 10 {
+			t.Errorf("%T allowed %d events instead of 10", l, n)
+		}
+		if l.AllowN("a", -100) {
+			t.Errorf("%T allowed a negative number of events", l)
+		}
+		if !l.AllowN("a", 0) {
+			t.Errorf("%T didn't allow zero events", l)
+		}
+		if l.Allow("a") {
+			t.Errorf("%T got capacity back from a negative or zero AllowN", l)
+		}
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	c := cache.New(cache.DefaultExpiration, 0)
+	limiters := []Limiter{
+		NewFixedWindow(c, 10, time.Hour),
+		NewSlidingLog(c, 10, time.Hour),
+		NewTokenBucket(c, 0.001, 10),
+	}
+	// Each limiter finds the others' state under the key.
+	for i := 0; i < 3; i++ {
+		for _, l := range limiters {
+			if !l.Allow("a") {
+				t.Errorf("%T didn't start afresh over another limiter's state", l)
+			}
+		}
+	}
+	c.Set("b", "not a limiter", cache.DefaultExpiration)
+	for _, l := range limiters {
+		if !l.Allow("b") {
+			t.Errorf("%T didn't start afresh over an unrelated value", l)
+		}
+	}
+}
+
+func TestConcurrentAllow(t *testing.T) {
+	c := cache.New(cache.DefaultExpiration, 0)
+	for _, l := range []Limiter{
+		NewFixedWindow(c.Namespace("fixed", 0), 100, time.Hour),
+		NewSlidingLog(c.Namespace("log", 0), 100, time.Hour),
+		NewTokenBucket(c.Namespace("bucket", 0), 0.001, 100),
+	} {
+		var n int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if l.Allow("a") {
+						atomic.AddInt32(&n, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if n != 100 {
+			t.Errorf("%T let %d events through instead of 100", l, n)
+		}
+	}
+}
+
+func BenchmarkTokenBucketAllow(b *testing.B) {
+	l := NewTokenBucket(cache.New(cache.DefaultExpiration, 0), 1e9, 1000)
+	for i := 0; i < b.N; i++ {
+		l.Allow("a")
+	}
+}
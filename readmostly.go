@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A ReadMostlyCache is a cache for items that are read far more often than
+// they are written, e.g. configuration. Reads never lock: they are served from
+// an immutable map that writes replace with an updated copy. That makes reads
+// scale across cores where the RWMutex of a Cache doesn't, but every write
+// takes time proportional to the number of items, so SetMany should be used to
+// make many changes at once.
+//
+// Values are shared between readers and must not be modified in place.
+type ReadMostlyCache struct {
+	*readMostlyCache
+	// If this is confusing, see the comment at the bottom of New()
+}
+
+type readMostlyCache struct {
+	defaultExpiration time.Duration
+	items             atomic.Pointer[map[string]Item]
+	// Serializes writes. Readers don't take it.
+	mu        sync.Mutex
+	onEvicted func(string, interface{})
+	janitor   *janitor
+}
+
+// load returns the current map of items, which must not be modified.
+func (c *readMostlyCache) load() map[string]Item {
+	return *c.items.Load()
+}
+
+// update calls f with a copy of the items, and replaces them with it once f
+// returns. c.mu must be held.
+func (c *readMostlyCache) update(f func(items map[string]Item)) {
+	old := c.load()
+	items := make(map[string]Item, len(old)+1)
+	for k, v := range old {
+		items[k] = v
+	}
+	f(items)
+	c.items.Store(&items)
+}
+
+func (c *readMostlyCache) item(x interface{}, d time.Duration) Item {
+	var e int64
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	if d > 0 {
+		e = time.Now().Add(d).UnixNano()
+	}
+	return Item{
+		Object:     x,
+		Expiration: e,
+	}
+}
+
+// Add an item to the cache, replacing any existing item. If the duration is 0
+// (DefaultExpiration), the cache's default expiration time is used. If it is -1
+// (NoExpiration), the item never expires.
+func (c *readMostlyCache) Set(k string, x interface{}, d time.Duration) {
+	item := c.item(x, d)
+	c.mu.Lock()
+	c.update(func(items map[string]Item) {
+		items[k] = item
+	})
+	c.mu.Unlock()
+}
+
+// Add an item to the cache, replacing any existing item, using the default
+// expiration.
+func (c *readMostlyCache) SetDefault(k string, x interface{}) {
+	c.Set(k, x, DefaultExpiration)
+}
+
+// Add several items to the cache at once, replacing any existing items, with
+// the same expiration (see Set.) Readers see either none or all of them.
+func (c *readMostlyCache) SetMany(xs map[string]interface{}, d time.Duration) {
+	c.mu.Lock()
+	c.update(func(items map[string]Item) {
+		for k, x := range xs {
+			items[k] = c.item(x, d)
+		}
+	})
+	c.mu.Unlock()
+}
+
+// Add an item to the cache only if an item doesn't already exist for the given
+// key, or if the existing item has expired. Returns an error otherwise.
+func (c *readMostlyCache) Add(k string, x interface{}, d time.Duration) error {
+	c.mu.Lock()
+	if _, found := c.get(k); found {
+		c.mu.Unlock()
+		return fmt.Errorf("Item %s already exists", k)
+	}
+	item := c.item(x, d)
+	c.update(func(items map[string]Item) {
+		items[k] = item
+	})
+	c.mu.Unlock()
+	return nil
+}
+
+// Set a new value for the cache key only if it already exists, and the existing
+// item hasn't expired. Returns an error otherwise.
+func (c *readMostlyCache) Replace(k string, x interface{}, d time.Duration) error {
+	c.mu.Lock()
+	if _, found := c.get(k); !found {
+		c.mu.Unlock()
+		return fmt.Errorf("Item %s doesn't exist", k)
+	}
+	item := c.item(x, d)
+	c.update(func(items map[string]Item) {
+		items[k] = item
+	})
+	c.mu.Unlock()
+	return nil
+}
+
+// Get an item from the cache. Returns the item or nil, and a bool indicating
+// whether the key was found.
+func (c *readMostlyCache) Get(k string) (interface{}, bool) {
+	return c.get(k)
+}
+
+func (c *readMostlyCache) get(k string) (interface{}, bool) {
+	item, found := c.load()[k]
+	if !found {
+		return nil, false
+	}
+	// "Inlining" of Expired
+	if item.Expiration > 0 {
+		if time.Now().UnixNano() > item.Expiration {
+			return nil, false
+		}
+	}
+	return item.Object, true
+}
+
+// GetWithExpiration returns an item and its expiration time from the cache.
+// It returns the item or nil, the expiration time if one is set (if the item
+// never expires a zero value for time.Time is returned), and a bool indicating
+// whether the key was found.
+func (c *readMostlyCache) GetWithExpiration(k string) (interface{}, time.Time, bool) {
+	item, found := c.load()[k]
+	if !found {
+		return nil, time.Time{}, false
+	}
+	if item.Expiration > 0 {
+		if time.Now().UnixNano() > item.Expiration {
+			return nil, time.Time{}, false
+		}
+		return item.Object, time.Unix(0, item.Expiration), true
+	}
+	return item.Object, time.Time{}, true
+}
+
+// Delete an item from the cache. Does nothing if the key is not in the cache.
+func (c *readMostlyCache) Delete(k string) {
+	c.mu.Lock()
+	item, found := c.load()[k]
+	if !found {
+		c.mu.Unlock()
+		return
+	}
+	c.update(func(items map[string]Item) {
+		delete(items, k)
+	})
+	onEvicted := c.onEvicted
+	c.mu.Unlock()
+	if onEvicted != nil {
+		onEvicted(k, item.Object)
+	}
+}
+
+// Delete all expired items from the cache.
+func (c *readMostlyCache) DeleteExpired() {
+	var evictedItems []keyAndValue
+	now := time.Now().UnixNano()
+	c.mu.Lock()
+	for k, v := range c.load() {
+		// "Inlining" of expired
+		if v.Expiration > 0 && now > v.Expiration {
+			evictedItems = append(evictedItems, keyAndValue{k, v.Object})
+		}
+	}
+	if len(evictedItems) > 0 {
+		c.update(func(items map[string]Item) {
+			for _, v := range evictedItems {
+				delete(items, v.key)
+			}
+		})
+	}
+	onEvicted := c.onEvicted
+	c.mu.Unlock()
+	if onEvicted != nil {
+		for _, v := range evictedItems {
+			onEvicted(v.key, v.value)
+		}
+	}
+}
+
+// Sets an (optional) function that is called with the key and value when an
+// item is evicted from the cache. (Including when it is deleted manually, but
+// not when it is overwritten.) Set to nil to disable.
+func (c *readMostlyCache) OnEvicted(f func(string, interface{})) {
+	c.mu.Lock()
+	c.onEvicted = f
+	c.mu.Unlock()
+}
+
+// Copies all unexpired items in the cache into a new map and returns it.
+func (c *readMostlyCache) Items() map[string]Item {
+	items := c.load()
+	m := make(map[string]Item, len(items))
+	now := time.Now().UnixNano()
+	for k, v := range items {
+		// "Inlining" of Expired
+		if v.Expiration > 0 {
+			if now > v.Expiration {
+				continue
+			}
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// Returns the number of items in the cache. This may include items that have
+// expired, but have not yet been cleaned up.
+func (c *readMostlyCache) ItemCount() int {
+	return len(c.load())
+}
+
+// Delete all items from the cache.
+func (c *readMostlyCache) Flush() {
+	c.mu.Lock()
+	items := map[string]Item{}
+	c.items.Store(&items)
+	c.mu.Unlock()
+}
+
+func stopReadMostlyJanitor(c *ReadMostlyCache) {
+	c.janitor.stop <- true
+}
+
+// Return a new read-mostly cache with a given default expiration duration and
+// cleanup interval (see New()).
+func NewReadMostly(defaultExpiration, cleanupInterval time.Duration) *ReadMostlyCache {
+	return NewReadMostlyFrom(defaultExpiration, cleanupInterval, map[string]Item{})
+}
+
+// Return a new read-mostly cache with a given default expiration duration and
+// cleanup interval, and the given items (see NewFrom().) The cache takes
+// ownership of the map, which must not be used afterwards.
+func NewReadMostlyFrom(defaultExpiration, cleanupInterval time.Duration, items map[string]Item) *ReadMostlyCache {
+	if defaultExpiration == 0 {
+		defaultExpiration = -1
+	}
+	c := &readMostlyCache{
+		defaultExpiration: defaultExpiration,
+	}
+	c.items.Store(&items)
+	C := &ReadMostlyCache{c}
+	if cleanupInterval > 0 {
+		c.janitor = &janitor{
+			Interval: cleanupInterval,
+			stop:     make(chan bool),
+		}
+		go c.janitor.Run(c)
+		runtime.SetFinalizer(C, stopReadMostlyJanitor)
+	}
+	return C
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadMostlyCache(t *testing.T) {
+	tc := NewReadMostly(DefaultExpiration, 0)
+	if _, found := tc.Get("foo"); found {
+		t.Error("Getting foo found value that shouldn't exist")
+	}
+	tc.Set("foo", "bar", DefaultExpiration)
+	if x, found := tc.Get("foo"); !found || x != "bar" {
+		t.Error("foo is", x)
+	}
+	if err := tc.Add("foo", "baz", DefaultExpiration); err == nil {
+		t.Error("Added foo, which already exists")
+	}
+	if err := tc.Replace("missing", "baz", DefaultExpiration); err == nil {
+		t.Error("Replaced missing, which doesn't exist")
+	}
+	if err := tc.Replace("foo", "baz", DefaultExpiration); err != nil {
+		t.Error(err)
+	}
+	if x, _ := tc.Get("foo"); x != "baz" {
+		t.Error("foo is", x, "after Replace")
+	}
+
+	tc.SetMany(map[string]interface{}{"a": 1, "b": 2}, DefaultExpiration)
+	if tc.ItemCount() != 3 {
+		t.Errorf("Expected 3 items, got %d", tc.ItemCount())
+	}
+
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		// Would deadlock if called with the cache locked.
+		tc.Set("evicted", k, DefaultExpiration)
+		evicted = append(evicted, k)
+	})
+	tc.Delete("a")
+	tc.Delete("missing")
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Error("Expected a to be evicted, got", evicted)
+	}
+	if _, found := tc.Get("a"); found {
+		t.Error("a was not deleted")
+	}
+
+	tc.Flush()
+	if tc.ItemCount() != 0 {
+		t.Error("Flush left items in the cache")
+	}
+}
+
+func TestReadMostlyCacheExpiration(t *testing.T) {
+	tc := NewReadMostly(50*time.Millisecond, 0)
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, NoExpiration)
+	tc.Set("c", 3, 20*time.Millisecond)
+	if _, e, _ := tc.GetWithExpiration("b"); !e.IsZero() {
+		t.Error("b has an expiration time:", e)
+	}
+	if _, e, _ := tc.GetWithExpiration("a"); e.IsZero() {
+		t.Error("a has no expiration time")
+	}
+
+	<-time.After(25 * time.Millisecond)
+	if _, found := tc.Get("c"); found {
+		t.Error("Found c when it should have been automatically deleted")
+	}
+	if err := tc.Add("c", 4, DefaultExpiration); err != nil {
+		t.Error("Couldn't add c over an expired item:", err)
+	}
+
+	<-time.After(30 * time.Millisecond)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	if len(tc.Items()) != 2 {
+		t.Error("Items returned expired items:", tc.Items())
+	}
+	tc.DeleteExpired()
+	if tc.ItemCount() != 2 || len(evicted) != 1 || evicted[0] != "a" {
+		t.Error("DeleteExpired didn't delete just a:", tc.Items(), evicted)
+	}
+}
+
+func TestReadMostlyCacheSnapshots(t *testing.T) {
+	// A reader sees every batch written with SetMany whole.
+	tc := NewReadMostly(DefaultExpiration, 0)
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = "k" + strconv.Itoa(i)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for gen := 0; gen < 200; gen++ {
+			xs := map[string]interface{}{}
+			for _, k := range keys {
+				xs[k] = gen
+			}
+			tc.SetMany(xs, DefaultExpiration)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		items := tc.Items()
+		var gen interface{}
+		for _, k := range keys {
+			item, found := items[k]
+			if !found {
+				continue
+			}
+			if gen == nil {
+				gen = item.Object
+			} else if item.Object != gen {
+				t.Fatalf("Saw a partial write: %v and %v", gen, item.Object)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+func TestReadMostlyCacheJanitor(t *testing.T) {
+	tc := NewReadMostly(time.Millisecond, time.Millisecond)
+	tc.Set("foo", "bar", DefaultExpiration)
+	deadline := time.Now().Add(5 * time.Second)
+	for tc.ItemCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The janitor never deleted the expired item")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
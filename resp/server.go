@@ -0,0 +1,790 @@
+// Package resp serves a cache over TCP using the Redis serialization protocol
+// (RESP2, or RESP3 after a HELLO 3), so that redis-cli and Redis client
+// libraries can be used to inspect and modify it.
+//
+// Only a subset of Redis' string commands is supported: GET, SET (with EX,
+// PX, NX and XX), DEL, EXISTS, EXPIRE, PEXPIRE, TTL, PTTL, INCR, INCRBY, DECR,
+// DECRBY, INCRBYFLOAT, KEYS, SCAN (with MATCH and COUNT), DBSIZE, FLUSHALL,
+// FLUSHDB, INFO, PING, ECHO, HELLO, SELECT 0, COMMAND and QUIT.
+//
+// Values set through the protocol are stored as int64 if they are the
+// canonical decimal form of one, and as strings otherwise; INCRBYFLOAT stores
+// a float64. Values of other types set directly on the cache are served as
+// their fmt.Sprint representation. A SET without EX or PX uses the cache's
+// default expiration.
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	version       = "7.0.0-go-cache"
+	maxBulkLen    = 512 << 20
+	maxArrayLen   = 1 << 20
+	maxInlineLine = 64 << 10
+	// The most space allocated for the arguments of a request, and for each
+	// argument, before they have actually arrived, so that a client can't
+	// make the server allocate a lot of memory by merely declaring large
+	// ones.
+	maxArrayAlloc = 1024
+	maxBulkAlloc  = 64 << 10
+)
+
+var (
+	errClosed   = errors.New("resp: server closed")
+	errProtocol = errors.New("resp: protocol error")
+)
+
+// A Server serves a *cache.Cache over RESP.
+type Server struct {
+	c *cache.Cache
+
+	// mu serializes the server's read-modify-write commands (SET with NX
+	// or XX, EXPIRE and the INCR family). Writes made to the cache
+	// directly, not through the server, aren't covered by it.
+	mu sync.Mutex
+
+	connMu    sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// Return a new server for the given cache.
+func NewServer(c *cache.Cache) *Server {
+	return &Server{
+		c:         c,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// Listen on the TCP network address addr and serve connections on it. It
+// returns when Close is called or the listener fails.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Accept connections on l and serve each of them in its own goroutine. It
+// returns when Close is called or l fails, and always closes l.
+func (s *Server) Serve(l net.Listener) error {
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		l.Close()
+		return errClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.connMu.Unlock()
+	defer func() {
+		s.connMu.Lock()
+		delete(s.listeners, l)
+		s.connMu.Unlock()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.connMu.Lock()
+			closed := s.closed
+			s.connMu.Unlock()
+			if closed {
+				return errClosed
+			}
+			return err
+		}
+		s.connMu.Lock()
+		if s.closed {
+			s.connMu.Unlock()
+			conn.Close()
+			return errClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.connMu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops all listeners and closes all open connections, and waits for
+// their goroutines to exit.
+func (s *Server) Close() error {
+	s.connMu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connMu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer func() {
+		s.connMu.Lock()
+		delete(s.conns, nc)
+		s.connMu.Unlock()
+		nc.Close()
+		s.wg.Done()
+	}()
+	r := bufio.NewReader(nc)
+	c := &conn{w: bufio.NewWriter(nc), proto: 2}
+	for {
+		args, err := readCommand(r)
+		if err == errProtocol {
+			c.err("ERR Protocol error")
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if quit := s.dispatch(c, args); quit {
+			c.w.Flush()
+			return
+		}
+		if r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads a request, either as a RESP array of bulk strings or as
+// an inline command.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxArrayLen {
+		return nil, errProtocol
+	}
+	args := make([]string, 0, min(n, maxArrayAlloc))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, errProtocol
+		}
+		var b bytes.Buffer
+		b.Grow(min(size+2, maxBulkAlloc))
+		if _, err := io.CopyN(&b, r, int64(size+2)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		buf := b.Bytes()
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		frag, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		sb.Write(frag)
+		if sb.Len() > maxInlineLine {
+			return "", errProtocol
+		}
+		if !isPrefix {
+			return sb.String(), nil
+		}
+	}
+}
+
+// A conn writes replies in the protocol version the client negotiated.
+type conn struct {
+	w     *bufio.Writer
+	proto int
+}
+
+func (c *conn) simple(s string) { fmt.Fprintf(c.w, "+%s\r\n", s) }
+func (c *conn) err(s string)    { fmt.Fprintf(c.w, "-%s\r\n", s) }
+func (c *conn) int(n int64)     { fmt.Fprintf(c.w, ":%d\r\n", n) }
+func (c *conn) array(n int)     { fmt.Fprintf(c.w, "*%d\r\n", n) }
+
+func (c *conn) bulk(s string) {
+	fmt.Fprintf(c.w, "$%d\r\n", len(s))
+	c.w.WriteString(s)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) null() {
+	if c.proto == 3 {
+		c.w.WriteString("_\r\n")
+	} else {
+		c.w.WriteString("$-1\r\n")
+	}
+}
+
+func (c *conn) mapHeader(n int) {
+	if c.proto == 3 {
+		fmt.Fprintf(c.w, "%%%d\r\n", n)
+	} else {
+		c.array(2 * n)
+	}
+}
+
+func (c *conn) wrongArgs(cmd string) {
+	c.err(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd))
+}
+
+func (c *conn) syntaxError()   { c.err("ERR syntax error") }
+func (c *conn) notInteger()    { c.err("ERR value is not an integer or out of range") }
+func (c *conn) notFloat()      { c.err("ERR value is not a valid float") }
+func (c *conn) overflowError() { c.err("ERR increment or decrement would overflow") }
+
+// dispatch runs a single command, and reports whether the connection should
+// be closed afterwards.
+func (s *Server) dispatch(c *conn, args []string) bool {
+	cmd := strings.ToLower(args[0])
+	args = args[1:]
+	switch cmd {
+	case "get":
+		s.get(c, cmd, args)
+	case "set":
+		s.set(c, cmd, args)
+	case "del":
+		s.del(c, cmd, args)
+	case "exists":
+		s.exists(c, cmd, args)
+	case "expire", "pexpire":
+		s.expire(c, cmd, args)
+	case "ttl", "pttl":
+		s.ttl(c, cmd, args)
+	case "incr", "decr", "incrby", "decrby":
+		s.incrBy(c, cmd, args)
+	case "incrbyfloat":
+		s.incrByFloat(c, cmd, args)
+	case "keys":
+		s.keys(c, cmd, args)
+	case "scan":
+		s.scan(c, cmd, args)
+	case "dbsize":
+		c.int(int64(s.c.ItemCount()))
+	case "flushall", "flushdb":
+		if len(args) > 1 {
+			c.syntaxError()
+			return false
+		}
+		s.c.Flush()
+		c.simple("OK")
+	case "info":
+		s.info(c)
+	case "ping":
+		switch len(args) {
+		case 0:
+			c.simple("PONG")
+		case 1:
+			c.bulk(args[0])
+		default:
+			c.wrongArgs(cmd)
+		}
+	case "echo":
+		if len(args) != 1 {
+			c.wrongArgs(cmd)
+			return false
+		}
+		c.bulk(args[0])
+	case "hello":
+		s.hello(c, args)
+	case "select":
+		if len(args) != 1 {
+			c.wrongArgs(cmd)
+		} else if args[0] != "0" {
+			c.err("ERR DB index is out of range")
+		} else {
+			c.simple("OK")
+		}
+	case "command":
+		// redis-cli asks for command docs on startup; there are none.
+		c.array(0)
+	case "quit":
+		c.simple("OK")
+		return true
+	default:
+		c.err(fmt.Sprintf("ERR unknown command '%s'", cmd))
+	}
+	return false
+}
+
+// format renders a cached value as a Redis string.
+func format(x interface{}) string {
+	switch v := x.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(x)
+}
+
+// parse turns a string set by a client into the value to put in the cache.
+func parse(s string) interface{} {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(n, 10) == s {
+		return n
+	}
+	return s
+}
+
+// remaining returns the duration to pass to Set to keep an item's current
+// expiration time.
+func remaining(exp time.Time) time.Duration {
+	if exp.IsZero() {
+		return cache.NoExpiration
+	}
+	d := time.Until(exp)
+	if d <= 0 {
+		d = 1
+	}
+	return d
+}
+
+func (s *Server) get(c *conn, cmd string, args []string) {
+	if len(args) != 1 {
+		c.wrongArgs(cmd)
+		return
+	}
+	x, found := s.c.Get(args[0])
+	if !found {
+		c.null()
+		return
+	}
+	c.bulk(format(x))
+}
+
+func (s *Server) set(c *conn, cmd string, args []string) {
+	if len(args) < 2 {
+		c.wrongArgs(cmd)
+		return
+	}
+	k, x := args[0], parse(args[1])
+	d := cache.DefaultExpiration
+	var nx, xx, hasTTL bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if hasTTL || i+1 == len(args) {
+				c.syntaxError()
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				c.notInteger()
+				return
+			}
+			if n <= 0 {
+				c.err(fmt.Sprintf("ERR invalid expire time in '%s' command", cmd))
+				return
+			}
+			unit := time.Second
+			if opt == "px" {
+				unit = time.Millisecond
+			}
+			if n > math.MaxInt64/int64(unit) {
+				c.err(fmt.Sprintf("ERR invalid expire time in '%s' command", cmd))
+				return
+			}
+			d = time.Duration(n) * unit
+			hasTTL = true
+		default:
+			c.syntaxError()
+			return
+		}
+	}
+	if nx && xx {
+		c.syntaxError()
+		return
+	}
+	switch {
+	case nx:
+		s.mu.Lock()
+		err := s.c.Add(k, x, d)
+		s.mu.Unlock()
+		if err != nil {
+			c.null()
+			return
+		}
+	case xx:
+		s.mu.Lock()
+		err := s.c.Replace(k, x, d)
+		s.mu.Unlock()
+		if err != nil {
+			c.null()
+			return
+		}
+	default:
+		s.c.Set(k, x, d)
+	}
+	c.simple("OK")
+}
+
+func (s *Server) del(c *conn, cmd string, args []string) {
+	if len(args) == 0 {
+		c.wrongArgs(cmd)
+		return
+	}
+	var n int64
+	s.mu.Lock()
+	for _, k := range args {
+		if _, found := s.c.Get(k); found {
+			n++
+		}
+		s.c.Delete(k)
+	}
+	s.mu.Unlock()
+	c.int(n)
+}
+
+func (s *Server) exists(c *conn, cmd string, args []string) {
+	if len(args) == 0 {
+		c.wrongArgs(cmd)
+		return
+	}
+	var n int64
+	for _, k := range args {
+		if _, found := s.c.Get(k); found {
+			n++
+		}
+	}
+	c.int(n)
+}
+
+func (s *Server) expire(c *conn, cmd string, args []string) {
+	if len(args) != 2 {
+		c.wrongArgs(cmd)
+		return
+	}
+	k := args[0]
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		c.notInteger()
+		return
+	}
+	unit := time.Second
+	if cmd == "pexpire" {
+		unit = time.Millisecond
+	}
+	if n > math.MaxInt64/int64(unit) {
+		c.err(fmt.Sprintf("ERR invalid expire time in '%s' command", cmd))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	x, found := s.c.Get(k)
+	if !found {
+		c.int(0)
+		return
+	}
+	if n <= 0 {
+		s.c.Delete(k)
+	} else {
+		s.c.Replace(k, x, time.Duration(n)*unit)
+	}
+	c.int(1)
+}
+
+func (s *Server) ttl(c *conn, cmd string, args []string) {
+	if len(args) != 1 {
+		c.wrongArgs(cmd)
+		return
+	}
+	_, exp, found := s.c.GetWithExpiration(args[0])
+	switch {
+	case !found:
+		c.int(-2)
+	case exp.IsZero():
+		c.int(-1)
+	case cmd == "pttl":
+		c.int(int64((time.Until(exp) + time.Millisecond/2) / time.Millisecond))
+	default:
+		c.int(int64((time.Until(exp) + time.Second/2) / time.Second))
+	}
+}
+
+func (s *Server) incrBy(c *conn, cmd string, args []string) {
+	var n int64 = 1
+	switch cmd {
+	case "incr", "decr":
+		if len(args) != 1 {
+			c.wrongArgs(cmd)
+			return
+		}
+	default:
+		if len(args) != 2 {
+			c.wrongArgs(cmd)
+			return
+		}
+		var err error
+		if n, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			c.notInteger()
+			return
+		}
+	}
+	if cmd == "decr" || cmd == "decrby" {
+		if n == math.MinInt64 {
+			c.overflowError()
+			return
+		}
+		n = -n
+	}
+	k := args[0]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	x, _, found := s.c.GetWithExpiration(k)
+	if !found {
+		// Like Redis, start missing keys off at 0 with no expiration.
+		x = int64(0)
+		s.c.Add(k, x, cache.NoExpiration)
+	}
+	cur, ok := x.(int64)
+	if !ok {
+		c.notInteger()
+		return
+	}
+	if (n > 0 && cur > math.MaxInt64-n) || (n < 0 && cur < math.MinInt64-n) {
+		c.overflowError()
+		return
+	}
+	if err := s.c.Increment(k, n); err != nil {
+		c.err("ERR " + err.Error())
+		return
+	}
+	c.int(cur + n)
+}
+
+func (s *Server) incrByFloat(c *conn, cmd string, args []string) {
+	if len(args) != 2 {
+		c.wrongArgs(cmd)
+		return
+	}
+	k := args[0]
+	n, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		c.notFloat()
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	x, exp, found := s.c.GetWithExpiration(k)
+	if !found {
+		x, exp = float64(0), time.Time{}
+		s.c.Add(k, x, cache.NoExpiration)
+	}
+	var cur float64
+	switch v := x.(type) {
+	case float64:
+		cur = v
+	case int64:
+		cur = float64(v)
+	case string:
+		if cur, err = strconv.ParseFloat(v, 64); err != nil {
+			c.notFloat()
+			return
+		}
+	default:
+		c.notFloat()
+		return
+	}
+	nv := cur + n
+	if math.IsNaN(nv) || math.IsInf(nv, 0) {
+		c.err("ERR increment would produce NaN or Infinity")
+		return
+	}
+	if _, ok := x.(float64); ok {
+		err = s.c.IncrementFloat(k, n)
+	} else {
+		// Convert the value to a float64, keeping its expiration.
+		err = s.c.Replace(k, nv, remaining(exp))
+	}
+	if err != nil {
+		c.err("ERR " + err.Error())
+		return
+	}
+	c.bulk(format(nv))
+}
+
+func (s *Server) keys(c *conn, cmd string, args []string) {
+	if len(args) != 1 {
+		c.wrongArgs(cmd)
+		return
+	}
+	var keys []string
+	s.c.Range(func(k string, _ cache.Item) bool {
+		if cache.Match(args[0], k) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	c.array(len(keys))
+	for _, k := range keys {
+		c.bulk(k)
+	}
+}
+
+// SCAN maps directly onto the cache's Scan, so it has the same guarantees.
+// Unlike Redis, COUNT is the number of matching keys to return, not the
+// number of keys to look at.
+func (s *Server) scan(c *conn, cmd string, args []string) {
+	if len(args) == 0 {
+		c.wrongArgs(cmd)
+		return
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		c.err("ERR invalid cursor")
+		return
+	}
+	pattern, count := "", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.syntaxError()
+			return
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				c.notInteger()
+				return
+			}
+			if n < 1 {
+				c.syntaxError()
+				return
+			}
+			count = n
+		default:
+			c.syntaxError()
+			return
+		}
+	}
+	page, next := s.c.Scan(cursor, pattern, count)
+	c.array(2)
+	c.bulk(strconv.FormatUint(next, 10))
+	c.array(len(page))
+	for _, k := range page {
+		c.bulk(k)
+	}
+}
+
+func (s *Server) info(c *conn) {
+	var keys, expires int
+	s.c.Range(func(_ string, it cache.Item) bool {
+		keys++
+		if it.Expiration > 0 {
+			expires++
+		}
+		return true
+	})
+	var sb strings.Builder
+	sb.WriteString("# Server\r\n")
+	fmt.Fprintf(&sb, "redis_version:%s\r\n", version)
+	sb.WriteString("redis_mode:standalone\r\n")
+	sb.WriteString("\r\n# Memory\r\n")
+	fmt.Fprintf(&sb, "used_memory:%d\r\n", s.c.ApproxMemoryUsage())
+	sb.WriteString("\r\n# Keyspace\r\n")
+	if keys > 0 {
+		fmt.Fprintf(&sb, "db0:keys=%d,expires=%d,avg_ttl=0\r\n", keys, expires)
+	}
+	c.bulk(sb.String())
+}
+
+func (s *Server) hello(c *conn, args []string) {
+	proto := c.proto
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			c.err("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if n != 2 && n != 3 {
+			c.err("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = n
+		for i := 1; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "auth":
+				i += 2
+			case "setname":
+				i++
+			default:
+				c.syntaxError()
+				return
+			}
+			if i >= len(args) {
+				c.syntaxError()
+				return
+			}
+		}
+	}
+	c.proto = proto
+	c.mapHeader(5)
+	c.bulk("server")
+	c.bulk("redis")
+	c.bulk("version")
+	c.bulk(version)
+	c.bulk("proto")
+	c.int(int64(proto))
+	c.bulk("mode")
+	c.bulk("standalone")
+	c.bulk("modules")
+	c.array(0)
+}
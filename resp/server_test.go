@@ -0,0 +1,303 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestServer(t *testing.T) (*testClient, *cache.Cache) {
+	tc := cache.New(cache.DefaultExpiration, 0)
+	s := NewServer(tc)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}, tc
+}
+
+// do sends a command as a RESP array and returns the decoded reply: a string
+// for simple and bulk strings, "ERR..." style strings prefixed with "-" for
+// errors, int64 for integers, nil for nulls, []interface{} for arrays and
+// map[string]interface{} for maps.
+func (c *testClient) do(args ...string) interface{} {
+	c.t.Helper()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write([]byte(sb.String())); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+func (c *testClient) read() interface{} {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal("Reading reply:", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return line
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		res := []interface{}{}
+		for i := 0; i < n; i++ {
+			res = append(res, c.read())
+		}
+		return res
+	case '%':
+		n, _ := strconv.Atoi(line[1:])
+		res := map[string]interface{}{}
+		for i := 0; i < n; i++ {
+			k := c.read().(string)
+			res[k] = c.read()
+		}
+		return res
+	}
+	c.t.Fatalf("Unexpected reply %q", line)
+	return nil
+}
+
+func (c *testClient) expect(want interface{}, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); !reflect.DeepEqual(got, want) {
+		c.t.Errorf("%v: expected %#v, got %#v", args, want, got)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	c, tc := newTestServer(t)
+	c.expect("PONG", "PING")
+	c.expect(nil, "GET", "foo")
+	c.expect("OK", "SET", "foo", "bar")
+	c.expect("bar", "GET", "foo")
+	c.expect("OK", "SET", "n", "42")
+	if x, _ := tc.Get("n"); x != int64(42) {
+		t.Errorf("Expected n to be stored as int64(42), got %T %v", x, x)
+	}
+	tc.Set("goint", 7, cache.DefaultExpiration)
+	c.expect("7", "get", "goint")
+
+	c.expect(nil, "SET", "foo", "baz", "NX")
+	c.expect("OK", "SET", "new", "baz", "NX")
+	c.expect(nil, "SET", "missing", "baz", "XX")
+	c.expect("OK", "SET", "foo", "qux", "XX")
+	c.expect("qux", "GET", "foo")
+	c.expect("-ERR syntax error", "SET", "foo", "bar", "NX", "XX")
+	c.expect("-ERR syntax error", "SET", "foo", "bar", "EX")
+	c.expect("-ERR invalid expire time in 'set' command", "SET", "foo", "bar", "EX", "0")
+	c.expect("-ERR wrong number of arguments for 'get' command", "GET")
+	c.expect("-ERR unknown command 'bogus'", "BOGUS")
+
+	c.expect(int64(2), "EXISTS", "foo", "new", "missing")
+	c.expect(int64(2), "DEL", "foo", "new", "missing")
+	c.expect(int64(0), "EXISTS", "foo", "new")
+}
+
+func TestExpiration(t *testing.T) {
+	c, tc := newTestServer(t)
+	c.expect("OK", "SET", "a", "1", "EX", "100")
+	c.expect(int64(100), "TTL", "a")
+	c.expect("OK", "SET", "b", "1", "PX", "1500")
+	if n := c.do("PTTL", "b").(int64); n <= 1000 || n > 1500 {
+		t.Error("Unexpected PTTL for b:", n)
+	}
+	c.expect("OK", "SET", "c", "1")
+	c.expect(int64(-1), "TTL", "c")
+	c.expect(int64(-2), "TTL", "missing")
+
+	c.expect(int64(1), "EXPIRE", "c", "50")
+	c.expect(int64(50), "TTL", "c")
+	c.expect(int64(0), "EXPIRE", "missing", "50")
+	c.expect(int64(1), "PEXPIRE", "c", "0")
+	c.expect(nil, "GET", "c")
+
+	c.expect("OK", "SET", "d", "1", "PX", "10")
+	<-time.After(20 * time.Millisecond)
+	c.expect(nil, "GET", "d")
+	if _, found := tc.Get("d"); found {
+		t.Error("d did not expire in the cache")
+	}
+}
+
+func TestIncr(t *testing.T) {
+	c, tc := newTestServer(t)
+	c.expect(int64(5), "INCRBY", "n", "5")
+	c.expect(int64(6), "INCR", "n")
+	c.expect(int64(4), "DECRBY", "n", "2")
+	c.expect(int64(3), "DECR", "n")
+	c.expect(int64(-1), "TTL", "n")
+
+	c.expect("OK", "SET", "m", "9223372036854775806", "EX", "100")
+	c.expect(int64(9223372036854775807), "INCR", "m")
+	c.expect("-ERR increment or decrement would overflow", "INCR", "m")
+	c.expect(int64(100), "TTL", "m")
+
+	c.expect("OK", "SET", "s", "abc")
+	c.expect("-ERR value is not an integer or out of range", "INCR", "s")
+	c.expect("-ERR value is not an integer or out of range", "INCRBY", "n", "x")
+
+	c.expect("3.5", "INCRBYFLOAT", "n", "0.5")
+	if x, _ := tc.Get("n"); x != 3.5 {
+		t.Errorf("Expected n to be float64(3.5), got %T %v", x, x)
+	}
+	c.expect("3", "INCRBYFLOAT", "n", "-0.5")
+	c.expect("-ERR value is not an integer or out of range", "INCR", "n")
+	c.expect("0.25", "INCRBYFLOAT", "f", "0.25")
+	c.expect("OK", "SET", "fs", "1.5", "EX", "100")
+	c.expect("3", "INCRBYFLOAT", "fs", "1.5")
+	c.expect(int64(100), "TTL", "fs")
+	c.expect("-ERR value is not a valid float", "INCRBYFLOAT", "s", "1")
+}
+
+func TestKeysAndScan(t *testing.T) {
+	c, _ := newTestServer(t)
+	var want []interface{}
+	for i := 0; i < 25; i++ {
+		k := fmt.Sprintf("pub:%02d", i)
+		c.expect("OK", "SET", k, "x")
+		if i%10 == 3 {
+			want = append(want, k)
+		}
+	}
+	c.expect("OK", "SET", "slot:1", "x")
+	c.expect(want, "KEYS", "pub:?3")
+	c.expect([]interface{}{"slot:1"}, "KEYS", "s*")
+	c.expect(int64(26), "DBSIZE")
+
+	var got []string
+	cursor := "0"
+	for i := 0; ; i++ {
+		if i > 10 {
+			t.Fatal("SCAN did not terminate")
+		}
+		res := c.do("SCAN", cursor, "MATCH", "pub:*", "COUNT", "7").([]interface{})
+		for _, k := range res[1].([]interface{}) {
+			got = append(got, k.(string))
+		}
+		cursor = res[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(got)
+	if len(got) != 25 || got[0] != "pub:00" || got[24] != "pub:24" {
+		t.Error("SCAN returned", got)
+	}
+
+	c.expect("OK", "FLUSHALL")
+	c.expect(int64(0), "DBSIZE")
+}
+
+func TestHelloAndInfo(t *testing.T) {
+	c, _ := newTestServer(t)
+	res := c.do("HELLO", "3")
+	m, ok := res.(map[string]interface{})
+	if !ok || m["proto"] != int64(3) {
+		t.Fatalf("Unexpected HELLO 3 reply %#v", res)
+	}
+	// RESP3 nulls.
+	if _, err := c.conn.Write([]byte("*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := c.r.ReadString('\n'); line != "_\r\n" {
+		t.Errorf("Expected a RESP3 null, got %q", line)
+	}
+	c.expect("OK", "SET", "a", "1", "EX", "10")
+	info := c.do("INFO").(string)
+	if !strings.Contains(info, "db0:keys=1,expires=1") || !strings.Contains(info, "used_memory:") {
+		t.Errorf("Unexpected INFO reply %q", info)
+	}
+
+	// Inline commands, as typed into telnet.
+	if _, err := c.conn.Write([]byte("PING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.read(); got != "PONG" {
+		t.Errorf("Expected PONG for an inline PING, got %#v", got)
+	}
+	c.expect("OK", "QUIT")
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("Connection was not closed after QUIT")
+	}
+}
+
+func TestLargeDeclaredSizes(t *testing.T) {
+	for _, header := range []string{
+		"*1\r\n$536870912\r\n",
+		"*1048576\r\n",
+	} {
+		c, _ := newTestServer(t)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := c.conn.Write([]byte(header)); err != nil {
+			t.Fatal(err)
+		}
+		c.conn.(*net.TCPConn).CloseWrite()
+		if _, err := c.r.ReadByte(); err != io.EOF {
+			t.Error("Expected the connection to be closed, got", err)
+		}
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > 4<<20 {
+			t.Errorf("%q made the server allocate %d bytes", header, n)
+		}
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	c, _ := newTestServer(t)
+	if _, err := c.conn.Write([]byte("*-1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.read(); got != "-ERR Protocol error" {
+		t.Errorf("Expected a protocol error for a negative array length, got %#v", got)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("Connection was not closed after a protocol error")
+	}
+}
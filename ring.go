@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"sort"
+	"strconv"
+)
+
+// A HashRing maps keys to nodes using consistent hashing, so that adding or
+// removing a node only moves the keys that hash to that node. Each node is
+// placed on the ring at several points (virtual nodes) to even out the share
+// of keys it gets.
+//
+// Unlike the sharded cache, the ring hashes with a fixed seed, so that every
+// process building a ring from the same nodes maps keys the same way. A
+// HashRing is not safe for concurrent use if nodes are added to it.
+type HashRing struct {
+	replicas int
+	hashes   []uint32
+	owners   map[uint32]string
+}
+
+// Return a new ring placing each node at the given number of points, which
+// should be somewhere around 50-200 for a good spread.
+func NewHashRing(replicas int, nodes ...string) *HashRing {
+	if replicas < 1 {
+		replicas = 1
+	}
+	r := &HashRing{
+		replicas: replicas,
+		owners:   map[uint32]string{},
+	}
+	r.Add(nodes...)
+	return r
+}
+
+// Add nodes to the ring. Adding a node that is already on it does nothing.
+func (r *HashRing) Add(nodes ...string) {
+	for _, node := range nodes {
+		for i := 0; i < r.replicas; i++ {
+			h := ringHash(strconv.Itoa(i) + node)
+			if _, taken := r.owners[h]; taken {
+				// Collisions are rare; the node that sorts first
+				// keeps the point, so the result doesn't depend on
+				// the order nodes were added in.
+				if r.owners[h] > node {
+					r.owners[h] = node
+				}
+				continue
+			}
+			r.owners[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// Returns the node that owns k, or "" if the ring is empty.
+func (r *HashRing) Get(k string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := ringHash(k)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// Returns the number of distinct nodes on the ring.
+func (r *HashRing) Len() int {
+	nodes := map[string]struct{}{}
+	for _, node := range r.owners {
+		nodes[node] = struct{}{}
+	}
+	return len(nodes)
+}
+
+// ringHash is djb33 with a fixed seed, followed by murmur3's finalizer. djb33
+// on its own leaves short strings (like the virtual node names) bunched up in
+// a small part of the hash space, which is fine for picking a shard with a
+// modulo but not for placing points on a ring.
+func ringHash(k string) uint32 {
+	h := djb33(0, k)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
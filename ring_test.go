@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	r := NewHashRing(100)
+	if node := r.Get("foo"); node != "" {
+		t.Error("Empty ring returned a node:", node)
+	}
+	r.Add("a", "b", "c")
+	if n := r.Len(); n != 3 {
+		t.Errorf("Expected 3 nodes, got %d", n)
+	}
+
+	n := 30000
+	counts := map[string]int{}
+	owners := make([]string, n)
+	for i := 0; i < n; i++ {
+		owners[i] = r.Get("key" + strconv.Itoa(i))
+		counts[owners[i]]++
+	}
+	for node, c := range counts {
+		if c < n/3/2 || c > n/3*2 {
+			t.Errorf("Node %s got %d of %d keys", node, c, n)
+		}
+	}
+
+	// The same nodes added in a different order map keys the same way.
+	r2 := NewHashRing(100, "c", "a", "b")
+	for i := 0; i < n; i++ {
+		if owner := r2.Get("key" + strconv.Itoa(i)); owner != owners[i] {
+			t.Fatalf("key%d is owned by %s on one ring and %s on the other", i, owners[i], owner)
+		}
+	}
+
+	// Adding a node only moves keys to the new node.
+	r.Add("d")
+	moved := 0
+	for i := 0; i < n; i++ {
+		owner := r.Get("key" + strconv.Itoa(i))
+		if owner != owners[i] {
+			if owner != "d" {
+				t.Fatalf("key%d moved from %s to %s instead of d", i, owners[i], owner)
+			}
+			moved++
+		}
+	}
+	if moved < n/4/2 || moved > n/4*2 {
+		t.Errorf("Expected about a quarter of the keys to move, %d of %d did", moved, n)
+	}
+}
@@ -2,11 +2,16 @@ package cache
 
 import (
 	"crypto/rand"
+	"hash/maphash"
+	"iter"
 	"math"
 	"math/big"
 	insecurerand "math/rand"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,10 +29,40 @@ type unexportedShardedCache struct {
 }
 
 type shardedCache struct {
-	seed    uint32
-	m       uint32
-	cs      []*cache
+	// Hashes keys to pick their shards.
+	hash    shardHash
+	table   atomic.Pointer[shardTable]
 	janitor *shardedJanitor
+	// Grows the number of shards when they are contended. Only set for
+	// caches made with unexportedNewShardedAdaptive.
+	grower *shardGrower
+}
+
+type shard struct {
+	*cache
+	// Held for reading by every operation on the shard of a cache that can
+	// grow, and for writing while the shard is split. See shardedCache.do.
+	routing sync.RWMutex
+	// Sampled operations, and how long they waited for the shard's lock.
+	samples atomic.Int64
+	waited  atomic.Int64
+}
+
+// A shardTable says which shard a key is in. It uses linear hashing, so that
+// shards can be split one at a time: the first split shards, and the shards
+// they were split into, use a modulus twice that of the others.
+type shardTable struct {
+	m      uint32
+	split  uint32
+	shards []*shard
+}
+
+func (t *shardTable) index(h uint32) uint32 {
+	i := h % t.m
+	if i < t.split {
+		i = h % (2 * t.m)
+	}
+	return i
 }
 
 // djb2 with better shuffling. 5x faster than FNV with the hash.Hash overhead.
@@ -49,59 +84,236 @@ func djb33(seed uint32, k string) uint32 {
 	}
 	switch l - i {
 	case 1:
+		d = (d * 33) ^ uint32(k[i])
 	case 2:
 		d = (d * 33) ^ uint32(k[i])
+		d = (d * 33) ^ uint32(k[i+1])
 	case 3:
 		d = (d * 33) ^ uint32(k[i])
 		d = (d * 33) ^ uint32(k[i+1])
+		d = (d * 33) ^ uint32(k[i+2])
 	case 4:
 		d = (d * 33) ^ uint32(k[i])
 		d = (d * 33) ^ uint32(k[i+1])
 		d = (d * 33) ^ uint32(k[i+2])
+		d = (d * 33) ^ uint32(k[i+3])
 	}
 	return d ^ (d >> 16)
 }
 
+// bucket returns the shard k is in. If the cache can grow, k may have moved
+// to another shard by the time the shard is used; see do.
 func (sc *shardedCache) bucket(k string) *cache {
-	return sc.cs[djb33(sc.seed, k)%sc.m]
+	t := sc.table.Load()
+	return t.shards[t.index(sc.hash(k))].cache
+}
+
+// do calls f with the shard k is in. If the cache can grow, the shard can't be
+// split until f returns.
+func (sc *shardedCache) do(k string, f func(c *cache)) {
+	if sc.grower == nil {
+		f(sc.bucket(k))
+		return
+	}
+	s := sc.acquire(sc.hash(k))
+	defer s.routing.RUnlock()
+	if sc.grower.sample() {
+		s.probe()
+	}
+	f(s.cache)
+}
+
+// acquire read-locks the routing of the shard a key with hash h is in.
+func (sc *shardedCache) acquire(h uint32) *shard {
+	for {
+		t := sc.table.Load()
+		s := t.shards[t.index(h)]
+		s.routing.RLock()
+		// If the table changed, the key may have moved.
+		if sc.table.Load() == t {
+			return s
+		}
+		s.routing.RUnlock()
+	}
+}
+
+// each calls f with every shard. If the cache can grow, no shard is split
+// until each returns, so that no items are missed.
+func (sc *shardedCache) each(f func(c *cache)) {
+	if sc.grower != nil {
+		sc.grower.mu.RLock()
+		defer sc.grower.mu.RUnlock()
+	}
+	for _, v := range sc.table.Load().shards {
+		f(v.cache)
+	}
+}
+
+// evictEach is like each, but f returns the items it evicted from each
+// shard, and their eviction function is only called once each has returned.
+// Called any earlier, it could deadlock by using the cache while a split is
+// waiting for the shards to be released.
+func (sc *shardedCache) evictEach(f func(c *cache) []keyAndValue) {
+	type shardEvictions struct {
+		c     *cache
+		items []keyAndValue
+	}
+	var evicted []shardEvictions
+	sc.each(func(c *cache) {
+		if items := f(c); len(items) > 0 {
+			evicted = append(evicted, shardEvictions{c, items})
+		}
+	})
+	for _, v := range evicted {
+		v.c.callEvicted(v.items)
+	}
 }
 
 func (sc *shardedCache) Set(k string, x interface{}, d time.Duration) {
-	sc.bucket(k).Set(k, x, d)
+	sc.do(k, func(c *cache) { c.Set(k, x, d) })
+}
+
+func (sc *shardedCache) Add(k string, x interface{}, d time.Duration) (err error) {
+	sc.do(k, func(c *cache) { err = c.Add(k, x, d) })
+	return
+}
+
+func (sc *shardedCache) Replace(k string, x interface{}, d time.Duration) (err error) {
+	sc.do(k, func(c *cache) { err = c.Replace(k, x, d) })
+	return
 }
 
-func (sc *shardedCache) Add(k string, x interface{}, d time.Duration) error {
-	return sc.bucket(k).Add(k, x, d)
+func (sc *shardedCache) Get(k string) (x interface{}, found bool) {
+	sc.do(k, func(c *cache) { x, found = c.Get(k) })
+	return
 }
 
-func (sc *shardedCache) Replace(k string, x interface{}, d time.Duration) error {
-	return sc.bucket(k).Replace(k, x, d)
+func (sc *shardedCache) SetNotFound(k string, d time.Duration) {
+	sc.do(k, func(c *cache) { c.SetNotFound(k, d) })
 }
 
-func (sc *shardedCache) Get(k string) (interface{}, bool) {
-	return sc.bucket(k).Get(k)
+func (sc *shardedCache) Lookup(k string) (it Item, status LookupStatus) {
+	sc.do(k, func(c *cache) { it, status = c.Lookup(k) })
+	return
 }
 
-func (sc *shardedCache) Increment(k string, n int64) error {
-	return sc.bucket(k).Increment(k, n)
+// Returns the number of negative hits in all shards. See cache.NegativeHits.
+func (sc *shardedCache) NegativeHits() int64 {
+	var n int64
+	sc.each(func(c *cache) {
+		n += c.NegativeHits()
+	})
+	return n
 }
 
-func (sc *shardedCache) IncrementFloat(k string, n float64) error {
-	return sc.bucket(k).IncrementFloat(k, n)
+func (sc *shardedCache) SetWithRecompute(k string, x interface{}, d, recompute time.Duration) {
+	sc.do(k, func(c *cache) { c.SetWithRecompute(k, x, d, recompute) })
 }
 
-func (sc *shardedCache) Decrement(k string, n int64) error {
-	return sc.bucket(k).Decrement(k, n)
+// Turns on early expiration in every shard. See cache.SetEarlyExpiration.
+func (sc *shardedCache) SetEarlyExpiration(beta float64) {
+	sc.each(func(c *cache) { c.SetEarlyExpiration(beta) })
 }
 
+func (sc *shardedCache) SetWithJitter(k string, x interface{}, d time.Duration, j Jitter) {
+	sc.do(k, func(c *cache) { c.SetWithJitter(k, x, d, j) })
+}
+
+func (sc *shardedCache) Increment(k string, n int64) (err error) {
+	sc.do(k, func(c *cache) { err = c.Increment(k, n) })
+	return
+}
+
+func (sc *shardedCache) IncrementFloat(k string, n float64) (err error) {
+	sc.do(k, func(c *cache) { err = c.IncrementFloat(k, n) })
+	return
+}
+
+func (sc *shardedCache) Decrement(k string, n int64) (err error) {
+	sc.do(k, func(c *cache) { err = c.Decrement(k, n) })
+	return
+}
+
+// Delete an item from the cache. As with evictEach, the eviction function is
+// called once the shard is released.
 func (sc *shardedCache) Delete(k string) {
-	sc.bucket(k).Delete(k)
+	var (
+		c       *cache
+		v       interface{}
+		evicted bool
+	)
+	sc.do(k, func(s *cache) {
+		c = s
+		v, evicted = s.remove(k)
+	})
+	if evicted {
+		c.onEvicted(k, v)
+	}
 }
 
-func (sc *shardedCache) DeleteExpired() {
-	for _, v := range sc.cs {
-		v.DeleteExpired()
+func (sc *shardedCache) Watch(k string) (<-chan Event, func()) {
+	return sc.watch(k, false)
+}
+
+// Watch every item whose key starts with prefix in every shard. Events for
+// keys in different shards may arrive out of order.
+func (sc *shardedCache) WatchPrefix(prefix string) (<-chan Event, func()) {
+	return sc.watch(prefix, true)
+}
+
+// watch adds a watch to the shard k is in, or to every shard if prefix is set.
+// If the cache can grow, splitting a shard moves or copies its watches.
+func (sc *shardedCache) watch(k string, prefix bool) (<-chan Event, func()) {
+	var lock sync.Locker
+	if sc.grower != nil {
+		lock = sc.grower.mu.RLocker()
+	}
+	return watchIn(func() []*cache {
+		if prefix {
+			return sc.caches()
+		}
+		return []*cache{sc.bucket(k)}
+	}, lock, k, prefix)
+}
+
+// caches returns the shards.
+func (sc *shardedCache) caches() []*cache {
+	shards := sc.table.Load().shards
+	cs := make([]*cache, len(shards))
+	for i, v := range shards {
+		cs[i] = v.cache
 	}
+	return cs
+}
+
+func (sc *shardedCache) SetWithTags(k string, x interface{}, d time.Duration, tags ...string) {
+	sc.do(k, func(c *cache) { c.SetWithTags(k, x, d, tags...) })
+}
+
+// Deletes every item tagged with tag. Each shard is invalidated atomically,
+// but not the shards as a whole.
+func (sc *shardedCache) InvalidateTag(tag string) {
+	sc.evictEach(func(c *cache) []keyAndValue { return c.removeTagged(tag) })
+}
+
+func (sc *shardedCache) DeletePrefix(prefix string) {
+	sc.evictEach(func(c *cache) []keyAndValue {
+		return c.removeWhere(func(k string) bool {
+			return strings.HasPrefix(k, prefix)
+		})
+	})
+}
+
+func (sc *shardedCache) DeleteMatching(pattern string) {
+	sc.evictEach(func(c *cache) []keyAndValue {
+		return c.removeWhere(func(k string) bool {
+			return match(pattern, k)
+		})
+	})
+}
+
+func (sc *shardedCache) DeleteExpired() {
+	sc.evictEach(func(c *cache) []keyAndValue { return c.removeExpired() })
 }
 
 // Returns the items in the cache. This may include items that have expired,
@@ -110,19 +322,61 @@ func (sc *shardedCache) DeleteExpired() {
 // is needed to use a cache and its corresponding Items() return values at
 // the same time, as the maps are shared.
 func (sc *shardedCache) Items() []map[string]Item {
-	res := make([]map[string]Item, len(sc.cs))
-	for i, v := range sc.cs {
-		res[i] = v.Items()
-	}
+	var res []map[string]Item
+	sc.each(func(c *cache) {
+		res = append(res, c.Items())
+	})
 	return res
 }
 
-func (sc *shardedCache) Flush() {
-	for _, v := range sc.cs {
-		v.Flush()
+// Calls f for every unexpired item, one shard at a time, until f returns
+// false. See cache.Range. If the cache grows meanwhile, items that move to a
+// new shard may be missed, or seen twice.
+func (sc *shardedCache) Range(f func(k string, it Item) bool) {
+	more := true
+	for _, v := range sc.caches() {
+		v.Range(func(k string, it Item) bool {
+			more = f(k, it)
+			return more
+		})
+		if !more {
+			return
+		}
 	}
 }
 
+// Like Range, but each shard is locked while its items are visited, so that
+// they are seen as they were at one point in time. The shards are not all
+// locked at once. See cache.RangeSnapshot.
+func (sc *shardedCache) RangeSnapshot(f func(k string, it Item) bool) {
+	more := true
+	for _, v := range sc.caches() {
+		v.RangeSnapshot(func(k string, it Item) bool {
+			more = f(k, it)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+func (sc *shardedCache) All() iter.Seq2[string, Item] {
+	return sc.Range
+}
+
+func (sc *shardedCache) Keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		sc.Range(func(k string, _ Item) bool {
+			return yield(k)
+		})
+	}
+}
+
+func (sc *shardedCache) Flush() {
+	sc.each(func(c *cache) { c.Flush() })
+}
+
 type shardedJanitor struct {
 	Interval time.Duration
 	stop     chan bool
@@ -153,28 +407,39 @@ func runShardedJanitor(sc *shardedCache, ci time.Duration) {
 	go j.Run(sc)
 }
 
-func newShardedCache(n int, de time.Duration) *shardedCache {
-	max := big.NewInt(0).SetUint64(uint64(math.MaxUint32))
+// randomSeed returns a random seed for a shard hash.
+func randomSeed() uint64 {
+	max := big.NewInt(0).SetUint64(uint64(math.MaxUint64))
 	rnd, err := rand.Int(rand.Reader, max)
-	var seed uint32
 	if err != nil {
 		os.Stderr.Write([]byte("WARNING: go-cache's newShardedCache failed to read from the system CSPRNG (/dev/urandom or equivalent.) Your system's security may be compromised. Continuing with an insecure seed.\n"))
-		seed = insecurerand.Uint32()
-	} else {
-		seed = uint32(rnd.Uint64())
+		return insecurerand.Uint64()
 	}
-	sc := &shardedCache{
-		seed: seed,
-		m:    uint32(n),
-		cs:   make([]*cache, n),
+	return rnd.Uint64()
+}
+
+// newShardedCache returns a sharded cache with n shards, picking shards for
+// keys with h, or with newMaphashHash() if h is nil.
+func newShardedCache(n int, de time.Duration, h shardHash) *shardedCache {
+	if h == nil {
+		h = newMaphashHash()
+	}
+	t := &shardTable{
+		m:      uint32(n),
+		shards: make([]*shard, n),
 	}
 	for i := 0; i < n; i++ {
 		c := &cache{
 			defaultExpiration: de,
 			items:             map[string]Item{},
+			seed:              maphash.MakeSeed(),
 		}
-		sc.cs[i] = c
+		t.shards[i] = &shard{cache: c}
+	}
+	sc := &shardedCache{
+		hash: h,
 	}
+	sc.table.Store(t)
 	return sc
 }
 
@@ -182,7 +447,17 @@ func unexportedNewSharded(defaultExpiration, cleanupInterval time.Duration, shar
 	if defaultExpiration == 0 {
 		defaultExpiration = -1
 	}
-	sc := newShardedCache(shards, defaultExpiration)
+	return unexportedNewShardedWithHash(defaultExpiration, cleanupInterval, shards, nil)
+}
+
+// Like unexportedNewSharded, but picks shards for keys with the given hash
+// function, e.g. newXXHash() for long keys that are known to be benign. See
+// shardHash.
+func unexportedNewShardedWithHash(defaultExpiration, cleanupInterval time.Duration, shards int, h shardHash) *unexportedShardedCache {
+	if defaultExpiration == 0 {
+		defaultExpiration = -1
+	}
+	sc := newShardedCache(shards, defaultExpiration, h)
 	SC := &unexportedShardedCache{sc}
 	if cleanupInterval > 0 {
 		runShardedJanitor(sc, cleanupInterval)
@@ -2,13 +2,36 @@ package cache
 
 import (
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
-// func TestDjb33(t *testing.T) {
-// }
+// djb33Reference is djb33 written plainly, to check the unrolled version.
+func djb33Reference(seed uint32, k string) uint32 {
+	d := 5381 + seed + uint32(len(k))
+	for i := 0; i < len(k); i++ {
+		d = (d * 33) ^ uint32(k[i])
+	}
+	return d ^ (d >> 16)
+}
+
+func TestDjb33(t *testing.T) {
+	var b []byte
+	for n := 0; n < 40; n++ {
+		k := string(b)
+		for _, seed := range []uint32{0, 1, 0xdeadbeef} {
+			if h, want := djb33(seed, k), djb33Reference(seed, k); h != want {
+				t.Errorf("djb33(%d, %q) = %d, expected %d", seed, k, h, want)
+			}
+		}
+		if djb33(1, k) == djb33(2, k) {
+			t.Errorf("The seed didn't change the hash of %q", k)
+		}
+		b = append(b, byte('a'+n%26))
+	}
+}
 
 var shardedKeys = []string{
 	"f",
@@ -83,3 +106,57 @@ func benchmarkShardedCacheGetManyConcurrent(b *testing.B, exp time.Duration) {
 	b.StartTimer()
 	wg.Wait()
 }
+
+func TestShardedCacheInvalidateTag(t *testing.T) {
+	tc := unexportedNewSharded(DefaultExpiration, 0, 13)
+	for _, v := range shardedKeys {
+		tc.SetWithTags(v, "value", DefaultExpiration, "all")
+	}
+	tc.Set("untagged", "value", DefaultExpiration)
+	tc.InvalidateTag("all")
+	for _, v := range shardedKeys {
+		if _, found := tc.Get(v); found {
+			t.Errorf("%s was found after its tag was invalidated", v)
+		}
+	}
+	if _, found := tc.Get("untagged"); !found {
+		t.Error("untagged was not found")
+	}
+}
+
+func TestShardedCacheDeletePrefix(t *testing.T) {
+	tc := unexportedNewSharded(DefaultExpiration, 0, 13)
+	for _, v := range shardedKeys {
+		tc.Set(v, "value", DefaultExpiration)
+	}
+	tc.DeletePrefix("foo")
+	tc.DeleteMatching("baz*")
+	for _, v := range shardedKeys {
+		_, found := tc.Get(v)
+		if want := !strings.HasPrefix(v, "foo") && !strings.HasPrefix(v, "baz"); found != want {
+			t.Errorf("%s: found is %v, should be %v", v, found, want)
+		}
+	}
+}
+
+func TestShardedCacheRange(t *testing.T) {
+	tc := unexportedNewSharded(DefaultExpiration, 0, 13)
+	for _, v := range shardedKeys {
+		tc.Set(v, "value", DefaultExpiration)
+	}
+	seen := map[string]bool{}
+	for k := range tc.Keys() {
+		seen[k] = true
+	}
+	if len(seen) != len(shardedKeys) {
+		t.Errorf("Expected %d keys, got %d", len(shardedKeys), len(seen))
+	}
+	n := 0
+	tc.RangeSnapshot(func(k string, it Item) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Errorf("RangeSnapshot didn't stop when asked to, %d calls", n)
+	}
+}
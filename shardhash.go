@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+// A shardHash hashes keys to pick the shards of a sharded cache. It must
+// always return the same hash for the same key, and is called concurrently.
+//
+// An attacker who controls the keys and can work out how they are hashed can
+// pick keys that all go to the same shard, making it as contended as an
+// unsharded cache. Each hash below has a random seed, so that keys can't be
+// picked offline, but only newMaphashHash is designed to keep its seed from
+// being worked out, so it is the default and should be used for keys that
+// come from untrusted input.
+type shardHash func(k string) uint32
+
+// Returns djb33 with a random seed. It is fast for short keys, but spreads
+// keys evenly only over a number of shards that isn't a power of two, and
+// since the seed is only added to its starting state, keys found to collide
+// for one seed mostly collide for any.
+func newDjb33Hash() shardHash {
+	seed := uint32(randomSeed())
+	return func(k string) uint32 {
+		return djb33(seed, k)
+	}
+}
+
+// Returns a hash using hash/maphash with a random seed, which resists keys
+// chosen to collide. This is the default.
+func newMaphashHash() shardHash {
+	seed := maphash.MakeSeed()
+	return func(k string) uint32 {
+		h := maphash.String(seed, k)
+		return uint32(h ^ h>>32)
+	}
+}
+
+// Returns xxHash (XXH64) with a random seed. It is fast for long keys, and
+// spreads them well, but isn't designed to resist keys chosen to collide.
+func newXXHash() shardHash {
+	seed := randomSeed()
+	return func(k string) uint32 {
+		h := xxhash64(seed, k)
+		return uint32(h ^ h>>32)
+	}
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 is XXH64. Like djb33, it reads from the string directly so as not
+// to convert it to a []byte.
+func xxhash64(seed uint64, k string) uint64 {
+	n := len(k)
+	i := 0
+	var h uint64
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for ; i <= n-32; i += 32 {
+			v1 = xxRound(v1, readUint64(k, i))
+			v2 = xxRound(v2, readUint64(k, i+8))
+			v3 = xxRound(v3, readUint64(k, i+16))
+			v4 = xxRound(v4, readUint64(k, i+24))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+	h += uint64(n)
+	for ; i <= n-8; i += 8 {
+		h ^= xxRound(0, readUint64(k, i))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if i <= n-4 {
+		h ^= uint64(readUint32(k, i)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		i += 4
+	}
+	for ; i < n; i++ {
+		h ^= uint64(k[i]) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func readUint64(k string, i int) uint64 {
+	return uint64(k[i]) | uint64(k[i+1])<<8 | uint64(k[i+2])<<16 | uint64(k[i+3])<<24 |
+		uint64(k[i+4])<<32 | uint64(k[i+5])<<40 | uint64(k[i+6])<<48 | uint64(k[i+7])<<56
+}
+
+func readUint32(k string, i int) uint32 {
+	return uint32(k[i]) | uint32(k[i+1])<<8 | uint32(k[i+2])<<16 | uint32(k[i+3])<<24
+}
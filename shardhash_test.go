@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var shardHashes = []struct {
+	name string
+	new  func() shardHash
+	// djb33 mixes its low bits poorly, so it only spreads keys evenly over
+	// a number of shards that isn't a power of two, and its seed is only
+	// added to its starting state, so keys that collide under one seed
+	// mostly collide under any.
+	weak bool
+}{
+	{"djb33", newDjb33Hash, true},
+	{"maphash", newMaphashHash, false},
+	{"xxhash", newXXHash, false},
+}
+
+func TestXXHash64(t *testing.T) {
+	for _, v := range []struct {
+		k    string
+		seed uint64
+		h    uint64
+	}{
+		{"", 0, 0xef46db3751d8e999},
+		{"a", 0, 0xd24ec4f1a98c6e5b},
+		{"abc", 0, 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0, 0xfbcea83c8a378bf1},
+	} {
+		if h := xxhash64(v.seed, v.k); h != v.h {
+			t.Errorf("xxhash64(%d, %q) = %#x, expected %#x", v.seed, v.k, h, v.h)
+		}
+	}
+	if xxhash64(1, "abc") == xxhash64(2, "abc") {
+		t.Error("The seed didn't change the hash")
+	}
+}
+
+// chiSquare returns Pearson's chi-squared statistic for counts that should be
+// uniform, and a limit it exceeds with negligible probability if they are.
+func chiSquare(counts []int) (float64, float64) {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	expected := float64(total) / float64(len(counts))
+	x := 0.0
+	for _, n := range counts {
+		d := float64(n) - expected
+		x += d * d / expected
+	}
+	// The statistic has a mean of df and a variance of 2df.
+	df := float64(len(counts) - 1)
+	return x, df + 6*math.Sqrt(2*df)
+}
+
+func shardCounts(h shardHash, shards int, keys []string) []int {
+	counts := make([]int, shards)
+	for _, k := range keys {
+		counts[h(k)%uint32(shards)]++
+	}
+	return counts
+}
+
+func TestShardHashDistribution(t *testing.T) {
+	keySets := map[string][]string{}
+	for i := 0; i < 50000; i++ {
+		keySets["sequential"] = append(keySets["sequential"], "user:"+strconv.Itoa(i))
+		keySets["numbers"] = append(keySets["numbers"], strconv.Itoa(i))
+		keySets["long prefix"] = append(keySets["long prefix"], strings.Repeat("x", 100)+strconv.Itoa(i))
+		keySets["suffix"] = append(keySets["suffix"], strconv.Itoa(i)+strings.Repeat("x", 37))
+	}
+	for i := 0; i < 1<<16; i++ {
+		keySets["two bytes"] = append(keySets["two bytes"], string([]byte{byte(i), byte(i >> 8)}))
+	}
+	for _, h := range shardHashes {
+		for name, keys := range keySets {
+			for _, shards := range []int{13, 64} {
+				if h.weak && shards&(shards-1) == 0 {
+					continue
+				}
+				x, limit := chiSquare(shardCounts(h.new(), shards, keys))
+				if x > limit {
+					t.Errorf("%s spreads %s keys over %d shards unevenly: chi-squared is %.1f, above %.1f", h.name, name, shards, x, limit)
+				}
+			}
+		}
+	}
+}
+
+// Keys picked to all go to the same shard of one cache should be spread out
+// in another, whose hash has a different seed, so that an attacker can't
+// find them offline or reuse them across restarts.
+func TestShardHashAdversarialKeys(t *testing.T) {
+	const shards = 64
+	for _, h := range shardHashes {
+		if h.weak {
+			continue
+		}
+		known := h.new()
+		var keys []string
+		for i := 0; len(keys) < 1000; i++ {
+			k := "id=" + strconv.Itoa(i)
+			if known(k)%shards == 0 {
+				keys = append(keys, k)
+			}
+		}
+		for trial := 0; trial < 3; trial++ {
+			x, limit := chiSquare(shardCounts(h.new(), shards, keys))
+			if x > limit {
+				t.Errorf("%s with a new seed still sends colliding keys to few shards: chi-squared is %.1f, above %.1f", h.name, x, limit)
+			}
+		}
+	}
+}
+
+func BenchmarkShardHash(b *testing.B) {
+	for _, h := range shardHashes {
+		for _, k := range []string{"foo", "user:1234567", strings.Repeat("x", 100)} {
+			f := h.new()
+			b.Run(h.name+"/"+strconv.Itoa(len(k)), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					f(k)
+				}
+			})
+		}
+	}
+}
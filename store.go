@@ -0,0 +1,379 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A Store is the backing store a StoreCache sits in front of, e.g. a database.
+// Its methods must be safe for concurrent use.
+type Store interface {
+	// Returns the value for k, or ErrNotInStore if there is none.
+	Get(k string) (interface{}, error)
+	// Stores x as the value for k.
+	Put(k string, x interface{}) error
+	// Deletes the value for k. Deleting a missing key is not an error.
+	Delete(k string) error
+}
+
+// ErrNotInStore is returned by a Store, and by StoreCache.Get, if there is no
+// value for a key.
+var ErrNotInStore = errors.New("cache: not in store")
+
+// A StoreMode decides how a StoreCache writes to its store.
+type StoreMode int
+
+const (
+	// Writes only go to the cache. The store is only read from, on misses.
+	ReadThrough StoreMode = iota
+	// Writes go to the store, and then, if that succeeded, to the cache.
+	WriteThrough
+	// Writes go to the cache right away, and to the store in batches in
+	// the background. Only the latest write to each key is kept, and
+	// writes that fail are retried with the next batch.
+	WriteBehind
+)
+
+// A StoreCache is a cache in front of a Store. Get reads through to the store
+// on a miss, and Set and Delete write to the store as the cache's StoreMode
+// says.
+//
+// The cache it was given can still be used directly, e.g. to Flush it, but
+// anything done that way bypasses the store.
+type StoreCache struct {
+	*storeCache
+	// If this is confusing, see the comment at the bottom of New()
+}
+
+type storeCache struct {
+	c     *Cache
+	store Store
+	mode  StoreMode
+
+	// For WriteBehind: the writes that haven't been made yet, and those
+	// being made by the current flush. flushMu keeps flushes in order.
+	mu       sync.Mutex
+	pending  map[string]pendingWrite
+	flushing map[string]pendingWrite
+	flushMu  sync.Mutex
+	flusher  *janitor
+	// The error returned by the last Sync, including those run in the
+	// background.
+	syncErr error
+	// Keys being loaded from the store by Get, or written through to it
+	// by Set and Delete.
+	keys map[string]*storeKey
+}
+
+type pendingWrite struct {
+	x       interface{}
+	deleted bool
+}
+
+// A storeKey tracks a key being loaded or written through. Its generation is
+// bumped by Set and Delete, so that a value loaded meanwhile isn't cached, and
+// its lock makes writes through to the store and the cache in the same order.
+type storeKey struct {
+	refs int
+	gen  uint64
+	mu   sync.Mutex
+}
+
+// Return a new StoreCache putting c in front of store. In WriteBehind mode,
+// pending writes are made every flushInterval, as well as by Sync and Close,
+// which should be called before the StoreCache is discarded so that no writes
+// are lost.
+func NewStoreCache(c *Cache, store Store, mode StoreMode, flushInterval time.Duration) *StoreCache {
+	sc := &storeCache{
+		c:       c,
+		store:   store,
+		mode:    mode,
+		pending: map[string]pendingWrite{},
+		keys:    map[string]*storeKey{},
+	}
+	SC := &StoreCache{sc}
+	if mode == WriteBehind && flushInterval > 0 {
+		sc.flusher = &janitor{
+			Interval: flushInterval,
+			stop:     make(chan bool),
+		}
+		go sc.flusher.Run(syncer{sc})
+		runtime.SetFinalizer(SC, stopFlusher)
+	}
+	return SC
+}
+
+// syncer lets a janitor run Sync periodically.
+type syncer struct {
+	sc *storeCache
+}
+
+func (s syncer) DeleteExpired() {
+	s.sc.Sync()
+}
+
+func stopFlusher(sc *StoreCache) {
+	sc.flusher.stop <- true
+}
+
+// Get the value for k from the cache, or, if it isn't there, from the store,
+// adding it to the cache with the default expiration. Returns ErrNotInStore if
+// the store doesn't have it either, or if k was cached as missing (see
+// SetNotFound.)
+func (sc *storeCache) Get(k string) (interface{}, error) {
+	it, status := sc.c.Lookup(k)
+	switch status {
+	case Found:
+		return it.Object, nil
+	case NotFound:
+		return nil, ErrNotInStore
+	}
+	sc.mu.Lock()
+	if sc.mode == WriteBehind {
+		// The item may have left the cache before its write was made.
+		w, found := sc.pending[k]
+		if !found {
+			w, found = sc.flushing[k]
+		}
+		if found {
+			sc.mu.Unlock()
+			if w.deleted {
+				return nil, ErrNotInStore
+			}
+			return w.x, nil
+		}
+	}
+	e := sc.acquire(k)
+	gen := e.gen
+	sc.mu.Unlock()
+
+	x, err := sc.store.Get(k)
+
+	sc.mu.Lock()
+	// Don't overwrite a value set, or resurrect one deleted, while this
+	// one was loading.
+	if err == nil && e.gen == gen {
+		sc.c.Add(k, x, DefaultExpiration)
+	}
+	sc.release(k, e)
+	sc.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// acquire returns the storeKey for k, adding one if need be. sc.mu must be
+// held, and release called when the storeKey is no longer used.
+func (sc *storeCache) acquire(k string) *storeKey {
+	e, found := sc.keys[k]
+	if !found {
+		e = &storeKey{}
+		sc.keys[k] = e
+	}
+	e.refs++
+	return e
+}
+
+// release drops the storeKey for k once nothing uses it. sc.mu must be held.
+func (sc *storeCache) release(k string, e *storeKey) {
+	if e.refs--; e.refs == 0 {
+		delete(sc.keys, k)
+	}
+}
+
+// written bumps the generation of k if it's being loaded. sc.mu must be held,
+// and the write must be made to the cache before it's released.
+func (sc *storeCache) written(k string) {
+	if e, found := sc.keys[k]; found {
+		e.gen++
+	}
+}
+
+// writeThrough makes a write to the store with write, and then, if it
+// succeeded, to the cache with update, holding k's lock throughout so that
+// concurrent writes to k are made to both in the same order.
+func (sc *storeCache) writeThrough(k string, write func() error, update func()) error {
+	sc.mu.Lock()
+	e := sc.acquire(k)
+	sc.mu.Unlock()
+	e.mu.Lock()
+	err := write()
+	sc.mu.Lock()
+	if err == nil {
+		sc.written(k)
+		update()
+	}
+	sc.release(k, e)
+	sc.mu.Unlock()
+	e.mu.Unlock()
+	return err
+}
+
+// Set the value for k in the cache, with the given expiration (see
+// Cache.Set), and in the store as the cache's StoreMode says. In WriteThrough
+// mode, returns the store's error, if any, and leaves the cache alone if there
+// is one.
+func (sc *storeCache) Set(k string, x interface{}, d time.Duration) error {
+	switch sc.mode {
+	case WriteThrough:
+		return sc.writeThrough(k, func() error {
+			return sc.store.Put(k, x)
+		}, func() {
+			sc.c.Set(k, x, d)
+		})
+	case WriteBehind:
+		sc.mu.Lock()
+		sc.pending[k] = pendingWrite{x: x}
+		sc.written(k)
+		sc.c.Set(k, x, d)
+		sc.mu.Unlock()
+		return nil
+	}
+	sc.mu.Lock()
+	sc.written(k)
+	sc.c.Set(k, x, d)
+	sc.mu.Unlock()
+	return nil
+}
+
+// Delete k from the cache, and from the store as the cache's StoreMode says.
+// In WriteThrough mode, returns the store's error, if any, and leaves the
+// cache alone if there is one.
+func (sc *storeCache) Delete(k string) error {
+	switch sc.mode {
+	case WriteThrough:
+		return sc.writeThrough(k, func() error {
+			return sc.store.Delete(k)
+		}, func() {
+			sc.c.Delete(k)
+		})
+	case WriteBehind:
+		sc.mu.Lock()
+		sc.pending[k] = pendingWrite{deleted: true}
+		sc.written(k)
+		sc.c.Delete(k)
+		sc.mu.Unlock()
+		return nil
+	}
+	sc.mu.Lock()
+	sc.written(k)
+	sc.c.Delete(k)
+	sc.mu.Unlock()
+	return nil
+}
+
+// Returns the number of writes waiting to be made to the store.
+func (sc *storeCache) Pending() int {
+	sc.mu.Lock()
+	n := len(sc.pending)
+	sc.mu.Unlock()
+	return n
+}
+
+// Make all pending writes to the store now. Writes that fail are kept to be
+// retried, unless the key has been written again since, and their errors are
+// returned.
+func (sc *storeCache) Sync() error {
+	sc.flushMu.Lock()
+	defer sc.flushMu.Unlock()
+	sc.mu.Lock()
+	batch := sc.pending
+	sc.pending = map[string]pendingWrite{}
+	sc.flushing = batch
+	sc.mu.Unlock()
+
+	var errs []error
+	failed := map[string]pendingWrite{}
+	for k, w := range batch {
+		var err error
+		if w.deleted {
+			err = sc.store.Delete(k)
+		} else {
+			err = sc.store.Put(k, w.x)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Item %s couldn't be written: %w", k, err))
+			failed[k] = w
+		}
+	}
+
+	err := errors.Join(errs...)
+	sc.mu.Lock()
+	for k, w := range failed {
+		if _, found := sc.pending[k]; !found {
+			sc.pending[k] = w
+		}
+	}
+	sc.flushing = nil
+	sc.syncErr = err
+	sc.mu.Unlock()
+	return err
+}
+
+// Returns the error returned by the last Sync, or nil if it succeeded. This is
+// how failures of the writes made in the background every flushInterval are
+// reported; the writes themselves are retried.
+func (sc *storeCache) SyncError() error {
+	sc.mu.Lock()
+	err := sc.syncErr
+	sc.mu.Unlock()
+	return err
+}
+
+// Stop writing to the store in the background, and make all pending writes.
+// Returns the errors of any that failed.
+func (sc *StoreCache) Close() error {
+	if sc.flusher != nil {
+		runtime.SetFinalizer(sc, nil)
+		sc.flusher.stop <- true
+		sc.flusher = nil
+	}
+	return sc.Sync()
+}
+
+// A MemoryStore is a Store that keeps values in a map. It is meant for tests.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+// Return a new, empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: map[string]interface{}{}}
+}
+
+func (s *MemoryStore) Get(k string) (interface{}, error) {
+	s.mu.RLock()
+	x, found := s.values[k]
+	s.mu.RUnlock()
+	if !found {
+		return nil, ErrNotInStore
+	}
+	return x, nil
+}
+
+func (s *MemoryStore) Put(k string, x interface{}) error {
+	s.mu.Lock()
+	s.values[k] = x
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Delete(k string) error {
+	s.mu.Lock()
+	delete(s.values, k)
+	s.mu.Unlock()
+	return nil
+}
+
+// Returns the number of values in the store.
+func (s *MemoryStore) Len() int {
+	s.mu.RLock()
+	n := len(s.values)
+	s.mu.RUnlock()
+	return n
+}
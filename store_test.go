@@ -0,0 +1,300 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyStore fails every write while failing is set, and counts reads.
+type flakyStore struct {
+	*MemoryStore
+	mu      sync.Mutex
+	failing bool
+	gets    int
+}
+
+var errFlaky = errors.New("store is down")
+
+func (s *flakyStore) Get(k string) (interface{}, error) {
+	s.mu.Lock()
+	s.gets++
+	s.mu.Unlock()
+	return s.MemoryStore.Get(k)
+}
+
+func (s *flakyStore) Put(k string, x interface{}) error {
+	s.mu.Lock()
+	failing := s.failing
+	s.mu.Unlock()
+	if failing {
+		return errFlaky
+	}
+	return s.MemoryStore.Put(k, x)
+}
+
+func (s *flakyStore) Delete(k string) error {
+	s.mu.Lock()
+	failing := s.failing
+	s.mu.Unlock()
+	if failing {
+		return errFlaky
+	}
+	return s.MemoryStore.Delete(k)
+}
+
+func (s *flakyStore) fail(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+
+func TestStoreCacheReadThrough(t *testing.T) {
+	store := &flakyStore{MemoryStore: NewMemoryStore()}
+	store.Put("foo", "bar")
+	tc := New(DefaultExpiration, 0)
+	sc := NewStoreCache(tc, store, ReadThrough, 0)
+
+	for i := 0; i < 3; i++ {
+		if x, err := sc.Get("foo"); err != nil || x != "bar" {
+			t.Fatal("Get returned", x, err)
+		}
+	}
+	if store.gets != 1 {
+		t.Errorf("Expected 1 read from the store, got %d", store.gets)
+	}
+	if _, err := sc.Get("missing"); err != ErrNotInStore {
+		t.Error("Expected ErrNotInStore, got", err)
+	}
+	tc.SetNotFound("known", DefaultExpiration)
+	if _, err := sc.Get("known"); err != ErrNotInStore || store.gets != 2 {
+		t.Error("A key cached as missing was read from the store:", err)
+	}
+
+	sc.Set("foo", "baz", DefaultExpiration)
+	sc.Set("new", 1, DefaultExpiration)
+	if x, _ := store.Get("foo"); x != "bar" || store.Len() != 1 {
+		t.Error("A ReadThrough cache wrote to the store")
+	}
+	if x, _ := sc.Get("foo"); x != "baz" {
+		t.Error("Get didn't return the value set in the cache:", x)
+	}
+}
+
+func TestStoreCacheWriteThrough(t *testing.T) {
+	store := &flakyStore{MemoryStore: NewMemoryStore()}
+	tc := New(DefaultExpiration, 0)
+	sc := NewStoreCache(tc, store, WriteThrough, 0)
+
+	if err := sc.Set("foo", "bar", DefaultExpiration); err != nil {
+		t.Fatal(err)
+	}
+	if x, _ := store.Get("foo"); x != "bar" {
+		t.Error("Set didn't write to the store")
+	}
+	if x, found := tc.Get("foo"); !found || x != "bar" {
+		t.Error("Set didn't write to the cache")
+	}
+
+	store.fail(true)
+	if err := sc.Set("foo", "baz", DefaultExpiration); err != errFlaky {
+		t.Error("Expected the store's error, got", err)
+	}
+	if x, _ := tc.Get("foo"); x != "bar" {
+		t.Error("A failed write changed the cache")
+	}
+	if err := sc.Delete("foo"); err != errFlaky {
+		t.Error("Expected the store's error, got", err)
+	}
+	store.fail(false)
+	if err := sc.Delete("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.Get("foo"); err != ErrNotInStore {
+		t.Error("Delete didn't delete from both the cache and the store:", err)
+	}
+}
+
+func TestStoreCacheWriteBehind(t *testing.T) {
+	store := &flakyStore{MemoryStore: NewMemoryStore()}
+	store.Put("old", 1)
+	tc := New(DefaultExpiration, 0)
+	sc := NewStoreCache(tc, store, WriteBehind, 0)
+
+	for i := 0; i < 10; i++ {
+		sc.Set("foo"+strconv.Itoa(i%5), i, DefaultExpiration)
+	}
+	sc.Delete("old")
+	if n := sc.Pending(); n != 6 {
+		t.Errorf("Expected 6 pending writes, got %d", n)
+	}
+	if store.Len() != 1 {
+		t.Error("Writes were made before a flush")
+	}
+	// Pending writes are visible even if the cache loses them.
+	tc.Flush()
+	if x, err := sc.Get("foo4"); err != nil || x != 9 {
+		t.Error("Get didn't return a pending write:", x, err)
+	}
+	if _, err := sc.Get("old"); err != ErrNotInStore {
+		t.Error("Get returned a value with a pending delete:", err)
+	}
+
+	store.fail(true)
+	if err := sc.Sync(); !errors.Is(err, errFlaky) {
+		t.Error("Expected Sync to return the store's error, got", err)
+	}
+	if err := sc.SyncError(); !errors.Is(err, errFlaky) {
+		t.Error("Expected SyncError to return the store's error, got", err)
+	}
+	if n := sc.Pending(); n != 6 {
+		t.Errorf("Failed writes weren't kept to be retried, %d are pending", n)
+	}
+	// A newer write isn't overwritten by a retry of an older one.
+	sc.Set("foo0", "newer", DefaultExpiration)
+	store.fail(false)
+	if err := sc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := sc.Pending(); n != 0 {
+		t.Errorf("Close left %d writes pending", n)
+	}
+	if err := sc.SyncError(); err != nil {
+		t.Error("Expected no error after a successful Sync, got", err)
+	}
+	if store.Len() != 5 {
+		t.Errorf("Expected 5 values in the store, got %d", store.Len())
+	}
+	if x, _ := store.Get("foo0"); x != "newer" {
+		t.Error("The store has a stale value:", x)
+	}
+	if _, err := store.Get("old"); err != ErrNotInStore {
+		t.Error("The pending delete wasn't made")
+	}
+}
+
+func TestStoreCacheWriteBehindInterval(t *testing.T) {
+	store := NewMemoryStore()
+	sc := NewStoreCache(New(DefaultExpiration, 0), store, WriteBehind, 1*time.Millisecond)
+	defer sc.Close()
+	sc.Set("foo", "bar", DefaultExpiration)
+	deadline := time.Now().Add(5 * time.Second)
+	for store.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The write was never flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// slowStore reads a value, then blocks until released, like a store whose
+// reply is slow to arrive.
+type slowStore struct {
+	*MemoryStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) Get(k string) (interface{}, error) {
+	x, err := s.MemoryStore.Get(k)
+	s.started <- struct{}{}
+	<-s.release
+	return x, err
+}
+
+func TestStoreCacheGetDuringDelete(t *testing.T) {
+	for _, mode := range []StoreMode{ReadThrough, WriteThrough, WriteBehind} {
+		store := &slowStore{
+			MemoryStore: NewMemoryStore(),
+			started:     make(chan struct{}),
+			release:     make(chan struct{}),
+		}
+		store.Put("foo", "bar")
+		store.Put("bar", "old")
+		tc := New(DefaultExpiration, 0)
+		sc := NewStoreCache(tc, store, mode, 0)
+
+		done := make(chan struct{})
+		go func() {
+			sc.Get("foo")
+			close(done)
+		}()
+		<-store.started
+		sc.Delete("foo")
+		if mode == WriteBehind {
+			sc.Sync()
+		}
+		close(store.release)
+		<-done
+		if _, found := tc.Get("foo"); found {
+			t.Errorf("Mode %d: a value loaded while its key was deleted was cached", mode)
+		}
+
+		// Nor is a value loaded while the key was set.
+		store.release = make(chan struct{})
+		done = make(chan struct{})
+		go func() {
+			sc.Get("bar")
+			close(done)
+		}()
+		<-store.started
+		sc.Set("bar", "new", DefaultExpiration)
+		if mode == WriteBehind {
+			sc.Sync()
+		}
+		close(store.release)
+		<-done
+		if x, _ := tc.Get("bar"); x != "new" {
+			t.Errorf("Mode %d: a value loaded while its key was set was cached: %v", mode, x)
+		}
+		sc.Close()
+	}
+}
+
+// pausingStore pauses while writing the value 1, after writing it.
+type pausingStore struct {
+	*MemoryStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *pausingStore) Put(k string, x interface{}) error {
+	s.MemoryStore.Put(k, x)
+	if x == 1 {
+		s.started <- struct{}{}
+		<-s.release
+	}
+	return nil
+}
+
+func TestStoreCacheWriteThroughConcurrent(t *testing.T) {
+	store := &pausingStore{
+		MemoryStore: NewMemoryStore(),
+		started:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	tc := New(DefaultExpiration, 0)
+	sc := NewStoreCache(tc, store, WriteThrough, 0)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sc.Set("foo", 1, DefaultExpiration)
+	}()
+	<-store.started
+	go func() {
+		defer wg.Done()
+		sc.Set("foo", 2, DefaultExpiration)
+	}()
+	// Give the second Set time to get ahead of the first, if it can.
+	time.Sleep(10 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+	cached, _ := tc.Get("foo")
+	stored, _ := store.Get("foo")
+	if cached != stored {
+		t.Errorf("The cache has %v, but the store has %v", cached, stored)
+	}
+}
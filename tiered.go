@@ -0,0 +1,598 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TieredCache is a cache with two tiers: an in-memory tier that holds at
+// most a fixed number of items, and an on-disk tier that items spill to when
+// the memory tier is full. A Get that misses in memory checks the disk tier and
+// promotes the item back into memory if it is found there.
+//
+// Items are written to disk using Gob, so the same caveats as for Save() apply:
+// the types of the values stored in the cache should be gob-encodable, and
+// registered with gob.Register() if they are to be read back by a different
+// process. Items that can't be encoded are kept in memory instead of being
+// spilled.
+type TieredCache struct {
+	*tieredCache
+	// If this is confusing, see the comment at the bottom of New()
+}
+
+type tieredCache struct {
+	defaultExpiration time.Duration
+	maxItems          int
+	items             map[string]Item
+	mu                sync.Mutex
+	onEvicted         func(string, interface{})
+	disk              *segmentLog
+	janitor           *janitor
+}
+
+// Add an item to the cache, replacing any existing item. If the duration is 0
+// (DefaultExpiration), the cache's default expiration time is used. If it is -1
+// (NoExpiration), the item never expires. If the memory tier is full, another
+// item is spilled to disk to make room.
+func (c *tieredCache) Set(k string, x interface{}, d time.Duration) error {
+	c.mu.Lock()
+	err := c.set(k, x, d)
+	c.mu.Unlock()
+	return err
+}
+
+func (c *tieredCache) set(k string, x interface{}, d time.Duration) error {
+	var e int64
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	if d > 0 {
+		e = time.Now().Add(d).UnixNano()
+	}
+	return c.store(k, Item{
+		Object:     x,
+		Expiration: e,
+	})
+}
+
+// store puts an item into the memory tier, spilling another item to disk if
+// the memory tier is already at capacity, and then drops any older copy of it
+// from the disk tier. If none of the items in memory can be written to disk,
+// the item is written there instead.
+func (c *tieredCache) store(k string, item Item) error {
+	if _, found := c.items[k]; !found && len(c.items) >= c.maxItems {
+		spilled, err := c.spill()
+		if err != nil {
+			return err
+		}
+		if !spilled {
+			return c.disk.put(k, item)
+		}
+	}
+	c.items[k] = item
+	c.disk.remove(k)
+	return nil
+}
+
+// spill moves one item from the memory tier to the disk tier, and reports
+// whether there was one that could be. Map iteration order is random, so this
+// picks an arbitrary victim, skipping those that can't be encoded. Expired
+// items are spilled like any other and left for DeleteExpired to clean up.
+func (c *tieredCache) spill() (bool, error) {
+	for k, v := range c.items {
+		rec, err := encodeRecord(k, v)
+		if err != nil {
+			continue
+		}
+		if err := c.disk.write(k, rec, v.Expiration); err != nil {
+			return false, err
+		}
+		delete(c.items, k)
+		return true, nil
+	}
+	return false, nil
+}
+
+// Add an item to the cache, replacing any existing item, using the default
+// expiration.
+func (c *tieredCache) SetDefault(k string, x interface{}) error {
+	return c.Set(k, x, DefaultExpiration)
+}
+
+// Add an item to the cache only if an item doesn't already exist for the given
+// key in either tier, or if the existing item has expired. Returns an error
+// otherwise.
+func (c *tieredCache) Add(k string, x interface{}, d time.Duration) error {
+	c.mu.Lock()
+	_, found, err := c.get(k)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if found {
+		c.mu.Unlock()
+		return fmt.Errorf("Item %s already exists", k)
+	}
+	err = c.set(k, x, d)
+	c.mu.Unlock()
+	return err
+}
+
+// Set a new value for the cache key only if it already exists in either tier,
+// and the existing item hasn't expired. Returns an error otherwise.
+func (c *tieredCache) Replace(k string, x interface{}, d time.Duration) error {
+	c.mu.Lock()
+	_, found, err := c.get(k)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if !found {
+		c.mu.Unlock()
+		return fmt.Errorf("Item %s doesn't exist", k)
+	}
+	err = c.set(k, x, d)
+	c.mu.Unlock()
+	return err
+}
+
+// Get an item from the cache. Returns the item or nil, and a bool indicating
+// whether the key was found. Items found on disk are promoted into memory.
+// Disk errors are treated as misses; use GetWithExpiration to observe them.
+func (c *tieredCache) Get(k string) (interface{}, bool) {
+	c.mu.Lock()
+	item, found, _ := c.get(k)
+	c.mu.Unlock()
+	if !found {
+		return nil, false
+	}
+	return item.Object, true
+}
+
+// GetWithExpiration returns an item and its expiration time from the cache.
+// It returns the item or nil, the expiration time if one is set (if the item
+// never expires a zero value for time.Time is returned), a bool indicating
+// whether the key was found, and any error encountered reading the disk tier.
+func (c *tieredCache) GetWithExpiration(k string) (interface{}, time.Time, bool, error) {
+	c.mu.Lock()
+	item, found, err := c.get(k)
+	c.mu.Unlock()
+	if !found {
+		return nil, time.Time{}, false, err
+	}
+	if item.Expiration > 0 {
+		return item.Object, time.Unix(0, item.Expiration), true, nil
+	}
+	return item.Object, time.Time{}, true, nil
+}
+
+// get looks k up in memory, then on disk, promoting a disk hit into memory.
+func (c *tieredCache) get(k string) (Item, bool, error) {
+	now := time.Now().UnixNano()
+	item, found := c.items[k]
+	if found {
+		if item.Expiration > 0 && now > item.Expiration {
+			return Item{}, false, nil
+		}
+		return item, true, nil
+	}
+	item, found, err := c.disk.get(k)
+	if err != nil || !found {
+		return Item{}, false, err
+	}
+	if item.Expiration > 0 && now > item.Expiration {
+		return Item{}, false, nil
+	}
+	// If there's no room in memory, the item stays where it is.
+	c.store(k, item)
+	return item, true, nil
+}
+
+// Delete an item from the cache. Does nothing if the key is not in the cache.
+func (c *tieredCache) Delete(k string) {
+	c.mu.Lock()
+	v, evicted := c.delete(k)
+	c.mu.Unlock()
+	if evicted {
+		c.onEvicted(k, v)
+	}
+}
+
+func (c *tieredCache) delete(k string) (interface{}, bool) {
+	if v, found := c.items[k]; found {
+		delete(c.items, k)
+		return v.Object, c.onEvicted != nil
+	}
+	if c.onEvicted != nil {
+		if v, found, err := c.disk.get(k); err == nil && found {
+			c.disk.remove(k)
+			return v.Object, true
+		}
+	}
+	c.disk.remove(k)
+	return nil, false
+}
+
+// Delete all expired items from both tiers of the cache.
+func (c *tieredCache) DeleteExpired() {
+	var evictedItems []keyAndValue
+	now := time.Now().UnixNano()
+	c.mu.Lock()
+	for k, v := range c.items {
+		// "Inlining" of expired
+		if v.Expiration > 0 && now > v.Expiration {
+			ov, evicted := c.delete(k)
+			if evicted {
+				evictedItems = append(evictedItems, keyAndValue{k, ov})
+			}
+		}
+	}
+	for _, k := range c.disk.expired(now) {
+		ov, evicted := c.delete(k)
+		if evicted {
+			evictedItems = append(evictedItems, keyAndValue{k, ov})
+		}
+	}
+	c.mu.Unlock()
+	for _, v := range evictedItems {
+		c.onEvicted(v.key, v.value)
+	}
+}
+
+// Sets an (optional) function that is called with the key and value when an
+// item is evicted from the cache. (Including when it is deleted manually, but
+// not when it is overwritten or spilled to disk.) Set to nil to disable.
+func (c *tieredCache) OnEvicted(f func(string, interface{})) {
+	c.mu.Lock()
+	c.onEvicted = f
+	c.mu.Unlock()
+}
+
+// Returns the number of items in the memory and disk tiers, respectively. This
+// may include items that have expired, but have not yet been cleaned up.
+func (c *tieredCache) ItemCount() (memory, disk int) {
+	c.mu.Lock()
+	memory, disk = len(c.items), len(c.disk.index)
+	c.mu.Unlock()
+	return
+}
+
+// Delete all items from both tiers of the cache.
+func (c *tieredCache) Flush() error {
+	c.mu.Lock()
+	c.items = map[string]Item{}
+	err := c.disk.reset()
+	c.mu.Unlock()
+	return err
+}
+
+// Close stops the janitor, if any, and removes the cache's segment files.
+// The cache must not be used after it has been closed.
+func (c *TieredCache) Close() error {
+	if c.janitor != nil {
+		runtime.SetFinalizer(c, nil)
+		stopTieredJanitor(c)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = map[string]Item{}
+	return c.disk.close()
+}
+
+func stopTieredJanitor(c *TieredCache) {
+	c.janitor.stop <- true
+}
+
+// Return a new tiered cache with a given default expiration duration and
+// cleanup interval (see New()), which keeps at most maxItems items in memory
+// and spills the rest to segment files in dir. The directory is created if it
+// doesn't exist. It should be dedicated to the cache: any segment files left
+// in it by a previous instance are removed, since the disk index only lives
+// in memory.
+func NewTiered(defaultExpiration, cleanupInterval time.Duration, maxItems int, dir string) (*TieredCache, error) {
+	if maxItems < 1 {
+		return nil, fmt.Errorf("maxItems must be at least 1, got %d", maxItems)
+	}
+	disk, err := openSegmentLog(dir, defaultSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	if defaultExpiration == 0 {
+		defaultExpiration = -1
+	}
+	c := &tieredCache{
+		defaultExpiration: defaultExpiration,
+		maxItems:          maxItems,
+		items:             make(map[string]Item, maxItems),
+		disk:              disk,
+	}
+	C := &TieredCache{c}
+	if cleanupInterval > 0 {
+		c.janitor = &janitor{
+			Interval: cleanupInterval,
+			stop:     make(chan bool),
+		}
+		go c.janitor.Run(c)
+		runtime.SetFinalizer(C, stopTieredJanitor)
+	}
+	return C, nil
+}
+
+const (
+	defaultSegmentSize = 64 << 20
+	segmentSuffix      = ".seg"
+	recordHeaderSize   = 16
+)
+
+// A segmentLog is an append-only log of gob-encoded items split across
+// segment files, with an in-memory index pointing at the latest record for
+// each key. A segment file is removed once none of the records in it are live
+// anymore, and compacted, by copying its live records to the active segment,
+// once less than half of it is. Compacting a segment looks through the whole
+// index for the records in it.
+type segmentLog struct {
+	dir     string
+	maxSize int64
+	segs    map[uint32]*segment
+	active  *segment
+	nextID  uint32
+	index   map[string]diskEntry
+}
+
+type segment struct {
+	id   uint32
+	f    *os.File
+	size int64
+	// The number of live records in the segment, and their size.
+	live      int
+	liveBytes int64
+}
+
+type diskEntry struct {
+	seg        uint32
+	off        int64
+	size       uint32
+	expiration int64
+}
+
+func openSegmentLog(dir string, maxSize int64) (*segmentLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range old {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	l := &segmentLog{
+		dir:     dir,
+		maxSize: maxSize,
+		segs:    map[uint32]*segment{},
+		index:   map[string]diskEntry{},
+	}
+	return l, nil
+}
+
+func (l *segmentLog) segmentPath(id uint32) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%08d%s", id, segmentSuffix))
+}
+
+// rotate closes off the active segment, if any, and starts a new one.
+func (l *segmentLog) rotate() error {
+	if l.active != nil {
+		if err := l.active.f.Sync(); err != nil {
+			return err
+		}
+		prev := l.active
+		l.active = nil
+		if prev.live == 0 {
+			l.drop(prev)
+		}
+	}
+	f, err := os.OpenFile(l.segmentPath(l.nextID), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	s := &segment{id: l.nextID, f: f}
+	l.segs[s.id] = s
+	l.active = s
+	l.nextID++
+	return nil
+}
+
+func (l *segmentLog) drop(s *segment) {
+	delete(l.segs, s.id)
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
+
+// encodeRecord returns the record for the item k.
+func encodeRecord(k string, item Item) (rec []byte, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("Error registering item types with Gob library")
+		}
+	}()
+	gob.Register(item.Object)
+	var buf bytes.Buffer
+	buf.Write(make([]byte, recordHeaderSize))
+	buf.WriteString(k)
+	if err = gob.NewEncoder(&buf).Encode(&item.Object); err != nil {
+		return nil, err
+	}
+	rec = buf.Bytes()
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(k)))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(rec)-recordHeaderSize-len(k)))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(item.Expiration))
+	return rec, nil
+}
+
+// put writes a record for the item k, replacing any older one.
+func (l *segmentLog) put(k string, item Item) error {
+	rec, err := encodeRecord(k, item)
+	if err != nil {
+		return err
+	}
+	return l.write(k, rec, item.Expiration)
+}
+
+// write appends the record rec for k to the active segment, and then points
+// the index at it, dropping the older record for k, if any.
+func (l *segmentLog) write(k string, rec []byte, expiration int64) error {
+	e, err := l.append(rec, expiration)
+	if err != nil {
+		return err
+	}
+	old, found := l.index[k]
+	l.index[k] = e
+	if found {
+		l.release(old)
+	}
+	return nil
+}
+
+// append appends rec to the active segment, starting a new one if it's full,
+// and returns the index entry for it.
+func (l *segmentLog) append(rec []byte, expiration int64) (diskEntry, error) {
+	if l.active == nil || (l.active.size > 0 && l.active.size+int64(len(rec)) > l.maxSize) {
+		if err := l.rotate(); err != nil {
+			return diskEntry{}, err
+		}
+	}
+	s := l.active
+	if _, err := s.f.WriteAt(rec, s.size); err != nil {
+		return diskEntry{}, err
+	}
+	e := diskEntry{
+		seg:        s.id,
+		off:        s.size,
+		size:       uint32(len(rec)),
+		expiration: expiration,
+	}
+	s.size += int64(len(rec))
+	s.live++
+	s.liveBytes += int64(len(rec))
+	return e, nil
+}
+
+// get reads the latest record for k back from disk.
+func (l *segmentLog) get(k string) (Item, bool, error) {
+	e, found := l.index[k]
+	if !found {
+		return Item{}, false, nil
+	}
+	rec := make([]byte, e.size)
+	if _, err := l.segs[e.seg].f.ReadAt(rec, e.off); err != nil && err != io.EOF {
+		return Item{}, false, err
+	}
+	klen := binary.LittleEndian.Uint32(rec[0:])
+	if got := string(rec[recordHeaderSize : recordHeaderSize+klen]); got != k {
+		return Item{}, false, fmt.Errorf("Corrupt segment record for %s: found key %s", k, got)
+	}
+	item := Item{Expiration: e.expiration}
+	dec := gob.NewDecoder(bytes.NewReader(rec[recordHeaderSize+klen:]))
+	if err := dec.Decode(&item.Object); err != nil {
+		return Item{}, false, err
+	}
+	return item, true, nil
+}
+
+// remove drops k from the index.
+func (l *segmentLog) remove(k string) {
+	e, found := l.index[k]
+	if !found {
+		return
+	}
+	delete(l.index, k)
+	l.release(e)
+}
+
+// release marks the record e as no longer live, which must no longer be in
+// the index. Its segment is removed if that was its last live record, or
+// compacted if less than half of it is live anymore.
+func (l *segmentLog) release(e diskEntry) {
+	s := l.segs[e.seg]
+	s.live--
+	s.liveBytes -= int64(e.size)
+	if s == l.active {
+		return
+	}
+	if s.live == 0 {
+		l.drop(s)
+	} else if s.liveBytes*2 < s.size {
+		l.compact(s)
+	}
+}
+
+// compact copies the live records in s to the active segment, and removes s.
+// If a record can't be copied, s is left with the records that weren't.
+func (l *segmentLog) compact(s *segment) {
+	for k, e := range l.index {
+		if e.seg != s.id {
+			continue
+		}
+		rec := make([]byte, e.size)
+		if _, err := s.f.ReadAt(rec, e.off); err != nil && err != io.EOF {
+			return
+		}
+		moved, err := l.append(rec, e.expiration)
+		if err != nil {
+			return
+		}
+		l.index[k] = moved
+		s.live--
+		s.liveBytes -= int64(e.size)
+	}
+	l.drop(s)
+}
+
+// expired returns the keys of all records that have expired as of now.
+func (l *segmentLog) expired(now int64) []string {
+	var ks []string
+	for k, e := range l.index {
+		if e.expiration > 0 && now > e.expiration {
+			ks = append(ks, k)
+		}
+	}
+	return ks
+}
+
+// reset removes every segment and empties the index.
+func (l *segmentLog) reset() error {
+	err := l.close()
+	l.segs = map[uint32]*segment{}
+	l.index = map[string]diskEntry{}
+	return err
+}
+
+func (l *segmentLog) close() error {
+	var errs []string
+	for _, s := range l.segs {
+		if err := s.f.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+		if err := os.Remove(s.f.Name()); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	l.segs = nil
+	l.active = nil
+	l.index = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("Error closing segment log: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
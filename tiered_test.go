@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestTiered(t *testing.T, de time.Duration, maxItems int) *TieredCache {
+	tc, err := NewTiered(de, 0, maxItems, t.TempDir())
+	if err != nil {
+		t.Fatal("Couldn't create tiered cache:", err)
+	}
+	t.Cleanup(func() { tc.Close() })
+	return tc
+}
+
+func TestTieredCache(t *testing.T) {
+	tc := newTestTiered(t, DefaultExpiration, 2)
+
+	for i := 0; i < 10; i++ {
+		if err := tc.Set("k"+strconv.Itoa(i), i, DefaultExpiration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	memory, disk := tc.ItemCount()
+	if memory != 2 || disk != 8 {
+		t.Errorf("Expected 2 items in memory and 8 on disk, got %d and %d", memory, disk)
+	}
+	for i := 0; i < 10; i++ {
+		x, found := tc.Get("k" + strconv.Itoa(i))
+		if !found {
+			t.Fatalf("k%d was not found", i)
+		}
+		if x.(int) != i {
+			t.Errorf("k%d is not %d: %v", i, i, x)
+		}
+	}
+	memory, disk = tc.ItemCount()
+	if memory != 2 || disk != 8 {
+		t.Errorf("Promotion changed the item counts to %d and %d", memory, disk)
+	}
+}
+
+func TestTieredCacheTimes(t *testing.T) {
+	tc := newTestTiered(t, 50*time.Millisecond, 1)
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, NoExpiration)
+	tc.Set("c", 3, 20*time.Millisecond)
+	tc.Set("d", 4, 70*time.Millisecond)
+
+	<-time.After(25 * time.Millisecond)
+	if _, found := tc.Get("c"); found {
+		t.Error("Found c when it should have been automatically deleted")
+	}
+
+	<-time.After(30 * time.Millisecond)
+	if _, found := tc.Get("a"); found {
+		t.Error("Found a when it should have been automatically deleted")
+	}
+	if _, found := tc.Get("b"); !found {
+		t.Error("Did not find b even though it was set to never expire")
+	}
+	if _, _, found, _ := tc.GetWithExpiration("d"); !found {
+		t.Error("Did not find d even though it was set to expire later than the default")
+	}
+
+	<-time.After(20 * time.Millisecond)
+	if _, found := tc.Get("d"); found {
+		t.Error("Found d when it should have been automatically deleted (later than the default)")
+	}
+}
+
+func TestTieredCacheDeleteExpired(t *testing.T) {
+	tc := newTestTiered(t, DefaultExpiration, 1)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Set("a", "a", 10*time.Millisecond)
+	tc.Set("b", "b", 10*time.Millisecond)
+	tc.Set("c", "c", NoExpiration)
+	<-time.After(20 * time.Millisecond)
+	tc.DeleteExpired()
+	if len(evicted) != 2 {
+		t.Errorf("Expected 2 evictions, got %v", evicted)
+	}
+	memory, disk := tc.ItemCount()
+	if memory+disk != 1 {
+		t.Errorf("Expected 1 item left, got %d in memory and %d on disk", memory, disk)
+	}
+	if x, found := tc.Get("c"); !found || x.(string) != "c" {
+		t.Error("c was not found")
+	}
+}
+
+func TestTieredCacheAddReplaceDelete(t *testing.T) {
+	tc := newTestTiered(t, DefaultExpiration, 1)
+	tc.Set("foo", "bar", DefaultExpiration)
+	tc.Set("baz", "qux", DefaultExpiration) // spills foo
+
+	if err := tc.Add("foo", "baz", DefaultExpiration); err == nil {
+		t.Error("Add of a key that is on disk succeeded")
+	}
+	if err := tc.Replace("foo", "baz", DefaultExpiration); err != nil {
+		t.Error("Replace of a key that is on disk failed:", err)
+	}
+	if x, _ := tc.Get("foo"); x.(string) != "baz" {
+		t.Error("foo was not replaced:", x)
+	}
+
+	var evicted interface{}
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = v
+	})
+	tc.Set("quux", 1, DefaultExpiration) // spills foo or baz
+	tc.Delete("baz")
+	if evicted != "qux" {
+		t.Error("OnEvicted was not called with the on-disk value:", evicted)
+	}
+	if _, found := tc.Get("baz"); found {
+		t.Error("baz was found after being deleted")
+	}
+	if err := tc.Replace("baz", 1, DefaultExpiration); err == nil {
+		t.Error("Replace of a deleted key succeeded")
+	}
+}
+
+func TestTieredCacheSegments(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "00000007"+segmentSuffix)
+	if err := os.WriteFile(stale, []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tc, err := NewTiered(DefaultExpiration, 0, 1, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Stale segment file was not removed")
+	}
+	tc.disk.maxSize = 1
+	for i := 0; i < 5; i++ {
+		tc.Set("k"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if len(tc.disk.segs) != 4 {
+		t.Errorf("Expected one segment per spilled item, got %d", len(tc.disk.segs))
+	}
+	for i := 0; i < 4; i++ {
+		tc.Delete("k" + strconv.Itoa(i))
+	}
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(segs) != 1 {
+		t.Errorf("Expected only the active segment to be left, got %v", segs)
+	}
+	if err := tc.Flush(); err != nil {
+		t.Error("Flush failed:", err)
+	}
+	if memory, disk := tc.ItemCount(); memory != 0 || disk != 0 {
+		t.Errorf("Flush left %d items in memory and %d on disk", memory, disk)
+	}
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	if err := tc.Close(); err != nil {
+		t.Error("Close failed:", err)
+	}
+	segs, _ = filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if len(segs) != 0 {
+		t.Errorf("Close left segment files behind: %v", segs)
+	}
+}
+
+func TestTieredCacheUnserializable(t *testing.T) {
+	tc := newTestTiered(t, DefaultExpiration, 1)
+	tc.Set("chan", make(chan bool), DefaultExpiration)
+	if err := tc.Set("foo", "bar", DefaultExpiration); err != nil {
+		t.Error("Unserializable item in memory made an unrelated Set fail:", err)
+	}
+	if _, found := tc.Get("chan"); !found {
+		t.Error("chan was not found")
+	}
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Error("foo is not bar:", x)
+	}
+	if err := tc.Set("foo", make(chan int), DefaultExpiration); err == nil {
+		t.Error("Writing an unserializable value to disk succeeded")
+	}
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Error("Failed Set lost the old value:", x)
+	}
+}
+
+func TestTieredCacheCompaction(t *testing.T) {
+	tc := newTestTiered(t, DefaultExpiration, 1)
+	tc.Set("k0", 0, DefaultExpiration)
+	tc.Set("k1", 1, DefaultExpiration)
+	tc.disk.maxSize = 4 * int64(tc.disk.index["k0"].size)
+	for i := 2; i < 10; i++ {
+		tc.Set("k"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	first := tc.disk.segs[tc.disk.index["k0"].seg]
+	if first.live != 4 {
+		t.Fatalf("Expected 4 records in the first segment, got %d", first.live)
+	}
+	for i := 0; i < 3; i++ {
+		tc.Delete("k" + strconv.Itoa(i))
+	}
+	if _, found := tc.disk.segs[first.id]; found {
+		t.Error("Mostly dead segment was not compacted")
+	}
+	if _, err := os.Stat(first.f.Name()); !os.IsNotExist(err) {
+		t.Error("Compacted segment file was not removed")
+	}
+	for i := 3; i < 10; i++ {
+		x, found := tc.Get("k" + strconv.Itoa(i))
+		if !found || x.(int) != i {
+			t.Errorf("k%d is not %d: %v", i, i, x)
+		}
+	}
+}
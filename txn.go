@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// A Tx is a transaction on a cache, passed to the function given to Txn. Its
+// changes are only made to the cache if that function returns nil, and then
+// all at once. A Tx must not be used after the function returns.
+type Tx struct {
+	bucket func(k string) *cache
+	// The caches locked for the transaction, in the order they were locked.
+	locked []*cache
+	writes map[string]txWrite
+	// Keys in the order they were first written to.
+	order []string
+	// Items set by the commit in caches with an item budget.
+	set  []txSet
+	done bool
+}
+
+type txWrite struct {
+	item    Item
+	deleted bool
+	// Whether the item is replaced (with Set), rather than updated in
+	// place (with Increment.)
+	set bool
+}
+
+type txEviction struct {
+	onEvicted func(string, interface{})
+	key       string
+	value     interface{}
+}
+
+type txSet struct {
+	c   *cache
+	key string
+}
+
+// Run f as a transaction on the cache: the cache is locked while f runs, and
+// the changes f makes through the Tx are made to the cache if it returns nil,
+// or discarded if it returns an error (or panics.) Returns f's error. The
+// eviction function, if any, is called for items the transaction deleted
+// after they have been deleted and the cache is unlocked.
+//
+// f must not use the cache directly, or it will deadlock.
+func (c *cache) Txn(f func(tx *Tx) error) error {
+	tx := &Tx{
+		bucket: func(string) *cache { return c },
+		locked: []*cache{c},
+	}
+	return tx.run(f)
+}
+
+// Run f as a transaction on the shards keys are in, as with cache.Txn. Only
+// those shards are locked, in the order of their index so that concurrent
+// transactions can't deadlock, and f may only use the Tx with keys.
+func (sc *shardedCache) Txn(keys []string, f func(tx *Tx) error) error {
+	hs := make([]uint32, len(keys))
+	for i, k := range keys {
+		hs[i] = sc.hash(k)
+	}
+	for {
+		t := sc.table.Load()
+		idx := make([]uint32, len(hs))
+		for i, h := range hs {
+			idx[i] = t.index(h)
+		}
+		slices.Sort(idx)
+		idx = slices.Compact(idx)
+		shards := make([]*shard, len(idx))
+		for i, v := range idx {
+			shards[i] = t.shards[v]
+		}
+		if sc.grower != nil && !lockRouting(sc, t, shards) {
+			continue
+		}
+		tx := &Tx{
+			bucket: func(k string) *cache {
+				return t.shards[t.index(sc.hash(k))].cache
+			},
+			locked: make([]*cache, len(shards)),
+		}
+		for i, v := range shards {
+			tx.locked[i] = v.cache
+		}
+		if sc.grower == nil {
+			return tx.run(f)
+		}
+		// The eviction functions are called once the shards can be split
+		// again, as with evictEach.
+		evicted, err := func() ([]txEviction, error) {
+			defer unlockRouting(shards)
+			return tx.runLocked(f)
+		}()
+		if err != nil {
+			return err
+		}
+		tx.finish(evicted)
+		return nil
+	}
+}
+
+// lockRouting read-locks the routing of shards, so that they can't be split.
+// Returns false, with nothing locked, if the cache grew beyond table t first.
+func lockRouting(sc *shardedCache, t *shardTable, shards []*shard) bool {
+	for _, v := range shards {
+		v.routing.RLock()
+	}
+	if sc.table.Load() != t {
+		unlockRouting(shards)
+		return false
+	}
+	return true
+}
+
+func unlockRouting(shards []*shard) {
+	for i := len(shards) - 1; i >= 0; i-- {
+		shards[i].routing.RUnlock()
+	}
+}
+
+func (tx *Tx) run(f func(tx *Tx) error) error {
+	evicted, err := tx.runLocked(f)
+	if err != nil {
+		return err
+	}
+	tx.finish(evicted)
+	return nil
+}
+
+// finish calls the eviction functions for the items the transaction deleted,
+// and enforces the caches' item limits for the items it set, once the caches
+// are unlocked.
+func (tx *Tx) finish(evicted []txEviction) {
+	for _, v := range evicted {
+		v.onEvicted(v.key, v.value)
+	}
+	for _, v := range tx.set {
+		v.c.budget.admit(v.c, v.key)
+	}
+}
+
+func (tx *Tx) runLocked(f func(tx *Tx) error) ([]txEviction, error) {
+	for _, c := range tx.locked {
+		c.mu.Lock()
+	}
+	defer func() {
+		tx.done = true
+		for i := len(tx.locked) - 1; i >= 0; i-- {
+			tx.locked[i].mu.Unlock()
+		}
+	}()
+	if err := f(tx); err != nil {
+		return nil, err
+	}
+	return tx.commit(), nil
+}
+
+// commit makes the transaction's changes to the cache, which must be locked.
+func (tx *Tx) commit() []txEviction {
+	var evicted []txEviction
+	for _, k := range tx.order {
+		c, w := tx.bucket(k), tx.writes[k]
+		switch {
+		case w.deleted:
+			if v, found := c.delete(k); found {
+				evicted = append(evicted, txEviction{c.onEvicted, k, v})
+			}
+		case w.set:
+			c.setItem(k, w.item)
+			if c.budget != nil {
+				tx.set = append(tx.set, txSet{c, k})
+			}
+		default:
+			c.items[k] = w.item
+			if c.watchers != nil {
+				c.watchers.notify(EventSet, k, w.item.Object)
+			}
+		}
+	}
+	return evicted
+}
+
+// cache returns the cache k is in, making sure it's one the transaction has
+// locked.
+func (tx *Tx) cache(k string) *cache {
+	if tx.done {
+		panic("cache: Tx used after its transaction ended")
+	}
+	c := tx.bucket(k)
+	for _, v := range tx.locked {
+		if v == c {
+			return c
+		}
+	}
+	panic(fmt.Sprintf("cache: key %q is not part of the transaction", k))
+}
+
+func (tx *Tx) write(k string, w txWrite) {
+	if tx.writes == nil {
+		tx.writes = map[string]txWrite{}
+	}
+	if _, found := tx.writes[k]; !found {
+		tx.order = append(tx.order, k)
+	}
+	tx.writes[k] = w
+}
+
+// lookup returns the item for k as the transaction sees it.
+func (tx *Tx) lookup(k string) (Item, bool) {
+	c := tx.cache(k)
+	if w, found := tx.writes[k]; found {
+		return w.item, !w.deleted
+	}
+	item, found := c.items[k]
+	if !found || item.Expired() {
+		return Item{}, false
+	}
+	return item, true
+}
+
+// Get an item, as changed by the transaction so far. Returns the item or nil,
+// and a bool indicating whether the key was found.
+func (tx *Tx) Get(k string) (interface{}, bool) {
+	item, found := tx.lookup(k)
+	if !found || item.NotFound() {
+		return nil, false
+	}
+	return item.Object, true
+}
+
+// Add an item, replacing any existing item, as with Cache.Set.
+func (tx *Tx) Set(k string, x interface{}, d time.Duration) {
+	c := tx.cache(k)
+	tx.write(k, txWrite{
+		item: Item{
+			Object:     x,
+			Expiration: c.expiration(d, c.jitter),
+		},
+		set: true,
+	})
+}
+
+// Delete an item. Does nothing if the key is not in the cache.
+func (tx *Tx) Delete(k string) {
+	tx.cache(k)
+	tx.write(k, txWrite{deleted: true})
+}
+
+// Increment an item of type int, int8, int16, int32, int64, uintptr, uint,
+// uint8, uint32, or uint64, float32 or float64 by n, as with Cache.Increment.
+// Returns an error if the item's value is not a number, or if it was not
+// found.
+func (tx *Tx) Increment(k string, n int64) error {
+	item, found := tx.lookup(k)
+	if !found {
+		return fmt.Errorf("Item %s not found", k)
+	}
+	if !increment(&item, n) {
+		return fmt.Errorf("The value for %s is not an integer", k)
+	}
+	tx.write(k, txWrite{item: item, set: tx.writes[k].set})
+	return nil
+}
@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTxnCommit(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 10, DefaultExpiration)
+	tc.Set("b", 0, DefaultExpiration)
+	tc.Set("gone", "x", DefaultExpiration)
+
+	err := tc.Txn(func(tx *Tx) error {
+		if err := tx.Increment("a", -3); err != nil {
+			return err
+		}
+		if err := tx.Increment("b", 3); err != nil {
+			return err
+		}
+		tx.Set("c", "new", DefaultExpiration)
+		tx.Delete("gone")
+		if x, found := tx.Get("a"); !found || x != 7 {
+			t.Error("The Tx didn't see its own increment:", x)
+		}
+		if _, found := tx.Get("gone"); found {
+			t.Error("The Tx saw an item it deleted")
+		}
+		if x, found := tx.Get("c"); !found || x != "new" {
+			t.Error("The Tx didn't see an item it set:", x)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, _ := tc.Get("a"); x != 7 {
+		t.Error("a is", x, "not 7")
+	}
+	if x, _ := tc.Get("b"); x != 3 {
+		t.Error("b is", x, "not 3")
+	}
+	if x, _ := tc.Get("c"); x != "new" {
+		t.Error("c is", x, "not new")
+	}
+	if _, found := tc.Get("gone"); found {
+		t.Error("gone was not deleted")
+	}
+}
+
+func TestTxnRollback(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 10, DefaultExpiration)
+	tc.Set("b", 0, DefaultExpiration)
+
+	errStop := errors.New("stop")
+	err := tc.Txn(func(tx *Tx) error {
+		tx.Increment("a", -3)
+		tx.Set("c", "new", DefaultExpiration)
+		tx.Delete("b")
+		return errStop
+	})
+	if err != errStop {
+		t.Error("Expected the function's error, got", err)
+	}
+	if x, _ := tc.Get("a"); x != 10 {
+		t.Error("A rolled back increment was kept:", x)
+	}
+	if _, found := tc.Get("b"); !found {
+		t.Error("A rolled back delete was kept")
+	}
+	if _, found := tc.Get("c"); found {
+		t.Error("A rolled back set was kept")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("The panic wasn't passed on")
+			}
+		}()
+		tc.Txn(func(tx *Tx) error {
+			tx.Set("a", 0, DefaultExpiration)
+			panic("oops")
+		})
+	}()
+	if x, _ := tc.Get("a"); x != 10 {
+		t.Error("A transaction that panicked was committed:", x)
+	}
+	// The cache was unlocked.
+	tc.Set("d", 1, DefaultExpiration)
+}
+
+func TestTxnIncrementErrors(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("s", "string", DefaultExpiration)
+	err := tc.Txn(func(tx *Tx) error {
+		if err := tx.Increment("missing", 1); err == nil {
+			t.Error("Incremented a missing item")
+		}
+		if err := tx.Increment("s", 1); err == nil {
+			t.Error("Incremented a string")
+		}
+		tx.Delete("s")
+		tx.Set("n", int8(1), DefaultExpiration)
+		if err := tx.Increment("n", 2); err != nil {
+			t.Error(err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, _ := tc.Get("n"); x != int8(3) {
+		t.Error("n is", x, "not 3")
+	}
+}
+
+func TestTxnOnEvicted(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("foo", 3, DefaultExpiration)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		// Would deadlock if called with the cache locked.
+		tc.Set("bar", 4, DefaultExpiration)
+		evicted = append(evicted, k)
+	})
+	tc.Txn(func(tx *Tx) error {
+		tx.Delete("foo")
+		tx.Delete("missing")
+		return nil
+	})
+	if len(evicted) != 1 || evicted[0] != "foo" {
+		t.Error("Expected foo to be evicted, got", evicted)
+	}
+	if _, found := tc.Get("bar"); !found {
+		t.Error("The eviction function didn't run")
+	}
+}
+
+func TestTxnUsedAfterEnd(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var leaked *Tx
+	tc.Txn(func(tx *Tx) error {
+		leaked = tx
+		return nil
+	})
+	defer func() {
+		if recover() == nil {
+			t.Error("Using a Tx after its transaction ended didn't panic")
+		}
+	}()
+	leaked.Set("foo", 1, DefaultExpiration)
+}
+
+func TestShardedCacheTxn(t *testing.T) {
+	tc := unexportedNewSharded(DefaultExpiration, 0, 13)
+	const accounts = 20
+	keys := make([]string, accounts)
+	for i := range keys {
+		keys[i] = "account" + strconv.Itoa(i)
+		tc.Set(keys[i], 100, DefaultExpiration)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				from, to := keys[(i+j)%accounts], keys[(i*7+j*3+1)%accounts]
+				err := tc.Txn([]string{from, to}, func(tx *Tx) error {
+					x, _ := tx.Get(from)
+					if x.(int) < 5 {
+						return errors.New("insufficient funds")
+					}
+					tx.Increment(from, -5)
+					tx.Increment(to, 5)
+					return nil
+				})
+				if err != nil && err.Error() != "insufficient funds" {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, k := range keys {
+		x, _ := tc.Get(k)
+		total += x.(int)
+	}
+	if total != accounts*100 {
+		t.Errorf("Transfers changed the total from %d to %d", accounts*100, total)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Using a key outside the transaction didn't panic")
+		}
+	}()
+	tc.Txn([]string{keys[0]}, func(tx *Tx) error {
+		for _, k := range keys {
+			tx.Get(k)
+		}
+		return nil
+	})
+}
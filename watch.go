@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// An EventType says what happened to an item.
+type EventType int
+
+const (
+	// The item was added or replaced, or its value was incremented or
+	// decremented.
+	EventSet EventType = iota + 1
+	// The item was deleted, e.g. with Delete or Flush.
+	EventDelete
+	// The item was deleted after it had expired, usually by the janitor.
+	EventExpire
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "Set"
+	case EventDelete:
+		return "Delete"
+	case EventExpire:
+		return "Expire"
+	}
+	return "Unknown"
+}
+
+// An Event is a change to a watched item.
+type Event struct {
+	Type EventType
+	Key  string
+	// The item's new value for EventSet, or the value it had for
+	// EventDelete and EventExpire.
+	Value interface{}
+	// The number of events that were dropped, because the watcher's
+	// channel was full, since the last one it received. A watcher that
+	// missed events may want to Get the keys it cares about again.
+	Missed int
+}
+
+// Number of events a watcher's channel holds before they are dropped.
+const watchBuffer = 64
+
+// A watch is a single Watch or WatchPrefix.
+type watch struct {
+	key    string
+	prefix bool
+	ch     chan Event
+	missed atomic.Int64
+}
+
+// send delivers e without blocking, counting it as missed if the channel is
+// full.
+func (w *watch) send(e Event) {
+	missed := w.missed.Swap(0)
+	e.Missed = int(missed)
+	select {
+	case w.ch <- e:
+	default:
+		w.missed.Add(missed + 1)
+	}
+}
+
+// watchers holds a cache's watches. It is protected by the cache's lock.
+type watchers struct {
+	keys     map[string][]*watch
+	prefixes []*watch
+}
+
+// notify sends an event to the watches matching k. The cache must be locked.
+func (ws *watchers) notify(t EventType, k string, x interface{}) {
+	for _, w := range ws.keys[k] {
+		w.send(Event{Type: t, Key: k, Value: x})
+	}
+	for _, w := range ws.prefixes {
+		if strings.HasPrefix(k, w.key) {
+			w.send(Event{Type: t, Key: k, Value: x})
+		}
+	}
+}
+
+func (c *cache) addWatch(w *watch) {
+	c.mu.Lock()
+	if c.watchers == nil {
+		c.watchers = &watchers{keys: map[string][]*watch{}}
+	}
+	if w.prefix {
+		c.watchers.prefixes = append(c.watchers.prefixes, w)
+	} else {
+		c.watchers.keys[w.key] = append(c.watchers.keys[w.key], w)
+	}
+	c.mu.Unlock()
+}
+
+func (c *cache) removeWatch(w *watch) {
+	c.mu.Lock()
+	ws := c.watchers
+	if ws == nil {
+		c.mu.Unlock()
+		return
+	}
+	if w.prefix {
+		ws.prefixes = removeWatch(ws.prefixes, w)
+	} else if v := removeWatch(ws.keys[w.key], w); len(v) > 0 {
+		ws.keys[w.key] = v
+	} else {
+		delete(ws.keys, w.key)
+	}
+	if len(ws.keys) == 0 && len(ws.prefixes) == 0 {
+		c.watchers = nil
+	}
+	c.mu.Unlock()
+}
+
+func (c *cache) self() []*cache {
+	return []*cache{c}
+}
+
+func removeWatch(ws []*watch, w *watch) []*watch {
+	for i, v := range ws {
+		if v == w {
+			return append(ws[:i:i], ws[i+1:]...)
+		}
+	}
+	return ws
+}
+
+// watchIn adds a watch to each of caches(), and returns its channel and a
+// function that removes it from each of caches() and closes the channel. If
+// lock isn't nil, it is held while doing either.
+func watchIn(caches func() []*cache, lock sync.Locker, k string, prefix bool) (<-chan Event, func()) {
+	w := &watch{
+		key:    k,
+		prefix: prefix,
+		ch:     make(chan Event, watchBuffer),
+	}
+	if lock != nil {
+		lock.Lock()
+	}
+	for _, c := range caches() {
+		c.addWatch(w)
+	}
+	if lock != nil {
+		lock.Unlock()
+	}
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() {
+			if lock != nil {
+				lock.Lock()
+				defer lock.Unlock()
+			}
+			for _, c := range caches() {
+				c.removeWatch(w)
+			}
+			close(w.ch)
+		})
+	}
+}
+
+// Watch an item for changes. Returns a channel that receives an Event each
+// time the item is set, deleted or deleted after expiring, and a function that
+// stops watching and closes the channel.
+//
+// Changing the cache never waits for watchers: if a watcher's channel is full,
+// the event is dropped, and the number dropped is reported in the Missed field
+// of the next event the watcher gets. Items that expire aren't reported until
+// they are deleted, e.g. by the janitor.
+func (c *cache) Watch(k string) (<-chan Event, func()) {
+	return watchIn(c.self, nil, k, false)
+}
+
+// Watch every item whose key starts with prefix for changes, as with Watch.
+func (c *cache) WatchPrefix(prefix string) (<-chan Event, func()) {
+	return watchIn(c.self, nil, prefix, true)
+}
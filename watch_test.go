@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("No event was sent")
+	}
+	return Event{}
+}
+
+func noEvent(t *testing.T, ch <-chan Event) {
+	t.Helper()
+	select {
+	case e := <-ch:
+		t.Error("Unexpected event:", e)
+	default:
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	ch, cancel := tc.Watch("foo")
+	defer cancel()
+
+	tc.Set("foo", 1, DefaultExpiration)
+	tc.Set("bar", 2, DefaultExpiration)
+	if e := nextEvent(t, ch); e.Type != EventSet || e.Key != "foo" || e.Value != 1 {
+		t.Error("Expected a Set of foo to 1, got", e)
+	}
+	tc.Increment("foo", 2)
+	if e := nextEvent(t, ch); e.Type != EventSet || e.Value != 3 {
+		t.Error("Expected a Set of foo to 3, got", e)
+	}
+	tc.Delete("foo")
+	if e := nextEvent(t, ch); e.Type != EventDelete || e.Value != 3 {
+		t.Error("Expected a Delete of foo, got", e)
+	}
+	tc.Delete("foo")
+	noEvent(t, ch)
+
+	tc.Set("foo", 4, 1*time.Millisecond)
+	nextEvent(t, ch)
+	<-time.After(5 * time.Millisecond)
+	tc.DeleteExpired()
+	if e := nextEvent(t, ch); e.Type != EventExpire || e.Value != 4 {
+		t.Error("Expected foo to expire, got", e)
+	}
+
+	tc.Set("foo", 5, DefaultExpiration)
+	nextEvent(t, ch)
+	tc.Flush()
+	if e := nextEvent(t, ch); e.Type != EventDelete || e.Value != 5 {
+		t.Error("Expected Flush to delete foo, got", e)
+	}
+	noEvent(t, ch)
+}
+
+func TestWatchPrefix(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	ch, cancel := tc.WatchPrefix("config/")
+	tc.Set("config/a", "a", DefaultExpiration)
+	tc.Set("other", "b", DefaultExpiration)
+	tc.Set("config/c", "c", DefaultExpiration)
+	if e := nextEvent(t, ch); e.Key != "config/a" {
+		t.Error("Expected an event for config/a, got", e)
+	}
+	if e := nextEvent(t, ch); e.Key != "config/c" {
+		t.Error("Expected an event for config/c, got", e)
+	}
+	noEvent(t, ch)
+
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("The channel wasn't closed")
+	}
+	if tc.watchers != nil {
+		t.Error("The watch wasn't removed")
+	}
+	tc.Set("config/a", "after", DefaultExpiration)
+}
+
+func TestWatchSlowSubscriber(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	ch, cancel := tc.Watch("n")
+	defer cancel()
+	done := make(chan bool)
+	go func() {
+		// Would block if writers waited for the watcher.
+		for i := 0; i < watchBuffer+10; i++ {
+			tc.Set("n", i, DefaultExpiration)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A writer was blocked by a full watcher")
+	}
+	for i := 0; i < watchBuffer; i++ {
+		if e := <-ch; e.Value != i || e.Missed != 0 {
+			t.Fatalf("Expected event %d, got %v", i, e)
+		}
+	}
+	tc.Set("n", "last", DefaultExpiration)
+	if e := nextEvent(t, ch); e.Value != "last" || e.Missed != 10 {
+		t.Error("Expected 10 missed events to be reported, got", e)
+	}
+}
+
+func TestWatchTxn(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("a", 1, DefaultExpiration)
+	ch, cancel := tc.WatchPrefix("")
+	defer cancel()
+	tc.Txn(func(tx *Tx) error {
+		tx.Increment("a", 1)
+		tx.Set("b", 2, DefaultExpiration)
+		noEvent(t, ch)
+		return nil
+	})
+	if e := nextEvent(t, ch); e.Key != "a" || e.Value != 2 {
+		t.Error("Expected an event for a, got", e)
+	}
+	if e := nextEvent(t, ch); e.Key != "b" || e.Value != 2 {
+		t.Error("Expected an event for b, got", e)
+	}
+}
+
+func TestShardedCacheWatchPrefix(t *testing.T) {
+	tc := unexportedNewSharded(DefaultExpiration, 0, 13)
+	ch, cancel := tc.WatchPrefix("user:")
+	one, cancelOne := tc.Watch("user:3")
+	for i := 0; i < 20; i++ {
+		tc.Set("user:"+strconv.Itoa(i), i, DefaultExpiration)
+		tc.Set("group:"+strconv.Itoa(i), i, DefaultExpiration)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		seen[nextEvent(t, ch).Key] = true
+	}
+	if len(seen) != 20 {
+		t.Error("Expected events for 20 keys, got", len(seen))
+	}
+	noEvent(t, ch)
+	if e := nextEvent(t, one); e.Key != "user:3" {
+		t.Error("Expected an event for user:3, got", e)
+	}
+	noEvent(t, one)
+	cancel()
+	cancelOne()
+	for _, c := range tc.caches() {
+		if c.watchers != nil {
+			t.Fatal("A watch wasn't removed from every shard")
+		}
+	}
+}
+
+func BenchmarkCacheSetWatched(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	_, cancel := tc.Watch("other")
+	defer cancel()
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Set("foo", "bar", DefaultExpiration)
+	}
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Turn on probabilistic early expiration, using the XFetch algorithm, for items
+// added with SetWithRecompute: Get and GetWithExpiration report such an item as
+// not found a little before it expires, with a probability that rises as its
+// expiration time approaches, and the sooner the longer the item took to
+// compute. That way one of the callers usually refreshes it before it
+// expires, rather than all of them at once afterwards.
+//
+// beta scales how early items expire. 1 is a good default, values above 1
+// favor earlier refreshes, and values of 0 or less turn early expiration off
+// (the default.)
+//
+// See "Optimal Probabilistic Cache Stampede Prevention" (Vattani, Chierichetti
+// and Lowenstein, 2015).
+func (c *cache) SetEarlyExpiration(beta float64) {
+	c.mu.Lock()
+	c.beta = beta
+	c.mu.Unlock()
+}
+
+// Add an item to the cache like Set, recording that it took recompute to
+// compute the value, e.g. to load it from a database. The recompute time
+// decides how early the item may expire when early expiration is on (see
+// SetEarlyExpiration.) Setting the item again in any other way forgets it.
+func (c *cache) SetWithRecompute(k string, x interface{}, d, recompute time.Duration) {
+	c.mu.Lock()
+	c.set(k, x, d)
+	if recompute > 0 {
+		if c.deltas == nil {
+			c.deltas = map[string]time.Duration{}
+		}
+		c.deltas[k] = recompute
+	}
+	b := c.budget
+	c.mu.Unlock()
+	if b != nil {
+		b.admit(c, k)
+	}
+}
+
+// For tests.
+var xfetchRand = rand.Float64
+
+// expiresEarly reports whether an unexpired item should be treated as expired
+// at now, which is when
+//
+//	now - recompute * beta * ln(rand()) >= expiration
+//
+// with rand() uniform in (0, 1]. The cache must be read-locked.
+func (c *cache) expiresEarly(k string, item Item, now int64) bool {
+	delta, found := c.deltas[k]
+	if !found {
+		return false
+	}
+	gap := -float64(delta) * c.beta * math.Log(1-xfetchRand())
+	return float64(now)+gap >= float64(item.Expiration)
+}
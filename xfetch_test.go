@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEarlyExpiration(t *testing.T) {
+	defer func(f func() float64) { xfetchRand = f }(xfetchRand)
+	r := 0.0
+	xfetchRand = func() float64 { return r }
+
+	tc := New(DefaultExpiration, 0)
+	tc.SetWithRecompute("foo", "bar", time.Second, 100*time.Millisecond)
+	tc.Set("plain", "bar", time.Second)
+	// 100ms * -ln(1-r) is 2s, which reaches past the expiration time.
+	r = 1 - math.Exp(-20)
+	if _, found := tc.Get("foo"); !found {
+		t.Error("An item expired early with early expiration off")
+	}
+
+	tc.SetEarlyExpiration(1)
+	if _, found := tc.Get("foo"); found {
+		t.Error("An item didn't expire early")
+	}
+	if _, _, found := tc.GetWithExpiration("foo"); found {
+		t.Error("An item didn't expire early with GetWithExpiration")
+	}
+	if _, found := tc.Get("plain"); !found {
+		t.Error("An item without a recompute time expired early")
+	}
+	r = 0
+	if _, found := tc.Get("foo"); !found {
+		t.Error("An item expired early when it shouldn't have")
+	}
+
+	// Setting the item again forgets its recompute time.
+	r = 1 - math.Exp(-20)
+	tc.Set("foo", "baz", time.Second)
+	if _, found := tc.Get("foo"); !found {
+		t.Error("A recompute time survived a Set")
+	}
+	tc.SetWithRecompute("foo", "bar", time.Second, 100*time.Millisecond)
+	tc.Delete("foo")
+	if len(tc.deltas) != 0 {
+		t.Error("Delete didn't forget the recompute time")
+	}
+}
+
+func TestEarlyExpirationProbability(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetEarlyExpiration(1)
+	tc.SetWithRecompute("foo", "bar", time.Minute, time.Minute)
+	// With the recompute time equal to the time left, an item expires
+	// early with a probability of 1/e.
+	n, early := 10000, 0
+	for i := 0; i < n; i++ {
+		if _, found := tc.Get("foo"); !found {
+			early++
+		}
+	}
+	if p := float64(early) / float64(n); p < 0.33 || p > 0.41 {
+		t.Errorf("Expected about %.3f of Gets to miss, got %.3f", 1/math.E, p)
+	}
+}
+
+func BenchmarkCacheGetEarlyExpiration(b *testing.B) {
+	b.StopTimer()
+	tc := New(DefaultExpiration, 0)
+	tc.SetEarlyExpiration(1)
+	tc.SetWithRecompute("foo", "bar", time.Hour, time.Millisecond)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		tc.Get("foo")
+	}
+}